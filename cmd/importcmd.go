@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"butterfly.orx.me/core"
+	"butterfly.orx.me/core/app"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/dao"
+	"go.orx.me/xbot/internal/transcript"
+)
+
+const importUsage = `Usage: xbot import --file <result.json> [options]
+
+Imports the history of a chat exported with Telegram Desktop (Export chat
+history, format JSON) into the configured message storage, so /sum, /ask and
+/hualao see messages sent before the bot joined. Messages already stored are
+left alone, importing the same export again is harmless. Restart a running
+bot afterwards so its history cache sees the imported messages.
+
+Smaller exports of groups and channels can also be uploaded to the chat with
+/import as caption. Exports of a private chat with the bot cannot be uploaded,
+their chat is the bot and their message IDs are those of the user's side.
+
+Options:
+`
+
+// importOptions are the flags of the import subcommand
+type importOptions struct {
+	file   string
+	chatID int64
+	dryRun bool
+}
+
+func parseImportOptions(args []string) (*importOptions, error) {
+	var opts importOptions
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), importUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.file, "file", "", "path of the result.json export")
+	fs.Int64Var(&opts.chatID, "chat", 0, "chat ID to import into, derived from the export when 0")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "parse and count the messages without writing them")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.file == "" {
+		return nil, errors.New("--file is required")
+	}
+	return &opts, nil
+}
+
+// runImport runs the import subcommand and exits the process
+func runImport(args []string) {
+	opts, err := parseImportOptions(args)
+	if err != nil {
+		log.Fatalf("import: %v", err)
+	}
+
+	// Like migrate, the import runs as the last init step of the application
+	os.Args = os.Args[:1]
+	a := core.New(&app.Config{
+		Config:  conf.Conf,
+		Service: "xbot",
+		InitFunc: []func() error{
+			func() error {
+				return dao.Init(context.Background())
+			},
+			func() error {
+				if err := importExport(context.Background(), opts); err != nil {
+					log.Fatalf("import: %v", err)
+				}
+				os.Exit(0)
+				return nil
+			},
+		},
+	})
+	a.Run()
+}
+
+func importExport(ctx context.Context, opts *importOptions) error {
+	f, err := os.Open(opts.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	result, err := transcript.ParseResult(f)
+	if err != nil {
+		return err
+	}
+
+	storage, err := dao.NewMessageStorage(ctx, conf.Conf.MessageStorage)
+	if err != nil {
+		return err
+	}
+	report, err := transcript.Import(ctx, storage, result, transcript.ImportOptions{
+		ChatID: opts.chatID,
+		DryRun: opts.dryRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	verb := "imported"
+	if opts.dryRun {
+		verb = "would import"
+	}
+	log.Printf("chat %d: %s %d messages, %d already stored, %d past retention, %d skipped",
+		report.ChatID, verb, report.Imported, report.Existing, report.Expired, report.Skipped)
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"os"
 
 	"butterfly.orx.me/core"
 	"butterfly.orx.me/core/app"
@@ -9,11 +10,13 @@ import (
 	"go.orx.me/xbot/internal/conf"
 	"go.orx.me/xbot/internal/dao"
 	"go.orx.me/xbot/internal/http"
-	"go.orx.me/xbot/internal/pkg/gemini"
-	"go.orx.me/xbot/internal/pkg/openai"
+	"go.orx.me/xbot/internal/pkg/llm"
 
-	// mysql driver
-	_ "github.com/go-sql-driver/mysql"
+	// Model providers
+	_ "go.orx.me/xbot/internal/pkg/anthropic"
+	_ "go.orx.me/xbot/internal/pkg/gemini"
+	_ "go.orx.me/xbot/internal/pkg/ollama"
+	_ "go.orx.me/xbot/internal/pkg/openai"
 )
 
 func NewApp() *app.App {
@@ -26,15 +29,27 @@ func NewApp() *app.App {
 			func() error {
 				return dao.Init(context.Background())
 			},
-			openai.Init,
+			llm.Init,
 			bot.Init,
-			gemini.Init,
 		},
 	})
 	return app
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		runRotateKeys(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+
 	app := NewApp()
 	app.Run()
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"butterfly.orx.me/core"
+	"butterfly.orx.me/core/app"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/dao"
+)
+
+const migrateUsage = `Usage: xbot migrate --from <storage> --to <storage> --chat <id>[,<id>...] [options]
+
+Copies stored messages of the given chats from one message storage to another.
+Storages are mongodb, s3, mysql and local, configured as for the bot.
+
+Progress is saved to the checkpoint file after every batch, running the same
+command again resumes where it stopped. Copying is idempotent: messages keep
+their ID so copying them twice does not create duplicates. Delete the
+checkpoint file to copy everything again.
+
+Options:
+`
+
+// migrateOptions are the flags of the migrate subcommand
+type migrateOptions struct {
+	from       string
+	to         string
+	chats      []int64
+	since      time.Time
+	until      time.Time
+	batchSize  int
+	checkpoint string
+	dryRun     bool
+}
+
+// migrateCheckpoint records the progress of each chat, keyed by
+// "<from>-<to>-<chat>-<since>-<until>"
+type migrateCheckpoint map[string]*migrateChatState
+
+type migrateChatState struct {
+	Cursor string `json:"cursor"`
+	Copied int    `json:"copied"`
+	Done   bool   `json:"done"`
+}
+
+func parseMigrateOptions(args []string) (*migrateOptions, error) {
+	var (
+		opts  migrateOptions
+		chats string
+		since string
+		until string
+	)
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), migrateUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.from, "from", "", "source message storage")
+	fs.StringVar(&opts.to, "to", "", "destination message storage")
+	fs.StringVar(&chats, "chat", "", "comma separated chat IDs to copy")
+	fs.StringVar(&since, "since", "", "only copy messages created on or after this date (2006-01-02)")
+	fs.StringVar(&until, "until", "", "only copy messages created before this date (2006-01-02)")
+	fs.IntVar(&opts.batchSize, "batch", 500, "number of messages read per batch")
+	fs.StringVar(&opts.checkpoint, "checkpoint", "migrate.checkpoint.json", "file used to resume an interrupted copy")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "read the source and report without writing")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if opts.from == "" || opts.to == "" || chats == "" {
+		fs.Usage()
+		return nil, errors.New("--from, --to and --chat are required")
+	}
+	if opts.from == opts.to {
+		return nil, errors.New("--from and --to must be different storages")
+	}
+	var err error
+	if opts.chats, err = parseChatIDs(chats); err != nil {
+		return nil, err
+	}
+	if since != "" {
+		if opts.since, err = time.ParseInLocation("2006-01-02", since, time.Local); err != nil {
+			return nil, fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+	if until != "" {
+		if opts.until, err = time.ParseInLocation("2006-01-02", until, time.Local); err != nil {
+			return nil, fmt.Errorf("invalid --until: %w", err)
+		}
+	}
+	return &opts, nil
+}
+
+// checkpointKey returns the checkpoint key of a chat. The time window is part
+// of it, the cursor of a copy does not apply to another window.
+func (opts *migrateOptions) checkpointKey(chatID int64) string {
+	return fmt.Sprintf("%s-%s-%d-%s-%s", opts.from, opts.to, chatID, formatDate(opts.since), formatDate(opts.until))
+}
+
+// formatDate formats a date flag, empty when it is not set
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// parseChatIDs parses comma separated chat IDs
+func parseChatIDs(chats string) ([]int64, error) {
+	var ids []int64
+	for _, c := range strings.Split(chats, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(c), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat id %q: %w", c, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// runMigrate runs the migrate subcommand and exits the process
+func runMigrate(args []string) {
+	opts, err := parseMigrateOptions(args)
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+
+	// The configuration and MongoDB are set up by the application framework,
+	// so the copy runs as the last init step instead of starting the bot
+	os.Args = os.Args[:1]
+	a := core.New(&app.Config{
+		Config:  conf.Conf,
+		Service: "xbot",
+		InitFunc: []func() error{
+			func() error {
+				// Only MongoDB is connected, dao.Init would also start the
+				// retention and compaction jobs on the storages being copied
+				if err := dao.InitMongo(context.Background()); err != nil {
+					log.Printf("MongoDB not available: %v", err)
+				}
+				return nil
+			},
+			func() error {
+				if err := migrate(context.Background(), opts); err != nil {
+					log.Fatalf("migrate: %v", err)
+				}
+				os.Exit(0)
+				return nil
+			},
+		},
+	})
+	a.Run()
+}
+
+func migrate(ctx context.Context, opts *migrateOptions) error {
+	if err := dao.CheckEncryption(opts.to); err != nil {
+		return err
+	}
+	from, err := dao.NewMessageStorage(ctx, opts.from)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", opts.from, err)
+	}
+	to, err := dao.NewMessageStorage(ctx, opts.to)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", opts.to, err)
+	}
+
+	checkpoint, err := loadMigrateCheckpoint(opts.checkpoint)
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	for _, chatID := range opts.chats {
+		key := opts.checkpointKey(chatID)
+		state := checkpoint[key]
+		if state == nil {
+			state = &migrateChatState{}
+			checkpoint[key] = state
+		}
+		if state.Done {
+			log.Printf("chat %d: already copied %d messages, skipping", chatID, state.Copied)
+			continue
+		}
+		if state.Cursor != "" {
+			log.Printf("chat %d: resuming after %d messages", chatID, state.Copied)
+		}
+
+		resumed := state.Copied
+		copied, err := dao.CopyMessages(ctx, from, to, dao.CopyOptions{
+			ChatID:    chatID,
+			Since:     opts.since,
+			Until:     opts.until,
+			BatchSize: opts.batchSize,
+			Cursor:    state.Cursor,
+			DryRun:    opts.dryRun,
+			Progress: func(p dao.CopyProgress) {
+				log.Printf("chat %d: %d messages, reached %s", chatID, resumed+p.Copied,
+					p.Oldest.Format(time.DateTime))
+				if opts.dryRun {
+					return
+				}
+				state.Cursor = p.Cursor
+				state.Copied = resumed + p.Copied
+				state.Done = p.Cursor == ""
+				if err := saveMigrateCheckpoint(opts.checkpoint, checkpoint); err != nil {
+					log.Printf("failed to save checkpoint: %v", err)
+				}
+			},
+		})
+		total += copied
+		if err != nil {
+			return fmt.Errorf("chat %d: %w", chatID, err)
+		}
+		log.Printf("chat %d: done, %d messages", chatID, resumed+copied)
+	}
+
+	if opts.dryRun {
+		log.Printf("dry run: %d messages would be copied from %s to %s", total, opts.from, opts.to)
+	} else {
+		log.Printf("copied %d messages from %s to %s", total, opts.from, opts.to)
+	}
+	return nil
+}
+
+func loadMigrateCheckpoint(path string) (migrateCheckpoint, error) {
+	checkpoint := make(migrateCheckpoint)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return checkpoint, nil
+		}
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w", path, err)
+	}
+	return checkpoint, nil
+}
+
+func saveMigrateCheckpoint(path string, checkpoint migrateCheckpoint) error {
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so an interrupted write keeps the old state
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
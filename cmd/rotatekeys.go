@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"butterfly.orx.me/core"
+	"butterfly.orx.me/core/app"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/dao"
+)
+
+const rotateKeysUsage = `Usage: xbot rotate-keys [--chat <id>[,<id>...]] [options]
+
+Gives each chat a new data key and encrypts its stored messages again with it,
+including messages stored before encryption was enabled. The configured
+message storage must be mongodb or s3 with encryption.masterKey set.
+
+To replace the master key, move the current one to encryption.oldMasterKeys,
+set the new one as encryption.masterKey and run rotate-keys for every chat.
+The old master key is no longer needed afterwards.
+
+A running bot picks up the new data key within minutes and may encrypt a few
+messages with the older one meanwhile. --prune therefore only drops the data
+keys replaced more than a day before, the messages they encrypted have been
+encrypted again by this rotation. Keys replaced more recently are dropped by a
+later rotation with --prune.
+
+Options:
+`
+
+// rotateKeysOptions are the flags of the rotate-keys subcommand
+type rotateKeysOptions struct {
+	chats     []int64
+	batchSize int
+	prune     bool
+}
+
+func parseRotateKeysOptions(args []string) (*rotateKeysOptions, error) {
+	var (
+		opts  rotateKeysOptions
+		chats string
+	)
+	fs := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), rotateKeysUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&chats, "chat", "", "comma separated chat IDs, every chat when empty")
+	fs.IntVar(&opts.batchSize, "batch", 500, "number of messages read per batch")
+	fs.BoolVar(&opts.prune, "prune", false, "drop the data keys replaced more than a day before")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if chats != "" {
+		var err error
+		if opts.chats, err = parseChatIDs(chats); err != nil {
+			return nil, err
+		}
+	}
+	return &opts, nil
+}
+
+// runRotateKeys runs the rotate-keys subcommand and exits the process
+func runRotateKeys(args []string) {
+	opts, err := parseRotateKeysOptions(args)
+	if err != nil {
+		log.Fatalf("rotate-keys: %v", err)
+	}
+
+	// Like migrate, the rotation runs as the last init step of the application
+	os.Args = os.Args[:1]
+	a := core.New(&app.Config{
+		Config:  conf.Conf,
+		Service: "xbot",
+		InitFunc: []func() error{
+			func() error {
+				return dao.Init(context.Background())
+			},
+			func() error {
+				if err := rotateKeys(context.Background(), opts); err != nil {
+					log.Fatalf("rotate-keys: %v", err)
+				}
+				os.Exit(0)
+				return nil
+			},
+		},
+	})
+	a.Run()
+}
+
+func rotateKeys(ctx context.Context, opts *rotateKeysOptions) error {
+	// A fresh storage, so messages are not served from the history cache
+	storage, err := dao.NewMessageStorage(ctx, conf.Conf.MessageStorage)
+	if err != nil {
+		return err
+	}
+
+	chats := opts.chats
+	if len(chats) == 0 {
+		if chats, err = storage.ListChatIDs(ctx); err != nil {
+			return err
+		}
+	}
+
+	total := 0
+	for _, chatID := range chats {
+		rotated, err := dao.RotateKeys(ctx, storage, chatID, dao.RotateOptions{
+			BatchSize: opts.batchSize,
+			Prune:     opts.prune,
+			Progress: func(p dao.CopyProgress) {
+				log.Printf("chat %d: %d messages", chatID, p.Copied)
+			},
+		})
+		total += rotated
+		if err != nil {
+			return fmt.Errorf("chat %d: %w", chatID, err)
+		}
+		log.Printf("chat %d: done, %d messages", chatID, rotated)
+	}
+	log.Printf("encrypted %d messages of %d chats with new data keys", total, len(chats))
+	return nil
+}
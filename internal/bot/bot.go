@@ -3,6 +3,7 @@ package bot
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -17,7 +18,7 @@ import (
 	"go.orx.me/xbot/internal/conf"
 	"go.orx.me/xbot/internal/dao"
 	"go.orx.me/xbot/internal/metrics"
-	"go.orx.me/xbot/internal/pkg/gemini"
+	"go.orx.me/xbot/internal/pkg/llm"
 	"go.orx.me/xbot/internal/pkg/openai"
 )
 
@@ -25,10 +26,24 @@ var (
 	defaultBot *bot.Bot
 )
 
+// historyPage is the number of stored updates read at once by /sum and /ask
+const historyPage = 200
+
+// allowedUpdates are the update kinds the webhook receives
+var allowedUpdates = []string{
+	"message", "edited_message", "channel_post", "edited_channel_post",
+	"business_message", "edited_business_message", "deleted_business_messages",
+	"message_reaction", "message_reaction_count", "callback_query", "poll", "poll_answer",
+}
+
 func Init() error {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
+	if err := initRetrieval(); err != nil {
+		return err
+	}
+
 	opts := []bot.Option{
 		bot.WithDefaultHandler(defaultHandler),
 	}
@@ -38,19 +53,27 @@ func Init() error {
 	}
 
 	defaultBot = b
+	llm.SetRecorder(recordUsage)
+	limiter = newLimiter()
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/hello", bot.MatchTypePrefix, helloHandler)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "/gpt", bot.MatchTypePrefix, gptHandler)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "gpt", bot.MatchTypePrefix, gptHandler)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "/chat", bot.MatchTypePrefix, chatHandler)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "/sum", bot.MatchTypePrefix, sumHandler)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "/ask", bot.MatchTypePrefix, askHandler)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "/huahua", bot.MatchTypePrefix, huahuaHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/gpt", bot.MatchTypePrefix, gptHandler, limit("gpt"))
+	b.RegisterHandler(bot.HandlerTypeMessageText, "gpt", bot.MatchTypePrefix, gptHandler, limit("gpt"))
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/chat", bot.MatchTypePrefix, chatHandler, limit("chat"))
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/sum", bot.MatchTypePrefix, sumHandler, limit("sum"))
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/ask", bot.MatchTypePrefix, askHandler, limit("ask"))
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/huahua", bot.MatchTypePrefix, huahuaHandler, limit("huahua"))
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/save_prompt", bot.MatchTypePrefix, savePromt)
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/dns_query", bot.MatchTypePrefix, dnsQueryHandler)
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/getid", bot.MatchTypeExact, getIDHandler)
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/me", bot.MatchTypeExact, meHandler)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "/hualao", bot.MatchTypeExact, hualaoHandler)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "/poster", bot.MatchTypeExact, posterHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/hualao", bot.MatchTypeExact, hualaoHandler, limit("hualao"))
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/poster", bot.MatchTypeExact, posterHandler, limit("poster"))
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/forget_me", bot.MatchTypeExact, forgetMeHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/search", bot.MatchTypePrefix, searchHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/export", bot.MatchTypePrefix, exportHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/usage", bot.MatchTypeExact, usageHandler)
+	b.RegisterHandlerMatchFunc(isImportUpload, importHandler)
+	b.RegisterHandlerMatchFunc(isConversationReply(b.ID()), conversationReplyHandler)
 
 	for _, config := range pollConfig {
 		b.RegisterHandler(bot.HandlerTypeMessageText, config.Command, bot.MatchTypePrefix, newPollHandler(config))
@@ -58,6 +81,8 @@ func Init() error {
 
 	resp, err := b.SetWebhook(ctx, &bot.SetWebhookParams{
 		URL: fmt.Sprintf("%s/v1/webhook", conf.Conf.Host),
+		// Reactions are only delivered when requested explicitly
+		AllowedUpdates: allowedUpdates,
 	})
 	if err != nil {
 		slog.Error("set webhook error",
@@ -105,21 +130,43 @@ func defaultHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 		metrics.MessageCounter.WithLabelValues(chatID).Inc()
 	}
 
-	// save to store
-	err := dao.GetMessageStorage().SaveMessage(ctx, &dao.Message{
-		Update: update,
-	})
+	// save to store, edits and reactions are applied to the stored message
+	if chatID := dao.UpdateChatID(update); chatID != 0 && !dao.ShouldStoreMessages(chatID) {
+		return
+	}
+	message, err := dao.ApplyUpdate(ctx, dao.GetMessageStorage(), update)
 	if nil != err {
-		logger.Error("SaveMessage error ",
+		logger.Error("ApplyUpdate error ",
 			"error", err)
+		return
+	}
+
+	// Embed new and edited messages for /ask and archive their files without
+	// delaying the update
+	if message != nil && isMessageUpdate(update) {
+		go indexMessage(context.WithoutCancel(ctx), message)
+		go archiveMedia(context.WithoutCancel(ctx), b, message)
 	}
 }
 
 func gptHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	message := gptQuestion(update.Message.Text)
+
+	// A /gpt replying to an answer continues its conversation
+	history := conversationHistory(ctx, b, update.Message)
+	saveConversationMessage(ctx, update.Message)
+
+	answerConversation(ctx, b, update, message, history)
+}
+
+// answerConversation answers the question of a message after the earlier
+// turns of its conversation, oldest first
+func answerConversation(ctx context.Context, b *bot.Bot, update *models.Update, message string, history []llm.Message) {
 	logger := log.FromContext(ctx)
 
+	// Without MongoDB no chat has a custom prompt
 	prompt, err := dao.GetPromt(ctx, update.Message.Chat.ID)
-	if err != nil {
+	if err != nil && !errors.Is(err, dao.ErrNoMongo) {
 		logger.Error("GetPromt error ",
 			"error", err)
 	}
@@ -127,18 +174,10 @@ func gptHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 		prompt.Promt = "You are a helpful assistant."
 	}
 
-	message := update.Message.Text
-
-	// remove gpt or /gpt prefix
-	if strings.HasPrefix(message, "/gpt ") {
-		message = strings.TrimPrefix(message, "/gpt ")
-	} else if strings.HasPrefix(message, "gpt ") {
-		message = strings.TrimPrefix(message, "gpt ")
-	}
-
 	logger.Info("gptHandler",
 		"prompt", prompt.Promt,
 		"message", message,
+		"turns", len(history),
 	)
 
 	// Send a processing message first
@@ -158,7 +197,19 @@ func gptHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 
 	start := time.Now()
 
-	resp, err := openai.ChatCompletion(ctx, conf.Conf.OpenAI.Model, prompt.Promt, message)
+	// Send the latest turns fitting the budget, the question at least
+	turns := llm.FitBudget(append(history, llm.Message{Role: llm.RoleUser, Content: message}),
+		conversationBudget(update.Message.Chat.ID, prompt.Promt))
+
+	// Show the answer in the loading message as it is generated
+	editor := startStreamEditor(ctx, b, loadingMsg)
+	resp, err := llm.ChatStream(ctx, llm.TaskChat, llm.ChatRequest{
+		ChatID:   update.Message.Chat.ID,
+		UserID:   callerID(update.Message),
+		System:   prompt.Promt,
+		Messages: turns,
+	}, editor.Write)
+	editor.Stop()
 	if nil != err {
 		if loadingMsg != nil {
 			// Update the loading message with the error
@@ -187,18 +238,19 @@ func gptHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	duration := time.Since(start)
 	logger.Info("ChatCompletion",
 		"duration", duration,
-		"resp", resp,
+		"resp", resp.Content,
 	)
 
 	formattedResp := fmt.Sprintf("*Model:* `%s`\n*Duration:* `%s`\n\n%s",
-		conf.Conf.OpenAI.Model,
+		resp.Model,
 		duration.String(),
-		resp)
+		resp.Content)
 	formattedResp = bot.EscapeMarkdown(formattedResp)
 
+	var sent *models.Message
 	if loadingMsg != nil {
 		// Update the loading message with the response
-		_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		sent, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
 			ChatID:    update.Message.Chat.ID,
 			MessageID: loadingMsg.ID,
 			Text:      formattedResp,
@@ -206,27 +258,11 @@ func gptHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 		})
 		if err != nil {
 			logger.Error("Failed to edit message", "error", err)
-			// If editing fails, send a new message
-			sendResp, err := b.SendMessage(ctx, &bot.SendMessageParams{
-				ChatID:    update.Message.Chat.ID,
-				Text:      formattedResp,
-				ParseMode: models.ParseModeMarkdown,
-				ReplyParameters: &models.ReplyParameters{
-					ChatID:                   update.Message.Chat.ID,
-					MessageID:                update.Message.ID,
-					AllowSendingWithoutReply: true,
-					Quote:                    message,
-				},
-			})
-			if err != nil {
-				logger.Error("SendMessage error ", "error", err)
-				return
-			}
-			logger.Info("SendMessage", "text", sendResp)
 		}
-	} else {
-		// If no loading message was sent, send a new message with the response
-		sendResp, err := b.SendMessage(ctx, &bot.SendMessageParams{
+	}
+	if sent == nil {
+		// Without a loading message to update, send a new message with the response
+		sent, err = b.SendMessage(ctx, &bot.SendMessageParams{
 			ChatID:    update.Message.Chat.ID,
 			Text:      formattedResp,
 			ParseMode: models.ParseModeMarkdown,
@@ -241,8 +277,11 @@ func gptHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 			logger.Error("SendMessage error ", "error", err)
 			return
 		}
-		logger.Info("SendMessage", "text", sendResp)
+		logger.Info("SendMessage", "text", sent)
 	}
+
+	// Replies to the answer continue the conversation
+	saveConversationMessage(ctx, storedAnswer(sent, update.Message, resp.Content))
 }
 
 func chatHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
@@ -268,6 +307,18 @@ func chatHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 
 	logger.Info("chatHandler", "message", message)
 
+	// The chat endpoint is not a local provider
+	if llm.LocalOnly(update.Message.Chat.ID) {
+		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: update.Message.Chat.ID,
+			Text:   "This command is not available in this chat.",
+		})
+		if err != nil {
+			logger.Error("SendMessage error", "error", err)
+		}
+		return
+	}
+
 	// Send a processing message first
 	loadingMsg, err := b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: update.Message.Chat.ID,
@@ -430,8 +481,10 @@ func huahuaHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 		logger.Error("Failed to send loading message", "error", err)
 	}
 
-	// Use Gemini to generate image
-	resp, err := gemini.GetClient().GenerateImage(ctx, gemini.GenerateImageRequest{
+	// Generate the image with the image models
+	img, err := llm.GenerateImage(ctx, llm.ImageRequest{
+		ChatID:      update.Message.Chat.ID,
+		UserID:      callerID(update.Message),
 		Prompt:      message,
 		Temperature: 0.7,
 		TopK:        40,
@@ -456,12 +509,12 @@ func huahuaHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	}
 
 	// Extract image data from response
-	// Gemini returns raw bytes as string, convert directly to []byte
-	imgData := []byte(resp.ImageData)
+	imgData := img.Data
 
-	logger.Info("Received image data from Gemini",
-		"mime_type", resp.MimeType,
-		"finish_reason", resp.FinishReason,
+	logger.Info("Received generated image",
+		"model", img.Model,
+		"mime_type", img.MIMEType,
+		"finish_reason", img.FinishReason,
 		"data_length", len(imgData))
 
 	bf := bytes.NewReader(imgData)
@@ -516,47 +569,141 @@ func huahuaHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	}
 }
 
-// prepareChatHistory prepares conversation history from messages
-func prepareChatHistory(messages []*dao.Message, maxMessages int, prefix string) string {
-	var conversationBuilder strings.Builder
-	conversationBuilder.WriteString(prefix)
-
-	// Add up to the last N messages (to avoid token limits)
-	startIdx := 0
-	if len(messages) > maxMessages {
-		startIdx = len(messages) - maxMessages
-	}
-
-	for i := startIdx; i < len(messages); i++ {
-		if messages[i].Update.Message != nil && messages[i].Update.Message.Text != "" {
-			name := "User"
-			if messages[i].Update.Message.From != nil {
-				if messages[i].Update.Message.From.Username != "" {
-					name = "@" + messages[i].Update.Message.From.Username
-				} else if messages[i].Update.Message.From.FirstName != "" {
-					name = messages[i].Update.Message.From.FirstName
-					if messages[i].Update.Message.From.LastName != "" {
-						name += " " + messages[i].Update.Message.From.LastName
-					}
-				}
+// recentMessages returns up to limit messages of the chat from the last 7 days,
+// limit 0 returns all of them
+func recentMessages(ctx context.Context, chatID int64, limit int) ([]*dao.Message, error) {
+	page, err := dao.GetMessageStorage().QueryMessages(ctx, dao.MessageQuery{
+		ChatID: chatID,
+		Since:  time.Now().Add(-dao.DefaultHistoryWindow),
+		Limit:  limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+// budgetedMessages returns the messages of the chat from the last 7 days,
+// reading pages newest first until their text fills the history budget of
+// the task
+func budgetedMessages(ctx context.Context, chatID int64, task llm.Task) ([]*dao.Message, error) {
+	budget := llm.HistoryBudget(chatID, task)
+	since := time.Now().Add(-dao.DefaultHistoryWindow)
+	var (
+		pages  [][]*dao.Message
+		cursor string
+		tokens int
+	)
+	for tokens < budget {
+		page, err := dao.GetMessageStorage().QueryMessages(ctx, dao.MessageQuery{
+			ChatID: chatID,
+			Since:  since,
+			Limit:  historyPage,
+			Cursor: cursor,
+		})
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page.Messages)
+		for _, line := range historyLines(page.Messages) {
+			tokens += llm.EstimateTokens(line + "\n")
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	var messages []*dao.Message
+	for i := len(pages) - 1; i >= 0; i-- {
+		messages = append(messages, pages[i]...)
+	}
+	return messages, nil
+}
+
+// senderName returns the name shown for the sender of a message
+func senderName(message *models.Message) string {
+	name := "User"
+	if message.From != nil {
+		if message.From.Username != "" {
+			name = "@" + message.From.Username
+		} else if message.From.FirstName != "" {
+			name = message.From.FirstName
+			if message.From.LastName != "" {
+				name += " " + message.From.LastName
 			}
-			conversationBuilder.WriteString(fmt.Sprintf("%s: %s\n", name, messages[i].Update.Message.Text))
 		}
+	} else if message.SenderChat != nil && message.SenderChat.Title != "" {
+		name = message.SenderChat.Title
 	}
+	return name
+}
 
-	return conversationBuilder.String()
+// historyLines returns a line per message for the models, with the latest
+// edit of each message and without the deleted ones
+func historyLines(messages []*dao.Message) []string {
+	lines := make([]string, 0, len(messages))
+	for _, m := range messages {
+		message := m.Latest()
+		if m.DeletedAt != 0 || message == nil || message.Text == "" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", senderName(message), message.Text))
+	}
+	return lines
+}
+
+// fitChatHistory returns the conversation text of a request of the task for a
+// chat: the prefix and as many recent messages as fit in the context of its
+// models, after a summary of the older ones when they do not all fit
+func fitChatHistory(ctx context.Context, chatID, userID int64, task llm.Task, system, prefix string, messages []*dao.Message) string {
+	logger := log.FromContext(ctx)
+	const (
+		earlierHeader = "更早消息的摘要：\n"
+		recentHeader  = "最近的消息：\n"
+	)
+
+	lines := historyLines(messages)
+	history := strings.Join(lines, "\n")
+	budget := llm.ContextBudget(chatID, task) - llm.EstimateTokens(system+prefix+earlierHeader+recentHeader)
+
+	// Only long histories are worth counting with the tokenizer of the model
+	var counter *llm.Counter
+	if llm.EstimateTokens(history) > budget/2 {
+		counter = llm.NewCounter(ctx, chatID, task, history)
+		budget = llm.ContextBudget(chatID, task) - counter.Count(system+prefix+earlierHeader+recentHeader)
+	}
+
+	condensed, err := llm.Condense(ctx, task, llm.ChatRequest{ChatID: chatID, UserID: userID}, counter, lines, budget)
+	if err != nil {
+		logger.Error("Failed to summarize older messages, leaving them out", "error", err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	if condensed.Summary != "" {
+		sb.WriteString(earlierHeader)
+		sb.WriteString(condensed.Summary)
+		sb.WriteString("\n\n")
+		sb.WriteString(recentHeader)
+	}
+	for _, line := range condensed.Recent {
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	return sb.String()
 }
 
-// processChatHistory handles the common logic for processing chat history with OpenAI
+// processChatHistory handles the common logic for processing chat history with the summary models
 func processChatHistory(ctx context.Context, b *bot.Bot, update *models.Update, loadingMsg *models.Message,
 	prompt string, messagePrefix string, responseTitle string, noMessagesText string) {
 
 	logger := log.FromContext(ctx)
 
 	// get messages by chat id
-	messages, err := dao.GetMessageStorage().GetMessageByChatID(ctx, update.Message.Chat.ID)
+	messages, err := budgetedMessages(ctx, update.Message.Chat.ID, llm.TaskSummary)
 	if nil != err {
-		logger.Error("GetMessageByChatID error ",
+		logger.Error("QueryMessages error ",
 			"error", err)
 		b.SendMessage(ctx, &bot.SendMessageParams{
 			ChatID: update.Message.Chat.ID,
@@ -575,43 +722,43 @@ func processChatHistory(ctx context.Context, b *bot.Bot, update *models.Update,
 		return
 	}
 
-	// Build a conversation history from the messages
-	conversationText := prepareChatHistory(messages, 50, messagePrefix)
+	// Build a conversation history from the messages fitting the context of
+	// the summary models
+	conversationText := fitChatHistory(ctx, update.Message.Chat.ID, callerID(update.Message), llm.TaskSummary, prompt, messagePrefix, messages)
 
 	start := time.Now()
 
-	// Use models defined in config with fallback
-	modelsConfig := conf.Conf.SummaryModels
-	if len(modelsConfig) == 0 {
-		// Fallback to the default model if no models defined in config
-		modelsConfig = []string{conf.Conf.OpenAI.Model}
-	}
-
-	// Call OpenAI to process the conversation with multiple model options
-	result, usedModel, err := openai.ChatCompletionWithModels(ctx, modelsConfig, prompt, conversationText)
+	// Process the conversation with the summary models, in order of
+	// preference, showing the answer in the loading message as it is generated
+	editor := startStreamEditor(ctx, b, loadingMsg)
+	resp, err := llm.ChatStream(ctx, llm.TaskSummary, llm.ChatRequest{
+		ChatID:   update.Message.Chat.ID,
+		UserID:   callerID(update.Message),
+		System:   prompt,
+		Messages: []llm.Message{{Role: llm.RoleUser, Content: conversationText}},
+	}, editor.Write)
+	editor.Stop()
 	if err != nil {
 		logger.Error("ChatCompletion error", "error", err)
-		b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   "Error processing chat history. Please try again later.",
-		})
+		// Replace the partial answer streamed into the loading message
+		showStreamError(ctx, b, update.Message.Chat.ID, loadingMsg, "Error processing chat history. Please try again later.")
 		return
 	}
 
 	duration := time.Since(start)
 	logger.Info("AI response generated",
 		"duration", duration,
-		"model", usedModel,
-		"chars", len(result),
+		"model", resp.Model,
+		"chars", len(resp.Content),
 	)
 
 	// Format the response with entities
 	text := fmt.Sprintf("%s\n\nModel: `%s`\nProcessed Messages: %d\nDuration: %s\n\n%s",
 		responseTitle,
-		usedModel,
+		resp.Model,
 		len(messages),
 		duration.Round(time.Millisecond).String(),
-		result)
+		resp.Content)
 	text = bot.EscapeMarkdown(text)
 
 	// Edit the loading message with the result
@@ -710,16 +857,29 @@ func askHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 		logger.Error("Failed to send loading message", "error", err)
 	}
 
-	// Get messages by chat id
-	messages, err := dao.GetMessageStorage().GetMessageByChatID(ctx, update.Message.Chat.ID)
-	if nil != err {
-		logger.Error("GetMessageByChatID error ",
-			"error", err)
-		b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   "Error retrieving messages. Please try again later.",
-		})
-		return
+	// Retrieve the messages relevant to the question, or fall back to the
+	// recent history when semantic retrieval is disabled or fails
+	var messages []*dao.Message
+	cited := false
+	if retrievalEnabled(update.Message.Chat.ID) {
+		messages, err = retrieveMessages(ctx, update.Message.Chat.ID, userQuestion)
+		if err != nil {
+			logger.Error("retrieveMessages error", "error", err)
+		} else {
+			cited = true
+		}
+	}
+	if !cited {
+		messages, err = budgetedMessages(ctx, update.Message.Chat.ID, llm.TaskSummary)
+		if nil != err {
+			logger.Error("QueryMessages error ",
+				"error", err)
+			b.SendMessage(ctx, &bot.SendMessageParams{
+				ChatID: update.Message.Chat.ID,
+				Text:   "Error retrieving messages. Please try again later.",
+			})
+			return
+		}
 	}
 
 	logger.Info("Chat history processing", "len", len(messages))
@@ -737,42 +897,50 @@ func askHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	messagePrefix := "这是一个Telegram聊天历史记录：\n\n"
 
 	// Build a conversation history from the messages
-	conversationText := prepareChatHistory(messages, 50, messagePrefix)
+	var conversationText string
+	if cited {
+		answerPrompt += "引用聊天记录时，请在句末用方括号标注消息编号，例如 [3]。"
+		conversationText = prepareCitedHistory(messages, messagePrefix)
+	} else {
+		conversationText = fitChatHistory(ctx, update.Message.Chat.ID, callerID(update.Message), llm.TaskSummary, answerPrompt, messagePrefix, messages)
+	}
 
 	start := time.Now()
 
-	// Use models defined in config with fallback
-	modelsConfig := conf.Conf.SummaryModels
-	if len(modelsConfig) == 0 {
-		// Fallback to the default model if no models defined in config
-		modelsConfig = []string{conf.Conf.OpenAI.Model}
-	}
-
-	// Call OpenAI to process the conversation with multiple model options
-	result, usedModel, err := openai.ChatCompletionWithModels(ctx, modelsConfig, answerPrompt, conversationText)
+	// Process the conversation with the summary models, in order of
+	// preference, showing the answer in the loading message as it is generated
+	editor := startStreamEditor(ctx, b, loadingMsg)
+	resp, err := llm.ChatStream(ctx, llm.TaskSummary, llm.ChatRequest{
+		ChatID:   update.Message.Chat.ID,
+		UserID:   callerID(update.Message),
+		System:   answerPrompt,
+		Messages: []llm.Message{{Role: llm.RoleUser, Content: conversationText}},
+	}, editor.Write)
+	editor.Stop()
 	if err != nil {
 		logger.Error("ChatCompletion error", "error", err)
-		b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   "Error processing your question. Please try again later.",
-		})
+		// Replace the partial answer streamed into the loading message
+		showStreamError(ctx, b, update.Message.Chat.ID, loadingMsg, "Error processing your question. Please try again later.")
 		return
 	}
 
 	duration := time.Since(start)
 	logger.Info("AI response generated",
 		"duration", duration,
-		"model", usedModel,
-		"chars", len(result),
+		"model", resp.Model,
+		"chars", len(resp.Content),
 	)
 
 	// Format the response with entities
 	text := fmt.Sprintf("❓ Answer to: %s\n\nModel: `%s`\nProcessed in: %s\n\n%s",
 		userQuestion,
-		usedModel,
+		resp.Model,
 		duration.Round(time.Millisecond).String(),
-		result)
+		resp.Content)
 	text = bot.EscapeMarkdown(text)
+	if cited {
+		text += formatCitations(update.Message.Chat, resp.Content, messages)
+	}
 
 	// Edit the loading message with the result
 	if loadingMsg != nil {
@@ -857,6 +1025,42 @@ func meHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	}
 }
 
+func forgetMeHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	logger := log.FromContext(ctx).With("handler", "forgetMeHandler")
+	if update.Message.From == nil {
+		return
+	}
+	logger.Info("forgetMeHandler",
+		"chat_id", update.Message.Chat.ID,
+		"user_id", update.Message.From.ID,
+	)
+
+	// Delete every stored message of the caller in this chat and its files
+	deleted, err := dao.DeleteMessages(ctx, dao.GetMessageStorage(), dao.MessageQuery{
+		ChatID:   update.Message.Chat.ID,
+		SenderID: update.Message.From.ID,
+	})
+	dropChatIndex(ctx, update.Message.Chat.ID)
+	text := fmt.Sprintf("Deleted %d of your stored messages in this chat.", deleted)
+	if err != nil {
+		logger.Error("DeleteMessages error", "error", err)
+		text = "Error deleting your messages. Please try again later."
+	}
+
+	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: update.Message.Chat.ID,
+		Text:   text,
+		ReplyParameters: &models.ReplyParameters{
+			ChatID:                   update.Message.Chat.ID,
+			MessageID:                update.Message.ID,
+			AllowSendingWithoutReply: true,
+		},
+	})
+	if err != nil {
+		logger.Error("SendMessage error", "error", err)
+	}
+}
+
 type userStats struct {
 	FirstName string
 	LastName  string
@@ -881,7 +1085,7 @@ func hualaoHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	}
 
 	// Get messages from the last 7 days
-	messages, err := dao.GetMessageStorage().GetMessageByChatID(ctx, update.Message.Chat.ID)
+	messages, err := recentMessages(ctx, update.Message.Chat.ID, 0)
 	if err != nil {
 		logger.Error("Failed to get messages", "error", err)
 		b.EditMessageText(ctx, &bot.EditMessageTextParams{
@@ -906,11 +1110,12 @@ func hualaoHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 
 	// Count messages for each user
 	for _, msg := range messages {
-		if msg.Update.Message == nil || msg.Update.Message.From == nil {
+		message := msg.Latest()
+		if msg.DeletedAt != 0 || message == nil || message.From == nil {
 			continue
 		}
 
-		from := msg.Update.Message.From
+		from := message.From
 		userID := from.ID
 
 		if _, exists := stats[userID]; !exists {
@@ -1039,7 +1244,7 @@ func posterHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	}
 
 	// Get messages from the last 7 days
-	messages, err := dao.GetMessageStorage().GetMessageByChatID(ctx, update.Message.Chat.ID)
+	messages, err := recentMessages(ctx, update.Message.Chat.ID, 0)
 	if err != nil {
 		logger.Error("Failed to get messages", "error", err)
 		b.EditMessageText(ctx, &bot.EditMessageTextParams{
@@ -1066,9 +1271,6 @@ func posterHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 		Text:      fmt.Sprintf("已获取 %d 条消息，正在生成海报文案...", len(messages)),
 	})
 
-	// Build a conversation history from the messages
-	conversationText := prepareChatHistory(messages, 100, "这是最近7天的Telegram聊天记录：\n\n")
-
 	// Create a prompt to generate poster content
 	posterPrompt := `你是一个创意海报文案生成助手。请根据提供的聊天记录，生成一段简短、有趣、富有创意的海报文案（50字以内）。
 要求：
@@ -1079,14 +1281,18 @@ func posterHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 
 只返回海报文案内容，不要有其他说明。`
 
-	// Use models defined in config with fallback
-	modelsConfig := conf.Conf.SummaryModels
-	if len(modelsConfig) == 0 {
-		modelsConfig = []string{conf.Conf.OpenAI.Model}
-	}
+	// Build a conversation history from the messages fitting the context of
+	// the summary models
+	conversationText := fitChatHistory(ctx, update.Message.Chat.ID, callerID(update.Message), llm.TaskSummary, posterPrompt,
+		"这是最近7天的Telegram聊天记录：\n\n", messages)
 
 	// Generate poster text using AI
-	posterText, usedModel, err := openai.ChatCompletionWithModels(ctx, modelsConfig, posterPrompt, conversationText)
+	resp, err := llm.Chat(ctx, llm.TaskSummary, llm.ChatRequest{
+		ChatID:   update.Message.Chat.ID,
+		UserID:   callerID(update.Message),
+		System:   posterPrompt,
+		Messages: []llm.Message{{Role: llm.RoleUser, Content: conversationText}},
+	})
 	if err != nil {
 		logger.Error("Failed to generate poster text", "error", err)
 		b.EditMessageText(ctx, &bot.EditMessageTextParams{
@@ -1098,9 +1304,10 @@ func posterHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	}
 
 	logger.Info("Generated poster text",
-		"model", usedModel,
-		"text_length", len(posterText),
+		"model", resp.Model,
+		"text_length", len(resp.Content),
 	)
+	posterText := resp.Content
 
 	// Update loading message
 	b.EditMessageText(ctx, &bot.EditMessageTextParams{
@@ -1121,15 +1328,17 @@ Requirements:
 - Add subtle background patterns or gradients
 - Professional and eye-catching layout`, posterText)
 
-	// Generate the poster image using Gemini
-	resp, err := gemini.GetClient().GenerateImage(ctx, gemini.GenerateImageRequest{
+	// Generate the poster image
+	img, err := llm.GenerateImage(ctx, llm.ImageRequest{
+		ChatID:      update.Message.Chat.ID,
+		UserID:      callerID(update.Message),
 		Prompt:      imagePrompt,
 		Temperature: 0.7,
 		TopK:        40,
 		TopP:        0.95,
 	})
 	if err != nil {
-		logger.Error("Failed to generate image with Gemini", "error", err)
+		logger.Error("Failed to generate poster image", "error", err)
 		b.EditMessageText(ctx, &bot.EditMessageTextParams{
 			ChatID:    update.Message.Chat.ID,
 			MessageID: loadingMsg.ID,
@@ -1138,12 +1347,12 @@ Requirements:
 		return
 	}
 
-	// Gemini returns raw bytes as string, convert directly to []byte
-	imgData := []byte(resp.ImageData)
+	imgData := img.Data
 
-	logger.Info("Generated poster image with Gemini",
-		"mime_type", resp.MimeType,
-		"finish_reason", resp.FinishReason,
+	logger.Info("Generated poster image",
+		"model", img.Model,
+		"mime_type", img.MIMEType,
+		"finish_reason", img.FinishReason,
 		"data_length", len(imgData))
 
 	bf := bytes.NewReader(imgData)
@@ -0,0 +1,150 @@
+package bot
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"butterfly.orx.me/core/log"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/dao"
+	"go.orx.me/xbot/internal/pkg/llm"
+)
+
+const (
+	// defaultConversationTokens is the token budget of a conversation when
+	// none is configured
+	defaultConversationTokens = 8000
+	// maxThreadMessages bounds how far back a reply thread is followed
+	maxThreadMessages = 50
+)
+
+// conversationBudget returns the token budget of the turns of a conversation
+// in a chat, within the context of the chat models
+func conversationBudget(chatID int64, system string) int {
+	budget := defaultConversationTokens
+	if conf.Conf.Conversation.MaxTokens > 0 {
+		budget = conf.Conf.Conversation.MaxTokens
+	}
+	return min(budget, llm.ContextBudget(chatID, llm.TaskChat)-llm.EstimateTokens(system))
+}
+
+// gptQuestion returns the question of a /gpt message
+func gptQuestion(text string) string {
+	// remove gpt or /gpt prefix
+	if strings.HasPrefix(text, "/gpt ") {
+		return strings.TrimPrefix(text, "/gpt ")
+	}
+	return strings.TrimPrefix(text, "gpt ")
+}
+
+// isConversationReply returns a match func for text messages replying to a
+// message of the bot, commands excluded
+func isConversationReply(botID int64) bot.MatchFunc {
+	return func(update *models.Update) bool {
+		message := update.Message
+		if message == nil || message.Text == "" || strings.HasPrefix(message.Text, "/") {
+			return false
+		}
+		reply := message.ReplyToMessage
+		return reply != nil && reply.From != nil && reply.From.ID == botID
+	}
+}
+
+// conversationReplyHandler continues a /gpt conversation when a message
+// replies to one of its answers. Other replies are handled as any message.
+func conversationReplyHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	// Store the message first, it is the next turn of the thread
+	defaultHandler(ctx, b, update)
+
+	history := conversationHistory(ctx, b, update.Message)
+	if len(history) == 0 || !allowCommand(ctx, b, update.Message, "gpt") {
+		return
+	}
+	answerConversation(ctx, b, update, update.Message.Text, history)
+}
+
+// saveConversationMessage stores a turn of a conversation so its thread can be
+// followed later, the message history of the chat keeps it as any message
+func saveConversationMessage(ctx context.Context, message *models.Message) {
+	storage := dao.GetMessageStorage()
+	if storage == nil || !dao.ShouldStoreMessages(message.Chat.ID) {
+		return
+	}
+	if _, err := dao.ApplyUpdate(ctx, storage, &models.Update{Message: message}); err != nil {
+		log.FromContext(ctx).Error("Failed to store conversation message",
+			"chatID", message.Chat.ID,
+			"messageID", message.ID,
+			"error", err)
+	}
+}
+
+// conversationHistory returns the earlier turns of the conversation a message
+// continues, oldest first. The thread is followed through the stored messages
+// the message replies to and starts with an answer of the bot, it is empty
+// when the message does not reply to one.
+func conversationHistory(ctx context.Context, b *bot.Bot, message *models.Message) []llm.Message {
+	logger := log.FromContext(ctx).With("method", "conversationHistory")
+	storage := dao.GetMessageStorage()
+	if storage == nil {
+		return nil
+	}
+
+	var history []llm.Message
+	seen := make(map[int]bool)
+	next := llm.RoleAssistant
+	for reply := message.ReplyToMessage; reply != nil && len(history) < maxThreadMessages; {
+		if seen[reply.ID] {
+			break
+		}
+		seen[reply.ID] = true
+
+		stored, err := dao.FindMessage(ctx, storage, message.Chat.ID, reply.ID)
+		if err != nil {
+			logger.Error("FindMessage error", "messageID", reply.ID, "error", err)
+			break
+		}
+		if stored == nil || stored.DeletedAt != 0 {
+			break
+		}
+		turn := stored.Latest()
+		if turn == nil || turn.Text == "" {
+			break
+		}
+
+		// Turns alternate, a thread going through messages of other users
+		// ends there
+		role := llm.RoleUser
+		if turn.From != nil && turn.From.ID == b.ID() {
+			role = llm.RoleAssistant
+		}
+		if role != next {
+			break
+		}
+		text := turn.Text
+		if role == llm.RoleUser {
+			text = gptQuestion(text)
+			next = llm.RoleAssistant
+		} else {
+			next = llm.RoleUser
+		}
+		history = append(history, llm.Message{Role: role, Content: text})
+		reply = turn.ReplyToMessage
+	}
+
+	// The thread was read newest first
+	slices.Reverse(history)
+	return history
+}
+
+// storedAnswer is the answer message of the bot as stored for its thread,
+// with the plain answer rather than its formatted text
+func storedAnswer(sent *models.Message, question *models.Message, answer string) *models.Message {
+	stored := *sent
+	stored.Text = answer
+	stored.Entities = nil
+	stored.ReplyToMessage = &models.Message{ID: question.ID, Chat: question.Chat}
+	return &stored
+}
@@ -0,0 +1,127 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"butterfly.orx.me/core/log"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/dao"
+	"go.orx.me/xbot/internal/transcript"
+)
+
+const exportUsage = "Usage: /export [since] [format]\n" +
+	"since is a date like 2025-01-02 or a period like 7d, every stored message by default.\n" +
+	"format is json (Telegram Desktop result.json), markdown or html, json by default."
+
+// exportHandler sends the stored history of the chat as a document
+func exportHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	logger := log.FromContext(ctx).With("handler", "exportHandler")
+	chat := update.Message.Chat
+
+	reply := func(text string) {
+		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chat.ID,
+			Text:   text,
+			ReplyParameters: &models.ReplyParameters{
+				ChatID:                   chat.ID,
+				MessageID:                update.Message.ID,
+				AllowSendingWithoutReply: true,
+			},
+		})
+		if err != nil {
+			logger.Error("SendMessage error", "error", err)
+		}
+	}
+
+	now := time.Now()
+	since, format, err := parseExportArgs(update.Message.Text, now)
+	if err != nil {
+		reply(err.Error() + "\n\n" + exportUsage)
+		return
+	}
+
+	// The history of a group is only handed out to its admins
+	if chat.Type == models.ChatTypeGroup || chat.Type == models.ChatTypeSupergroup {
+		if update.Message.From == nil || !isChatAdmin(ctx, b, chat.ID, update.Message.From.ID) {
+			reply("Only chat admins can export the chat history.")
+			return
+		}
+	}
+
+	logger.Info("exportHandler",
+		"chat_id", chat.ID,
+		"since", since,
+		"format", format,
+	)
+	t, err := transcript.Load(ctx, dao.GetMessageStorage(), chat.ID, since)
+	if err != nil {
+		logger.Error("Load transcript error", "error", err)
+		reply("Error reading the chat history. Please try again later.")
+		return
+	}
+	if len(t.Messages) == 0 {
+		reply("No messages to export.")
+		return
+	}
+	t.Chat = chat
+
+	var buf bytes.Buffer
+	if err := transcript.Render(&buf, format, t); err != nil {
+		logger.Error("Render transcript error", "error", err)
+		reply("Error exporting the chat history. Please try again later.")
+		return
+	}
+
+	_, err = b.SendDocument(ctx, &bot.SendDocumentParams{
+		ChatID: chat.ID,
+		Document: &models.InputFileUpload{
+			Filename: transcript.FileName(t, format, now),
+			Data:     &buf,
+		},
+		Caption: fmt.Sprintf("%d messages", len(t.Messages)),
+		ReplyParameters: &models.ReplyParameters{
+			ChatID:                   chat.ID,
+			MessageID:                update.Message.ID,
+			AllowSendingWithoutReply: true,
+		},
+	})
+	if err != nil {
+		logger.Error("SendDocument error", "error", err)
+	}
+}
+
+// parseExportArgs parses "/export [since] [format]", in any order
+func parseExportArgs(text string, now time.Time) (time.Time, transcript.Format, error) {
+	var (
+		since  time.Time
+		format = transcript.FormatJSON
+	)
+	args := strings.Fields(text)[1:]
+	for _, arg := range args {
+		if f, ok := transcript.ParseFormat(arg); ok {
+			format = f
+			continue
+		}
+		s, err := transcript.ParseSince(arg, now)
+		if err != nil {
+			return time.Time{}, "", err
+		}
+		since = s
+	}
+	return since, format, nil
+}
+
+// isChatAdmin reports whether the user is an administrator or the owner of the chat
+func isChatAdmin(ctx context.Context, b *bot.Bot, chatID, userID int64) bool {
+	member, err := b.GetChatMember(ctx, &bot.GetChatMemberParams{ChatID: chatID, UserID: userID})
+	if err != nil {
+		log.FromContext(ctx).Error("GetChatMember error", "error", err)
+		return false
+	}
+	return member.Type == models.ChatMemberTypeOwner || member.Type == models.ChatMemberTypeAdministrator
+}
@@ -0,0 +1,106 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"butterfly.orx.me/core/log"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/dao"
+	"go.orx.me/xbot/internal/transcript"
+)
+
+// isImportUpload matches a document sent with /import as caption
+func isImportUpload(update *models.Update) bool {
+	if update.Message == nil || update.Message.Document == nil {
+		return false
+	}
+	command, _, _ := strings.Cut(strings.TrimSpace(update.Message.Caption), " ")
+	command, _, _ = strings.Cut(command, "@")
+	return command == "/import"
+}
+
+// importHandler imports a Telegram Desktop result.json export of the chat
+// into the message storage
+func importHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	logger := log.FromContext(ctx).With("handler", "importHandler")
+	chat := update.Message.Chat
+
+	reply := func(text string) {
+		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chat.ID,
+			Text:   text,
+			ReplyParameters: &models.ReplyParameters{
+				ChatID:                   chat.ID,
+				MessageID:                update.Message.ID,
+				AllowSendingWithoutReply: true,
+			},
+		})
+		if err != nil {
+			logger.Error("SendMessage error", "error", err)
+		}
+	}
+
+	// The export of a chat with the bot is of the bot's peer, and its message
+	// IDs are the ones of the user's side of the chat
+	if chat.Type == models.ChatTypePrivate {
+		reply("Only the history of groups and channels can be imported.")
+		return
+	}
+	if update.Message.From == nil || !isChatAdmin(ctx, b, chat.ID, update.Message.From.ID) {
+		reply("Only chat admins can import chat history.")
+		return
+	}
+
+	_, resp, err := downloadFile(ctx, b, update.Message.Document.FileID, defaultMediaMaxSize)
+	if err != nil {
+		logger.Error("download export error", "error", err)
+		reply("Error downloading the export. Bots can only download files up to 20 MB, " +
+			"use `xbot import` for larger exports.")
+		return
+	}
+	defer resp.Body.Close()
+
+	result, err := transcript.ParseResult(resp.Body)
+	if err != nil {
+		reply(fmt.Sprintf("This is not a Telegram Desktop export: %v", err))
+		return
+	}
+	// Only the history of the chat the export is uploaded to is imported
+	if result.ChatID() != chat.ID {
+		reply("The export is of another chat. Upload it to the chat it was exported from.")
+		return
+	}
+
+	logger.Info("importHandler",
+		"chat_id", chat.ID,
+		"messages", len(result.Messages),
+	)
+	report, err := transcript.Import(ctx, dao.GetMessageStorage(), result, transcript.ImportOptions{ChatID: chat.ID})
+	if err != nil {
+		logger.Error("Import error", "error", err)
+		reply("Error importing the chat history. Please try again later.")
+		return
+	}
+	// The embeddings of the imported messages are computed on the next /ask
+	dropChatIndex(ctx, chat.ID)
+
+	reply(formatImportReport(report))
+}
+
+// formatImportReport describes the outcome of an import
+func formatImportReport(report *transcript.ImportResult) string {
+	text := fmt.Sprintf("Imported %d messages.", report.Imported)
+	if report.Existing > 0 {
+		text += fmt.Sprintf("\n%d were already stored.", report.Existing)
+	}
+	if report.Expired > 0 {
+		text += fmt.Sprintf("\n%d are older than the retention of the chat.", report.Expired)
+	}
+	if report.Skipped > 0 {
+		text += fmt.Sprintf("\n%d service or empty messages were skipped.", report.Skipped)
+	}
+	return text
+}
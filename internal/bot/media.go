@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+
+	"butterfly.orx.me/core/log"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/dao"
+)
+
+// defaultMediaMaxSize is the largest file the Bot API allows to download
+const defaultMediaMaxSize = 20 << 20
+
+var errFileTooLarge = errors.New("file exceeds the size limit")
+
+var mediaClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// archiveMedia copies the files of a stored message to the media archive and
+// records them on the message
+func archiveMedia(ctx context.Context, b *bot.Bot, message *dao.Message) {
+	logger := log.FromContext(ctx).With("method", "archiveMedia")
+	store := dao.GetMediaStore()
+	latest := message.Latest()
+	if store == nil || latest == nil || message.DeletedAt != 0 {
+		return
+	}
+
+	maxSize := conf.Conf.MediaArchive.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMediaMaxSize
+	}
+
+	var attachments []dao.Attachment
+	for _, file := range dao.MessageFiles(latest) {
+		if message.Attachment(file.FileUniqueID) != nil || file.Size > maxSize {
+			continue
+		}
+		attachment, err := archiveFile(ctx, b, store, message, file, maxSize)
+		if err != nil {
+			logger.Error("archive file error", "kind", file.Kind, "error", err)
+			continue
+		}
+		attachments = append(attachments, *attachment)
+	}
+	if len(attachments) == 0 {
+		return
+	}
+
+	if err := dao.SetAttachments(ctx, dao.GetMessageStorage(), message, attachments); err != nil {
+		logger.Error("SetAttachments error", "error", err)
+	}
+}
+
+// downloadFile starts the download of a file with getFile, files larger than
+// maxSize are refused
+func downloadFile(ctx context.Context, b *bot.Bot, fileID string, maxSize int64) (*models.File, *http.Response, error) {
+	f, err := b.GetFile(ctx, &bot.GetFileParams{FileID: fileID})
+	if err != nil {
+		return nil, nil, fmt.Errorf("getFile failed: %w", err)
+	}
+	if f.FileSize > maxSize {
+		return nil, nil, fmt.Errorf("file of %d bytes exceeds the limit", f.FileSize)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.FileDownloadLink(f), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("download failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("file of %d bytes exceeds the limit", resp.ContentLength)
+	}
+	// The length is not always known up front
+	resp.Body = &limitedBody{ReadCloser: resp.Body, left: maxSize}
+	return f, resp, nil
+}
+
+// limitedBody fails the read of a body larger than its limit, a file cut at
+// the limit would be corrupt
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	// Read one byte more than left to tell a body ending at the limit
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return 0, errFileTooLarge
+	}
+	return n, err
+}
+
+// archiveFile downloads a file with getFile and stores it in the archive
+func archiveFile(ctx context.Context, b *bot.Bot, store dao.MediaStore, message *dao.Message, file dao.MessageFile, maxSize int64) (*dao.Attachment, error) {
+	f, resp, err := downloadFile(ctx, b, file.FileID, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Telegram's file path carries the extension, e.g. "photos/file_0.jpg"
+	ext := path.Ext(f.FilePath)
+	if ext == "" {
+		ext = path.Ext(file.FileName)
+	}
+	mimeType := file.MIMEType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(ext)
+	}
+
+	key := dao.MediaKey(message, file.FileUniqueID, ext)
+	if err := store.Put(ctx, key, resp.Body, resp.ContentLength, mimeType); err != nil {
+		return nil, err
+	}
+
+	size := f.FileSize
+	if size == 0 && resp.ContentLength > 0 {
+		size = resp.ContentLength
+	}
+	return &dao.Attachment{
+		Kind:         file.Kind,
+		FileID:       file.FileID,
+		FileUniqueID: file.FileUniqueID,
+		Key:          key,
+		Size:         size,
+		MIMEType:     mimeType,
+		FileName:     file.FileName,
+	}, nil
+}
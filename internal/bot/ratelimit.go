@@ -0,0 +1,93 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"butterfly.orx.me/core/log"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/metrics"
+	"go.orx.me/xbot/internal/pkg/ratelimit"
+)
+
+// defaultLimits are the limits of the commands generating images, each use
+// can generate several
+var defaultLimits = map[string]conf.CommandLimitConfig{
+	"huahua": {PerMinute: 1, Burst: 3, Daily: 50},
+	"poster": {PerMinute: 0.2, Burst: 1, Daily: 10},
+}
+
+// limiter is created by Init, once the configuration is loaded
+var limiter *ratelimit.Limiter
+
+// newLimiter creates the limiter of the commands from the defaults and the
+// configured limits
+func newLimiter() *ratelimit.Limiter {
+	limits := maps.Clone(defaultLimits)
+	maps.Copy(limits, conf.Conf.RateLimit.Commands)
+	return ratelimit.New(limits)
+}
+
+// allowCommand reports whether the sender of a message may use a command and
+// tells them when they may not
+func allowCommand(ctx context.Context, b *bot.Bot, message *models.Message, command string) bool {
+	userID := callerID(message)
+	if slices.Contains(conf.Conf.RateLimit.Admins, userID) {
+		return true
+	}
+	d := limiter.Allow(command, message.Chat.ID, userID)
+	if d.Allowed {
+		return true
+	}
+
+	metrics.RateLimitRefusals.WithLabelValues(command, string(d.Reason)).Inc()
+	log.FromContext(ctx).Info("Command refused",
+		"command", command,
+		"chatID", message.Chat.ID,
+		"userID", userID,
+		"reason", d.Reason)
+
+	text := fmt.Sprintf("⏳ Slow down a little, you can use /%s again in %s.", command, formatWait(d.RetryAfter))
+	if d.Reason == ratelimit.QuotaExceeded {
+		text = fmt.Sprintf("🙅 This chat has used up its /%s for today, it is available again in %s.",
+			command, formatWait(d.RetryAfter))
+	}
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: message.Chat.ID,
+		Text:   text,
+		ReplyParameters: &models.ReplyParameters{
+			ChatID:                   message.Chat.ID,
+			MessageID:                message.ID,
+			AllowSendingWithoutReply: true,
+		},
+	})
+	if err != nil {
+		log.FromContext(ctx).Error("SendMessage error", "error", err)
+	}
+	return false
+}
+
+// limit is a middleware refusing a command to users over its limits
+func limit(command string) bot.Middleware {
+	return func(next bot.HandlerFunc) bot.HandlerFunc {
+		return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+			if update.Message != nil && !allowCommand(ctx, b, update.Message, command) {
+				return
+			}
+			next(ctx, b, update)
+		}
+	}
+}
+
+// formatWait rounds a wait up to the second, or to the minute when long
+func formatWait(d time.Duration) string {
+	if d >= time.Hour {
+		return (d + time.Minute - 1).Truncate(time.Minute).String()
+	}
+	return (d + time.Second - 1).Truncate(time.Second).String()
+}
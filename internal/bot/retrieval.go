@@ -0,0 +1,338 @@
+package bot
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"butterfly.orx.me/core/log"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/dao"
+	"go.orx.me/xbot/internal/pkg/llm"
+	"go.orx.me/xbot/internal/pkg/vector"
+)
+
+const (
+	// defaultRetrievalTopK is the number of messages retrieved for /ask
+	defaultRetrievalTopK = 30
+	// defaultEmbeddingBackfill is the number of stored messages of a chat
+	// without an embedding that are embedded when its index is loaded
+	defaultEmbeddingBackfill = 2000
+	// embeddingBatch is the number of texts sent in one embeddings request
+	embeddingBatch = 100
+	// retrievalPage is the page size used to load the embeddings of a chat
+	retrievalPage = 1000
+)
+
+var (
+	// vectorIndex is nil when semantic retrieval is disabled
+	vectorIndex vector.Index
+
+	loadMu sync.Mutex
+	// chatIndexes are the chats whose stored embeddings are or are being
+	// loaded into vectorIndex
+	chatIndexes = make(map[int64]*chatIndex)
+
+	citationPattern = regexp.MustCompile(`\[(\d+)\]`)
+	// linkEscaper escapes the characters MarkdownV2 reserves in link URLs
+	linkEscaper = strings.NewReplacer(`\`, `\\`, `)`, `\)`)
+)
+
+// initRetrieval sets up the vector index when an embedding model is configured
+func initRetrieval() error {
+	if !embeddingConfigured() {
+		return nil
+	}
+	index, err := vector.New(conf.Conf.Embedding.Index)
+	if err != nil {
+		return err
+	}
+	vectorIndex = index
+	return nil
+}
+
+// embeddingConfigured reports whether any chat has an embedding model
+func embeddingConfigured() bool {
+	if len(llm.Models(llm.TaskEmbedding)) > 0 {
+		return true
+	}
+	for _, r := range conf.Conf.ChatRoutes {
+		if r.Models.Embedding != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// retrievalEnabled reports whether /ask retrieves the messages of a chat by
+// their embeddings
+func retrievalEnabled(chatID int64) bool {
+	return vectorIndex != nil && llm.EmbeddingModel(chatID) != ""
+}
+
+// isMessageUpdate reports whether the update carries a new or edited message
+func isMessageUpdate(update *models.Update) bool {
+	return update.Message != nil || update.ChannelPost != nil || update.BusinessMessage != nil ||
+		update.EditedMessage != nil || update.EditedChannelPost != nil || update.EditedBusinessMessage != nil
+}
+
+// embeddingInput returns the text embedded for a message, "" if it is skipped
+func embeddingInput(message *dao.Message) string {
+	if message.DeletedAt != 0 {
+		return ""
+	}
+	text := strings.Join(strings.Fields(message.Text()), " ")
+	// Commands to the bot are not part of the conversation
+	if strings.HasPrefix(text, "/") {
+		return ""
+	}
+	return text
+}
+
+// indexMessage embeds a stored message, saves the embedding with it and adds
+// it to the vector index
+func indexMessage(ctx context.Context, message *dao.Message) {
+	logger := log.FromContext(ctx).With("method", "indexMessage")
+	if !retrievalEnabled(message.ChatID) {
+		return
+	}
+	text := embeddingInput(message)
+	if text == "" {
+		return
+	}
+
+	model := llm.EmbeddingModel(message.ChatID)
+	embeddings, err := llm.Embed(ctx, message.ChatID, model, []string{text})
+	if err != nil {
+		logger.Error("Embeddings error", "error", err)
+		return
+	}
+	if err := dao.SetEmbedding(ctx, dao.GetMessageStorage(), message, model, embeddings[0]); err != nil {
+		logger.Error("SetEmbedding error", "error", err)
+		return
+	}
+	err = vectorIndex.Upsert(ctx, message.ChatID, vector.Item{
+		ID:        message.ID.Hex(),
+		CreatedAt: message.CreatedAt,
+		Vector:    embeddings[0],
+	})
+	if err != nil {
+		logger.Error("Upsert error", "error", err)
+	}
+}
+
+// chatIndex is the state of the embeddings of a chat in the vector index, the
+// loads of different chats do not wait for each other
+type chatIndex struct {
+	mu     sync.Mutex
+	loaded bool
+}
+
+// chatIndexFor returns the index state of a chat
+func chatIndexFor(chatID int64) *chatIndex {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	c := chatIndexes[chatID]
+	if c == nil {
+		c = &chatIndex{}
+		chatIndexes[chatID] = c
+	}
+	return c
+}
+
+// loadChatIndex adds the stored embeddings of a chat to the vector index the
+// first time the chat is queried, embedding messages stored without one
+func loadChatIndex(ctx context.Context, chatID int64, since time.Time) error {
+	c := chatIndexFor(chatID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded {
+		return nil
+	}
+
+	model := llm.EmbeddingModel(chatID)
+	backfill := conf.Conf.Embedding.Backfill
+	if backfill <= 0 {
+		backfill = defaultEmbeddingBackfill
+	}
+
+	storage := dao.GetMessageStorage()
+	var (
+		items   []vector.Item
+		missing []*dao.Message
+		cursor  string
+	)
+	for {
+		page, err := storage.QueryMessages(ctx, dao.MessageQuery{
+			ChatID:         chatID,
+			Since:          since,
+			Limit:          retrievalPage,
+			Cursor:         cursor,
+			WithEmbeddings: true,
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range page.Messages {
+			if embeddingInput(m) == "" {
+				continue
+			}
+			if m.EmbeddingModel == model && len(m.Embedding) > 0 {
+				items = append(items, vector.Item{ID: m.ID.Hex(), CreatedAt: m.CreatedAt, Vector: m.Embedding})
+			} else if len(missing) < backfill {
+				missing = append(missing, m)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	// Pages are read newest first, so the most recent messages are backfilled
+	for start := 0; start < len(missing); start += embeddingBatch {
+		batch := missing[start:min(start+embeddingBatch, len(missing))]
+		inputs := make([]string, len(batch))
+		for i, m := range batch {
+			inputs[i] = embeddingInput(m)
+		}
+		embeddings, err := llm.Embed(ctx, chatID, model, inputs)
+		if err != nil {
+			return fmt.Errorf("failed to embed stored messages: %w", err)
+		}
+		for i, m := range batch {
+			if err := dao.SetEmbedding(ctx, storage, m, model, embeddings[i]); err != nil {
+				return err
+			}
+			items = append(items, vector.Item{ID: m.ID.Hex(), CreatedAt: m.CreatedAt, Vector: embeddings[i]})
+		}
+	}
+
+	if err := vectorIndex.Upsert(ctx, chatID, items...); err != nil {
+		return err
+	}
+	c.loaded = true
+	return nil
+}
+
+// dropChatIndex forgets the embeddings of a chat after messages were deleted
+// or imported
+func dropChatIndex(ctx context.Context, chatID int64) {
+	if vectorIndex == nil {
+		return
+	}
+	c := chatIndexFor(chatID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaded = false
+	if err := vectorIndex.Drop(ctx, chatID); err != nil {
+		log.FromContext(ctx).Error("Drop vector index error", "error", err)
+	}
+}
+
+// retrieveMessages returns the stored messages most relevant to the question
+// within the retention window of the chat, oldest first
+func retrieveMessages(ctx context.Context, chatID int64, question string) ([]*dao.Message, error) {
+	since := dao.RetentionCutoff(chatID, time.Now())
+	if err := loadChatIndex(ctx, chatID, since); err != nil {
+		return nil, err
+	}
+
+	embeddings, err := llm.Embed(ctx, chatID, llm.EmbeddingModel(chatID), []string{question})
+	if err != nil {
+		return nil, err
+	}
+	topK := conf.Conf.Embedding.TopK
+	if topK <= 0 {
+		topK = defaultRetrievalTopK
+	}
+	matches, err := vectorIndex.Search(ctx, chatID, embeddings[0], vector.SearchOptions{K: topK, Since: since})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	// Each match is read in the second it was created, reading the range
+	// between the oldest and newest match could span the whole history
+	storage := dao.GetMessageStorage()
+	messages := make([]*dao.Message, 0, len(matches))
+	for _, match := range matches {
+		id, err := bson.ObjectIDFromHex(match.ID)
+		if err != nil {
+			vectorIndex.Remove(ctx, chatID, match.ID)
+			continue
+		}
+		message, err := dao.GetMessage(ctx, storage, chatID, id, match.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if message == nil || message.DeletedAt != 0 {
+			// Deleted from the storage since it was indexed
+			vectorIndex.Remove(ctx, chatID, match.ID)
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	slices.SortFunc(messages, func(a, b *dao.Message) int {
+		return cmp.Compare(a.CreatedAt, b.CreatedAt)
+	})
+	return messages, nil
+}
+
+// prepareCitedHistory numbers the messages so the answer can cite them
+func prepareCitedHistory(messages []*dao.Message, prefix string) string {
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	for i, m := range messages {
+		message := m.Latest()
+		if message == nil {
+			continue
+		}
+		created := time.Unix(m.CreatedAt, 0).Format("2006-01-02 15:04")
+		sb.WriteString(fmt.Sprintf("[%d] %s %s: %s\n", i+1, created, senderName(message), message.Text))
+	}
+	return sb.String()
+}
+
+// formatCitations lists the messages cited in the answer as MarkdownV2, with a
+// link to each message when the chat has them
+func formatCitations(chat models.Chat, answer string, messages []*dao.Message) string {
+	cited := make(map[int]bool)
+	for _, match := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err == nil && n >= 1 && n <= len(messages) {
+			cited[n] = true
+		}
+	}
+	if len(cited) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\n\nSources:\n")
+	for i, m := range messages {
+		if !cited[i+1] {
+			continue
+		}
+		created := bot.EscapeMarkdown(time.Unix(m.CreatedAt, 0).Format("2006-01-02 15:04"))
+		if link := messageLink(chat, m.Latest().ID); link != "" {
+			sb.WriteString(fmt.Sprintf("[%d](%s) %s\n", i+1, linkEscaper.Replace(link), created))
+		} else {
+			sb.WriteString(fmt.Sprintf("\\[%d\\] %s\n", i+1, created))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,73 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/dao"
+)
+
+// markdownV2Reserved are the characters MarkdownV2 requires escaped in text
+const markdownV2Reserved = "_*[]()~`>#+-=|{}.!"
+
+// checkMarkdownV2 fails the test when s has a reserved character that is
+// neither escaped nor part of an inline link
+func checkMarkdownV2(t *testing.T, s string) {
+	t.Helper()
+	runes := []rune(s)
+	inLinkText := false
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\':
+			i++
+		case r == '[' && !inLinkText:
+			inLinkText = true
+		case r == ']' && inLinkText && i+1 < len(runes) && runes[i+1] == '(':
+			inLinkText = false
+			// Only ")" and "\" are escaped in the URL
+			for i += 2; i < len(runes) && runes[i] != ')'; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(runes) {
+				t.Errorf("unterminated link in %q", s)
+			}
+		case strings.ContainsRune(markdownV2Reserved, r):
+			t.Errorf("unescaped %q at %d in %q", r, i, s)
+		}
+	}
+	if inLinkText {
+		t.Errorf("unterminated link text in %q", s)
+	}
+}
+
+func TestFormatCitations(t *testing.T) {
+	created := time.Date(2025, 1, 2, 15, 4, 0, 0, time.Local).Unix()
+	messages := []*dao.Message{
+		{CreatedAt: created, Update: &models.Update{Message: &models.Message{ID: 11}}},
+		{CreatedAt: created, Update: &models.Update{Message: &models.Message{ID: 12}}},
+	}
+
+	chats := map[string]models.Chat{
+		"public":  {ID: -1001234, Username: "my_chat"},
+		"private": {ID: -1001234},
+		"group":   {ID: -1234},
+	}
+	for name, chat := range chats {
+		t.Run(name, func(t *testing.T) {
+			citations := formatCitations(chat, "see [1] and [2]", messages)
+			if !strings.Contains(citations, `2025\-01\-02 15:04`) {
+				t.Errorf("citations %q lack the escaped date", citations)
+			}
+			checkMarkdownV2(t, citations)
+		})
+	}
+
+	if got := formatCitations(chats["group"], "no sources", messages); got != "" {
+		t.Errorf("citations without citing = %q, want none", got)
+	}
+}
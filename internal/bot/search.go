@@ -0,0 +1,108 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"butterfly.orx.me/core/log"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/dao"
+)
+
+const (
+	// searchResults is the number of matches /search replies with
+	searchResults = 5
+	// searchSnippetLength is the number of characters shown of each match
+	searchSnippetLength = 120
+)
+
+func searchHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	logger := log.FromContext(ctx).With("handler", "searchHandler")
+
+	terms := strings.TrimSpace(strings.TrimPrefix(update.Message.Text, "/search"))
+	// Commands in groups may be addressed to the bot, e.g. /search@xbot
+	if strings.HasPrefix(terms, "@") {
+		_, terms, _ = strings.Cut(terms, " ")
+		terms = strings.TrimSpace(terms)
+	}
+
+	chat := update.Message.Chat
+	text := ""
+	if terms == "" {
+		text = "Please provide search terms. Usage: /search deploy failed"
+	} else {
+		logger.Info("searchHandler",
+			"chat_id", chat.ID,
+			"terms", terms,
+		)
+		results, err := dao.Search(ctx, dao.GetMessageStorage(), chat.ID, terms, dao.SearchOptions{Limit: searchResults})
+		if err != nil {
+			logger.Error("Search error", "error", err)
+			text = "Error searching messages. Please try again later."
+		} else {
+			text = formatSearchResults(chat, terms, results)
+		}
+	}
+
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: chat.ID,
+		Text:   text,
+		ReplyParameters: &models.ReplyParameters{
+			ChatID:                   chat.ID,
+			MessageID:                update.Message.ID,
+			AllowSendingWithoutReply: true,
+		},
+		LinkPreviewOptions: &models.LinkPreviewOptions{IsDisabled: bot.True()},
+	})
+	if err != nil {
+		logger.Error("SendMessage error", "error", err)
+	}
+}
+
+// formatSearchResults lists the matches with their sender, date and a link
+func formatSearchResults(chat models.Chat, terms string, results []*dao.SearchResult) string {
+	if len(results) == 0 {
+		return fmt.Sprintf("No messages found for \"%s\".", terms)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Top %d messages for \"%s\":\n", len(results), terms))
+	for i, result := range results {
+		message := result.Message.Latest()
+		if message == nil {
+			continue
+		}
+		created := time.Unix(result.Message.CreatedAt, 0).Format("2006-01-02 15:04")
+		sb.WriteString(fmt.Sprintf("\n%d. %s · %s\n%s\n", i+1, senderName(message), created, snippet(message.Text)))
+		if link := messageLink(chat, message.ID); link != "" {
+			sb.WriteString(link + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// snippet shortens text to searchSnippetLength characters on a single line
+func snippet(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= searchSnippetLength {
+		return text
+	}
+	return string([]rune(text)[:searchSnippetLength]) + "…"
+}
+
+// messageLink returns the deep link to a message. Only public chats and
+// supergroups have one, "" is returned otherwise.
+func messageLink(chat models.Chat, messageID int) string {
+	if chat.Username != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", chat.Username, messageID)
+	}
+	// Supergroup and channel IDs are the internal ID prefixed with -100
+	if id, ok := strings.CutPrefix(fmt.Sprint(chat.ID), "-100"); ok {
+		return fmt.Sprintf("https://t.me/c/%s/%d", id, messageID)
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"butterfly.orx.me/core/log"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// Telegram allows about a message a second in a chat and 20 a minute in
+	// a group, edits included
+	privateEditInterval = time.Second
+	groupEditInterval   = 3 * time.Second
+	// streamPreviewLimit keeps previews under the 4096 characters of a message
+	streamPreviewLimit = 3500
+)
+
+// streamEditor shows an answer as it is generated by editing a message at a
+// throttled cadence
+type streamEditor struct {
+	b         *bot.Bot
+	chatID    int64
+	messageID int
+	// header is shown above the partial answer
+	header   string
+	interval time.Duration
+
+	mu    sync.Mutex
+	text  strings.Builder
+	dirty bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startStreamEditor edits the message with the answer given to Write until
+// Stop. It returns nil, which ignores Write and Stop, without a message.
+func startStreamEditor(ctx context.Context, b *bot.Bot, message *models.Message) *streamEditor {
+	if message == nil {
+		return nil
+	}
+	e := &streamEditor{
+		b:         b,
+		chatID:    message.Chat.ID,
+		messageID: message.ID,
+		header:    message.Text,
+		interval:  groupEditInterval,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if message.Chat.Type == models.ChatTypePrivate {
+		e.interval = privateEditInterval
+	}
+	go e.run(ctx)
+	return e
+}
+
+// Write adds a piece of the answer, shown with the next edit
+func (e *streamEditor) Write(text string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.text.WriteString(text)
+	e.dirty = true
+}
+
+// Stop stops editing the message so the final answer can replace it
+func (e *streamEditor) Stop() {
+	if e == nil {
+		return
+	}
+	close(e.stop)
+	<-e.done
+}
+
+func (e *streamEditor) run(ctx context.Context) {
+	defer close(e.done)
+	logger := log.FromContext(ctx).With("method", "streamEditor")
+
+	timer := time.NewTimer(e.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		wait := e.interval
+		if preview, ok := e.preview(); ok {
+			_, err := e.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+				ChatID:    e.chatID,
+				MessageID: e.messageID,
+				Text:      preview,
+			})
+			var tooMany *bot.TooManyRequestsError
+			if errors.As(err, &tooMany) {
+				wait = max(wait, time.Duration(tooMany.RetryAfter)*time.Second)
+			} else if err != nil {
+				logger.Debug("Failed to edit streamed message", "error", err)
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// preview returns the text of the next edit, ok is false when the answer did
+// not change since the last one. Long answers show their end.
+func (e *streamEditor) preview() (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.dirty {
+		return "", false
+	}
+	e.dirty = false
+
+	text := e.text.String()
+	if runes := []rune(text); len(runes) > streamPreviewLimit {
+		text = "…" + string(runes[len(runes)-streamPreviewLimit:])
+	}
+	return e.header + "\n\n" + text + " ▍", true
+}
+
+// showStreamError replaces the partial answer in the loading message with an
+// error, or sends the error without a loading message
+func showStreamError(ctx context.Context, b *bot.Bot, chatID int64, loadingMsg *models.Message, text string) {
+	if loadingMsg != nil {
+		_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:    chatID,
+			MessageID: loadingMsg.ID,
+			Text:      text,
+		})
+		if err == nil {
+			return
+		}
+		log.FromContext(ctx).Error("Failed to edit message", "error", err)
+	}
+	b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: chatID,
+		Text:   text,
+	})
+}
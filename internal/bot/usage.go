@@ -0,0 +1,118 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"butterfly.orx.me/core/log"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/dao"
+	"go.orx.me/xbot/internal/pkg/llm"
+)
+
+// callerID returns the user who sent a message, 0 for channel posts
+func callerID(message *models.Message) int64 {
+	if message.From == nil {
+		return 0
+	}
+	return message.From.ID
+}
+
+// recordUsage stores a request made to a model without delaying its answer
+func recordUsage(ctx context.Context, r *llm.Record) {
+	usage := dao.Usage{
+		ChatID:           r.ChatID,
+		UserID:           r.UserID,
+		Task:             string(r.Task),
+		Model:            r.Model,
+		PromptTokens:     r.Usage.PromptTokens,
+		CompletionTokens: r.Usage.CompletionTokens,
+		Images:           r.Images,
+		LatencyMs:        r.Latency.Milliseconds(),
+		Cost:             r.Cost,
+	}
+	if r.Err != nil {
+		usage.Error = r.Err.Error()
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		// Without a database the usage is only in the metrics
+		if err := dao.SaveUsage(ctx, usage); err != nil && !errors.Is(err, dao.ErrNoMongo) {
+			log.FromContext(ctx).Error("SaveUsage error", "chatID", usage.ChatID, "error", err)
+		}
+	}()
+}
+
+// formatUsage describes a usage total on a line
+func formatUsage(total *dao.UsageTotal) string {
+	s := fmt.Sprintf("$%.4f, %d requests, %d tokens", total.Cost, total.Requests,
+		total.PromptTokens+total.CompletionTokens)
+	if total.Images > 0 {
+		s += fmt.Sprintf(", %d images", total.Images)
+	}
+	return s
+}
+
+// usageScope is whose usage /usage shows, userID 0 for the whole chat
+type usageScope struct {
+	title  string
+	userID int64
+}
+
+// usageHandler shows the spend of the chat and of the caller in the chat
+// today and this month
+func usageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	logger := log.FromContext(ctx).With("handler", "usageHandler")
+	chatID := update.Message.Chat.ID
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	// In a private chat the caller is the chat
+	scopes := []usageScope{{"This chat", 0}}
+	if userID := callerID(update.Message); userID != 0 && update.Message.Chat.Type != models.ChatTypePrivate {
+		scopes = append(scopes, usageScope{"You in this chat", userID})
+	}
+
+	var sb strings.Builder
+	sb.WriteString("📊 Model usage\n")
+	for _, scope := range scopes {
+		sb.WriteString("\n" + scope.title + "\n")
+		for _, period := range []struct {
+			name  string
+			since time.Time
+		}{{"Today", today}, {"This month", month}} {
+			total, err := dao.SumUsage(ctx, dao.UsageQuery{ChatID: chatID, UserID: scope.userID, Since: period.since})
+			if err != nil {
+				logger.Error("SumUsage error", "error", err)
+				text := "Error retrieving usage. Please try again later."
+				if errors.Is(err, dao.ErrNoMongo) {
+					text = "Usage is not recorded, it needs MongoDB or MySQL."
+				}
+				b.SendMessage(ctx, &bot.SendMessageParams{ChatID: chatID, Text: text})
+				return
+			}
+			sb.WriteString(fmt.Sprintf("%s: %s\n", period.name, formatUsage(total)))
+		}
+	}
+	sb.WriteString("\nCosts are estimated from the configured prices.")
+
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: chatID,
+		Text:   sb.String(),
+		ReplyParameters: &models.ReplyParameters{
+			ChatID:                   chatID,
+			MessageID:                update.Message.ID,
+			AllowSendingWithoutReply: true,
+		},
+	})
+	if err != nil {
+		logger.Error("SendMessage error", "error", err)
+	}
+}
@@ -1,10 +1,11 @@
 package conf
 
 type OpenAI struct {
-	Endpoint string   `yaml:"endpoint"`
-	Key      string   `yaml:"key"`
-	Model    string   `yaml:"model"`
-	Keys     []string `yaml:"keys"`
+	Endpoint string `yaml:"endpoint"`
+	Key      string `yaml:"key"`
+	Model    string `yaml:"model"`
+	// Keys are more API keys, requests are spread over them and Key
+	Keys []string `yaml:"keys"`
 }
 
 type Config struct {
@@ -12,6 +13,8 @@ type Config struct {
 
 	ChatEndpoint string `yaml:"chatEndpoint"`
 
+	// SummaryModels are tried in order for /sum, /ask and /hualao, e.g.
+	// gpt-4o or gemini:gemini-2.5-flash. See ModelsConfig.
 	SummaryModels []string `yaml:"summaryModels"`
 	Host          string   `yaml:"host"`
 	DBName        string   `yaml:"dbName"`
@@ -20,7 +23,24 @@ type Config struct {
 	Bots          []Bot    `yaml:"bots"`
 	S3            S3Config `yaml:"s3Config"`
 
-	MessageStorage string `yaml:"messageStorage"`
+	MessageStorage string             `yaml:"messageStorage"`
+	LocalStorage   LocalStorageConfig `yaml:"localStorage"`
+	MySQL          MySQLConfig        `yaml:"mysql"`
+	Retention      RetentionConfig    `yaml:"retention"`
+	HistoryCache   HistoryCacheConfig `yaml:"historyCache"`
+	Embedding      EmbeddingConfig    `yaml:"embedding"`
+	MediaArchive   MediaArchiveConfig `yaml:"mediaArchive"`
+	Encryption     EncryptionConfig   `yaml:"encryption"`
+	Admin          AdminConfig        `yaml:"admin"`
+
+	Providers  []ProviderConfig  `yaml:"providers"`
+	Models     ModelsConfig      `yaml:"models"`
+	ChatRoutes []ChatRouteConfig `yaml:"chatRoutes"`
+
+	Conversation ConversationConfig `yaml:"conversation"`
+	// Prices estimate the cost of the requests made to models
+	Prices    []PriceConfig   `yaml:"prices"`
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
 }
 
 type Bot struct {
@@ -36,6 +56,168 @@ type S3Config struct {
 	Bucket    string `yaml:"bucket"`
 }
 
+type LocalStorageConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+type MySQLConfig struct {
+	// DSN in the go-sql-driver/mysql format, e.g. user:pass@tcp(host:3306)/xbot
+	DSN string `yaml:"dsn"`
+}
+
+type RetentionConfig struct {
+	// Days messages are kept, 0 keeps them forever
+	Days  int             `yaml:"days"`
+	Chats []ChatRetention `yaml:"chats"`
+}
+
+type ChatRetention struct {
+	ChatID int64 `yaml:"chatID"`
+	// Days overrides the global retention for the chat, 0 keeps messages forever
+	Days int `yaml:"days"`
+	// NoStore disables storing the messages of the chat
+	NoStore bool `yaml:"noStore"`
+}
+
+type HistoryCacheConfig struct {
+	// Disabled turns off the in-process cache of recent chat history
+	Disabled bool `yaml:"disabled"`
+	// ChatMessages is the number of recent messages kept per chat, 0 uses the default
+	ChatMessages int `yaml:"chatMessages"`
+	// Chats is the number of chats kept in the cache, 0 uses the default
+	Chats int `yaml:"chats"`
+}
+
+type EmbeddingConfig struct {
+	// Model computing the embeddings, "provider:model" like the models of
+	// ModelsConfig. Empty disables semantic retrieval and /ask falls back to
+	// the recent history.
+	Model string `yaml:"model"`
+	// Index is the vector index implementation, empty is the brute-force one
+	Index string `yaml:"index"`
+	// TopK is the number of messages retrieved for /ask, 0 uses the default
+	TopK int `yaml:"topK"`
+	// Backfill is the maximum number of stored messages of a chat embedded
+	// when its index is first loaded, 0 uses the default
+	Backfill int `yaml:"backfill"`
+}
+
+type MediaArchiveConfig struct {
+	// Enabled downloads photos, voice notes and files of stored messages
+	Enabled bool `yaml:"enabled"`
+	// Storage is "s3" or "local", empty uses S3 when it is configured
+	Storage string `yaml:"storage"`
+	// Dir is the directory of the local archive, empty is "media" in the
+	// local message storage directory
+	Dir string `yaml:"dir"`
+	// MaxSize is the largest file archived in bytes, 0 is the 20 MB the Bot
+	// API allows to download
+	MaxSize int64 `yaml:"maxSize"`
+}
+
+type EncryptionConfig struct {
+	// MasterKey is the base64 encoded 32 byte key wrapping the data key of
+	// each chat. Empty stores messages in the clear. Only the mongodb and s3
+	// message storages encrypt messages, the others refuse to start with it.
+	MasterKey string `yaml:"masterKey"`
+	// OldMasterKeys are previous master keys, still used to read data keys
+	// until `xbot rotate-keys` wraps them with MasterKey
+	OldMasterKeys []string `yaml:"oldMasterKeys"`
+}
+
+type AdminConfig struct {
+	// Token authenticates the admin HTTP endpoints as a bearer token, empty
+	// disables them
+	Token string `yaml:"token"`
+}
+
+type ProviderConfig struct {
+	// Name refers to the provider in model references like "name:model"
+	Name string `yaml:"name"`
+	// Type is the implementation, openai (any OpenAI compatible API), gemini,
+	// anthropic, ollama or llamacpp
+	Type     string `yaml:"type"`
+	Endpoint string `yaml:"endpoint"`
+	Key      string `yaml:"key"`
+	// Keys are more API keys, requests are spread over them and Key
+	Keys []string `yaml:"keys"`
+	// MaxTokens limits the length of answers for APIs requiring a limit, 0
+	// uses the default of the provider
+	MaxTokens int `yaml:"maxTokens"`
+	// ContextWindow is the context size of the models of the provider in
+	// tokens, 0 uses a conservative default
+	ContextWindow int `yaml:"contextWindow"`
+	// ContextWindows are the context sizes of some models by name,
+	// overriding ContextWindow
+	ContextWindows map[string]int `yaml:"contextWindows"`
+	// Local marks providers running in our network, the only ones chat
+	// routes with localOnly use
+	Local bool `yaml:"local"`
+}
+
+// ModelsConfig lists the models used for each task, tried in order until one
+// succeeds. A model is "provider:model", or a model of the first provider.
+type ModelsConfig struct {
+	// Chat answers /gpt, empty uses openAI.model
+	Chat []string `yaml:"chat"`
+	// Summary runs /sum, /ask, /hualao and /poster, empty uses summaryModels
+	Summary []string `yaml:"summary"`
+	// Image draws /huahua and /poster, empty uses Gemini
+	Image []string `yaml:"image"`
+	// Embedding computes the embeddings of messages for /ask, empty uses
+	// embedding.model
+	Embedding string `yaml:"embedding"`
+}
+
+// ChatRouteConfig sends the requests made for some chats to other models
+type ChatRouteConfig struct {
+	ChatIDs []int64 `yaml:"chatIDs"`
+	// Models replace the models of the tasks they list
+	Models ModelsConfig `yaml:"models"`
+	// LocalOnly only uses local providers for the chats, requests fail rather
+	// than leave our network
+	LocalOnly bool `yaml:"localOnly"`
+}
+
+type ConversationConfig struct {
+	// MaxTokens caps the earlier turns of a /gpt conversation sent to the
+	// model, the oldest are left out first. 0 uses the default.
+	MaxTokens int `yaml:"maxTokens"`
+}
+
+// PriceConfig is the price of a model in dollars
+type PriceConfig struct {
+	// Model is the model as listed in ModelsConfig, e.g. gemini:gemini-2.5-flash
+	Model string `yaml:"model"`
+	// Input and Output are the prices of a million prompt and completion tokens
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+	// Image is the price of a generated image
+	Image float64 `yaml:"image"`
+}
+
+// RateLimitConfig limits how often the commands calling models are used
+type RateLimitConfig struct {
+	// Commands are the limits of the commands by name without the slash,
+	// e.g. huahua. They replace the defaults of huahua and poster.
+	Commands map[string]CommandLimitConfig `yaml:"commands"`
+	// Admins are the IDs of the Telegram users no limit applies to
+	Admins []int64 `yaml:"admins"`
+}
+
+// CommandLimitConfig is a token bucket per user and a daily quota per chat.
+// A use is one command, however many model requests it makes: a /sum, /ask
+// or /hualao over a long history can summarize it in 16 or more requests.
+type CommandLimitConfig struct {
+	// PerMinute is the number of uses a user regains per minute, 0 does not
+	// limit users
+	PerMinute float64 `yaml:"perMinute"`
+	// Burst is the number of uses a user can make in a row, 0 is 1
+	Burst int `yaml:"burst"`
+	// Daily is the number of uses per chat and day, 0 for no quota
+	Daily int `yaml:"daily"`
+}
+
 var (
 	Conf = new(Config)
 )
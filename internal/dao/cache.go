@@ -0,0 +1,277 @@
+package dao
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"go.orx.me/xbot/internal/metrics"
+)
+
+const (
+	// defaultCacheChatMessages is the number of recent messages kept per chat
+	defaultCacheChatMessages = 1000
+	// defaultCacheChats is the number of chats kept in the cache
+	defaultCacheChats = 1000
+)
+
+// CachedMessageStorage is a read-through cache in front of a MessageStorage.
+// It keeps a ring buffer of the most recent messages of each chat, warmed from
+// the storage on first access and kept up to date by SaveMessage, and serves
+// recent history queries from it when the buffer holds every message the
+// query can match. Everything else goes to the storage.
+//
+// Embeddings are not cached, they would be most of its memory. Queries reading
+// messages to save them again or for their embeddings set WithEmbeddings and
+// go to the storage.
+type CachedMessageStorage struct {
+	MessageStorage
+
+	chatMessages int
+	chats        int
+
+	mu sync.Mutex
+	// lru holds the cached chats, most recently used first
+	lru     *list.List
+	entries map[int64]*list.Element
+}
+
+// chatCache is the ring buffer of a chat
+type chatCache struct {
+	chatID int64
+
+	mu     sync.Mutex
+	loaded bool
+	// since is the unix time from which the buffer holds every message
+	since int64
+	// ring holds the cached messages oldest first starting at start
+	ring  []*Message
+	start int
+	size  int
+}
+
+// NewCachedMessageStorage wraps a storage with a cache of chatMessages
+// messages for at most chats chats, zero uses the defaults
+func NewCachedMessageStorage(storage MessageStorage, chatMessages, chats int) *CachedMessageStorage {
+	if chatMessages <= 0 {
+		chatMessages = defaultCacheChatMessages
+	}
+	if chats <= 0 {
+		chats = defaultCacheChats
+	}
+	return &CachedMessageStorage{
+		MessageStorage: storage,
+		chatMessages:   chatMessages,
+		chats:          chats,
+		lru:            list.New(),
+		entries:        make(map[int64]*list.Element),
+	}
+}
+
+// chat returns the cache of a chat, creating it if create is set
+func (s *CachedMessageStorage) chat(chatID int64, create bool) *chatCache {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[chatID]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*chatCache)
+	}
+	if !create {
+		return nil
+	}
+
+	c := &chatCache{chatID: chatID, ring: make([]*Message, s.chatMessages)}
+	s.entries[chatID] = s.lru.PushFront(c)
+	for s.lru.Len() > s.chats {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*chatCache).chatID)
+	}
+	metrics.HistoryCacheChats.Set(float64(s.lru.Len()))
+	return c
+}
+
+// invalidate drops the cache of a chat
+func (s *CachedMessageStorage) invalidate(chatID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[chatID]; ok {
+		s.lru.Remove(e)
+		delete(s.entries, chatID)
+	}
+	metrics.HistoryCacheChats.Set(float64(s.lru.Len()))
+}
+
+// SaveMessage stores the message and adds it to the cache of its chat
+func (s *CachedMessageStorage) SaveMessage(ctx context.Context, message *Message) error {
+	if err := s.MessageStorage.SaveMessage(ctx, message); err != nil {
+		return err
+	}
+
+	// Chats that are not cached yet will read the message when warmed
+	c := s.chat(message.ChatID, false)
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded {
+		c.add(message)
+	}
+	return nil
+}
+
+// GetMessageByChatID retrieves messages from the last 7 days for a specific chat ID
+func (s *CachedMessageStorage) GetMessageByChatID(ctx context.Context, chatID int64) ([]*Message, error) {
+	page, err := s.QueryMessages(ctx, MessageQuery{
+		ChatID: chatID,
+		Since:  historySince(time.Now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+// QueryMessages serves recent history queries from the cache
+func (s *CachedMessageStorage) QueryMessages(ctx context.Context, query MessageQuery) (*MessagePage, error) {
+	// Older pages and per user queries are rare and go to the storage
+	if query.Cursor != "" || query.SenderID != 0 || query.WithEmbeddings {
+		metrics.HistoryCacheRequests.WithLabelValues("bypass").Inc()
+		return s.MessageStorage.QueryMessages(ctx, query)
+	}
+
+	now := time.Now()
+	c := s.chat(query.ChatID, true)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.loaded {
+		since := historySince(now)
+		if !query.Since.IsZero() && query.Since.Before(since) {
+			since = query.Since
+		}
+		if err := s.warm(ctx, c, since); err != nil {
+			return nil, err
+		}
+	}
+	if page, ok := c.query(query, now); ok {
+		metrics.HistoryCacheRequests.WithLabelValues("hit").Inc()
+		return page, nil
+	}
+	metrics.HistoryCacheRequests.WithLabelValues("miss").Inc()
+	return s.MessageStorage.QueryMessages(ctx, query)
+}
+
+// Search searches the wrapped storage, the cache only holds recent history
+func (s *CachedMessageStorage) Search(ctx context.Context, chatID int64, query string, opts SearchOptions) ([]*SearchResult, error) {
+	return Search(ctx, s.MessageStorage, chatID, query, opts)
+}
+
+// DeleteMessages deletes the messages and drops the cache of the chat
+func (s *CachedMessageStorage) DeleteMessages(ctx context.Context, query MessageQuery) (int, error) {
+	deleted, err := s.MessageStorage.DeleteMessages(ctx, query)
+	s.invalidate(query.ChatID)
+	return deleted, err
+}
+
+// warm fills the buffer with the most recent messages since the given time
+func (s *CachedMessageStorage) warm(ctx context.Context, c *chatCache, since time.Time) error {
+	page, err := s.MessageStorage.QueryMessages(ctx, MessageQuery{
+		ChatID: c.chatID,
+		Since:  since,
+		Limit:  len(c.ring),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.since = since.Unix()
+	if page.NextCursor != "" {
+		// Older messages of the same second may not have fit in the buffer
+		c.since = page.Messages[0].CreatedAt + 1
+	}
+	for _, m := range page.Messages {
+		c.add(m)
+	}
+	c.loaded = true
+	return nil
+}
+
+// add inserts a copy of a message without its embedding into the buffer,
+// evicting the oldest one when full
+func (c *chatCache) add(m *Message) {
+	if m.CreatedAt < c.since {
+		return
+	}
+	message := *m
+	message.Embedding = nil
+
+	messages := c.messages()
+	for i, m := range messages {
+		if m.ID == message.ID {
+			c.ring[(c.start+i)%len(c.ring)] = &message
+			return
+		}
+	}
+
+	if c.size == len(c.ring) {
+		evicted := c.ring[c.start]
+		c.ring[c.start] = nil
+		c.start = (c.start + 1) % len(c.ring)
+		c.size--
+		c.since = max(c.since, evicted.CreatedAt+1)
+		if message.CreatedAt < c.since {
+			return
+		}
+	}
+	c.ring[(c.start+c.size)%len(c.ring)] = &message
+	c.size++
+
+	// Messages almost always arrive in order, keep the buffer sorted otherwise
+	for i := c.size - 1; i > 0; i-- {
+		cur := (c.start + i) % len(c.ring)
+		prev := (c.start + i - 1) % len(c.ring)
+		if !lessMessage(c.ring[cur], c.ring[prev]) {
+			break
+		}
+		c.ring[cur], c.ring[prev] = c.ring[prev], c.ring[cur]
+	}
+}
+
+// messages returns the buffered messages oldest first
+func (c *chatCache) messages() []*Message {
+	messages := make([]*Message, 0, c.size)
+	for i := 0; i < c.size; i++ {
+		messages = append(messages, c.ring[(c.start+i)%len(c.ring)])
+	}
+	return messages
+}
+
+// query answers the query from the buffer, ok is false when messages the query
+// matches may be missing from it
+func (c *chatCache) query(query MessageQuery, now time.Time) (*MessagePage, bool) {
+	// Expired messages the retention job has not purged yet must not be
+	// served either
+	cutoff := retentionFor(c.chatID).cutoff(now)
+
+	var matched []*Message
+	for _, m := range c.messages() {
+		if !cutoff.IsZero() && m.CreatedAt < cutoff.Unix() {
+			continue
+		}
+		if query.match(m, nil) {
+			copied := *m
+			matched = append(matched, &copied)
+		}
+	}
+
+	complete := query.Since.Unix() >= c.since
+	if !complete && (query.Limit == 0 || len(matched) <= query.Limit) {
+		return nil, false
+	}
+	return newMessagePage(matched, query.Limit), true
+}
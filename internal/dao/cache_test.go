@@ -0,0 +1,110 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+func TestCachedMessageStorage(t *testing.T) {
+	testMessageStorage(t, func(t *testing.T) MessageStorage {
+		return NewCachedMessageStorage(NewMemoryMessageStorage(), 4, 2)
+	})
+}
+
+// countingStorage counts the queries reaching the wrapped storage
+type countingStorage struct {
+	MessageStorage
+	queries int
+}
+
+func (s *countingStorage) QueryMessages(ctx context.Context, query MessageQuery) (*MessagePage, error) {
+	s.queries++
+	return s.MessageStorage.QueryMessages(ctx, query)
+}
+
+func TestCachedMessageStorageHits(t *testing.T) {
+	storage := &countingStorage{MessageStorage: NewMemoryMessageStorage()}
+	s := NewCachedMessageStorage(storage, 3, 1)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		saveAt(t, s, 100, fmt.Sprintf("m%d", i), now.Add(time.Duration(i-10)*time.Minute))
+	}
+
+	recent := func(limit int) []string {
+		return queryTexts(t, s, MessageQuery{ChatID: 100, Since: historySince(time.Now()), Limit: limit})
+	}
+	assertQueries := func(want int) {
+		t.Helper()
+		if storage.queries != want {
+			t.Errorf("storage queries = %d, want %d", storage.queries, want)
+		}
+	}
+
+	// The first query warms the cache, the next ones are served from it
+	assertTexts(t, recent(0), "m0", "m1")
+	assertQueries(1)
+	saveAt(t, s, 100, "m2", now.Add(-time.Minute))
+	assertTexts(t, recent(0), "m0", "m1", "m2")
+	assertTexts(t, recent(2), "m1", "m2")
+	assertQueries(1)
+
+	// Once messages are evicted only limited queries can be answered
+	saveAt(t, s, 100, "m3", now)
+	assertTexts(t, recent(2), "m2", "m3")
+	assertQueries(1)
+	assertTexts(t, recent(0), "m0", "m1", "m2", "m3")
+	assertQueries(2)
+
+	// Deletions invalidate the chat
+	if _, err := s.DeleteMessages(context.Background(), MessageQuery{ChatID: 100, Until: now.Add(-5 * time.Minute)}); err != nil {
+		t.Fatalf("DeleteMessages: %v", err)
+	}
+	assertTexts(t, recent(0), "m2", "m3")
+	assertQueries(3)
+
+	// Warming another chat evicts the least recently used one
+	saveAt(t, s, 200, "other", now)
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 200, Since: historySince(time.Now())}), "other")
+	assertTexts(t, recent(0), "m2", "m3")
+	assertQueries(5)
+}
+
+func TestCachedMessageStorageEmbeddings(t *testing.T) {
+	ctx := context.Background()
+	s := NewCachedMessageStorage(NewMemoryMessageStorage(), 10, 1)
+	m := saveAt(t, s, 100, "hello", time.Now().Add(-time.Minute))
+	if err := SetEmbedding(ctx, s, m, "small", []float32{1, 2}); err != nil {
+		t.Fatalf("SetEmbedding: %v", err)
+	}
+
+	// The cache serves history without the embeddings
+	page, err := s.QueryMessages(ctx, MessageQuery{ChatID: 100, Since: historySince(time.Now())})
+	if err != nil || len(page.Messages) != 1 {
+		t.Fatalf("QueryMessages = %v, %v", page, err)
+	}
+	if page.Messages[0].Embedding != nil {
+		t.Errorf("cached message has embedding %v", page.Messages[0].Embedding)
+	}
+
+	// A reaction saves the message again without losing its embedding
+	_, err = ApplyUpdate(ctx, s, &models.Update{MessageReaction: &models.MessageReactionUpdated{
+		Chat:        m.Update.Message.Chat,
+		MessageID:   m.MessageID,
+		User:        &models.User{ID: 8},
+		NewReaction: []models.ReactionType{{ReactionTypeEmoji: &models.ReactionTypeEmoji{Emoji: "👍"}}},
+	}})
+	if err != nil {
+		t.Fatalf("ApplyUpdate: %v", err)
+	}
+	page, err = s.QueryMessages(ctx, MessageQuery{ChatID: 100, WithEmbeddings: true})
+	if err != nil || len(page.Messages) != 1 {
+		t.Fatalf("QueryMessages = %v, %v", page, err)
+	}
+	if got := page.Messages[0]; len(got.Embedding) != 2 || len(got.Reactions) != 1 {
+		t.Errorf("stored message = %+v", got)
+	}
+}
@@ -0,0 +1,277 @@
+package dao
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// compactionInterval is how often completed days are compacted
+const compactionInterval = time.Hour
+
+// Bundles hold every message of a chat day as gzip compressed JSON lines, the
+// number of messages is part of the key so it is known without reading it:
+// "chatID/year/month/day/bundle-<count>.ndjson.gz"
+const (
+	bundleKeyPrefix = "bundle-"
+	bundleKeySuffix = ".ndjson.gz"
+)
+
+// s3Day holds the object keys of one chat day
+type s3Day struct {
+	prefix string
+	// bundles are the keys of the compacted messages, sorted. A day has one
+	// unless a compaction or deletion stopped before removing the previous.
+	bundles []string
+	// keys are the per message object keys, sorted
+	keys []string
+}
+
+// groupDays groups sorted object keys by day, oldest first
+func groupDays(keys []string) []*s3Day {
+	var days []*s3Day
+	for _, key := range keys {
+		prefix := key[:strings.LastIndex(key, "/")+1]
+		if len(days) == 0 || days[len(days)-1].prefix != prefix {
+			days = append(days, &s3Day{prefix: prefix})
+		}
+		day := days[len(days)-1]
+		if isBundleKey(key) {
+			day.bundles = append(day.bundles, key)
+		} else {
+			day.keys = append(day.keys, key)
+		}
+	}
+	return days
+}
+
+func isBundleKey(key string) bool {
+	name := key[strings.LastIndex(key, "/")+1:]
+	return strings.HasPrefix(name, bundleKeyPrefix) && strings.HasSuffix(name, bundleKeySuffix)
+}
+
+// bundleCount returns the number of messages in a bundle from its key
+func bundleCount(key string) int {
+	name := key[strings.LastIndex(key, "/")+1:]
+	count, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, bundleKeyPrefix), bundleKeySuffix))
+	return count
+}
+
+// readBundle reads every message of a bundle
+func (s *S3MessageStorage) readBundle(ctx context.Context, key string) ([]*Message, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting object %s: %w", key, err)
+	}
+	defer obj.Close()
+
+	zr, err := gzip.NewReader(obj)
+	if err != nil {
+		return nil, fmt.Errorf("error reading bundle %s: %w", key, err)
+	}
+	defer zr.Close()
+
+	var messages []*Message
+	scanner := bufio.NewScanner(zr)
+	// Updates can be larger than the default 64KB token size
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		message, err := s.unmarshal(ctx, scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshaling message from %s: %w", key, err)
+		}
+		messages = append(messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading bundle %s: %w", key, err)
+	}
+	return messages, nil
+}
+
+// writeBundle stores messages as the bundle of a day and returns its key
+func (s *S3MessageStorage) writeBundle(ctx context.Context, prefix string, messages []*Message) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, m := range messages {
+		data, err := s.marshal(ctx, m)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal message: %w", err)
+		}
+		if _, err := zw.Write(append(data, '\n')); err != nil {
+			return "", fmt.Errorf("failed to compress bundle: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress bundle: %w", err)
+	}
+
+	key := fmt.Sprintf("%s%s%d%s", prefix, bundleKeyPrefix, len(messages), bundleKeySuffix)
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()),
+		minio.PutObjectOptions{ContentType: "application/gzip"})
+	if err != nil {
+		return "", fmt.Errorf("failed to store bundle in S3: %w", err)
+	}
+	return key, nil
+}
+
+// readBundles reads the messages of every bundle of a day, a message found in
+// several bundles is returned once
+func (s *S3MessageStorage) readBundles(ctx context.Context, day *s3Day) ([]*Message, error) {
+	if len(day.bundles) == 1 {
+		return s.readBundle(ctx, day.bundles[0])
+	}
+
+	var messages []*Message
+	index := make(map[string]int)
+	for _, key := range day.bundles {
+		bundled, err := s.readBundle(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range bundled {
+			if i, ok := index[message.ID.Hex()]; ok {
+				messages[i] = message
+				continue
+			}
+			index[message.ID.Hex()] = len(messages)
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+// dayCount returns the number of messages of a day, reading the bundles only
+// when there are several
+func (s *S3MessageStorage) dayCount(ctx context.Context, day *s3Day) (int, error) {
+	count := len(day.keys)
+	if len(day.bundles) == 1 {
+		return count + bundleCount(day.bundles[0]), nil
+	}
+	bundled, err := s.readBundles(ctx, day)
+	if err != nil {
+		return 0, err
+	}
+	return count + len(bundled), nil
+}
+
+// readDay reads every message of a day. Per message objects are newer than the
+// bundles, so they replace bundled messages with the same ID.
+func (s *S3MessageStorage) readDay(ctx context.Context, day *s3Day) ([]*Message, error) {
+	messages, err := s.readBundles(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int, len(messages))
+	for i, m := range messages {
+		index[m.ID.Hex()] = i
+	}
+	for _, key := range day.keys {
+		message, err := s.getMessage(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := index[message.ID.Hex()]; ok {
+			messages[i] = message
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	sortMessages(messages)
+	return messages, nil
+}
+
+// compactDay rolls the per message objects and the bundles of a day into a
+// single bundle
+func (s *S3MessageStorage) compactDay(ctx context.Context, day *s3Day) error {
+	messages, err := s.readDay(ctx, day)
+	if err != nil {
+		return err
+	}
+
+	key, err := s.writeBundle(ctx, day.prefix, messages)
+	if err != nil {
+		return err
+	}
+
+	remove := append([]string{}, day.keys...)
+	for _, bundle := range day.bundles {
+		if bundle != key {
+			remove = append(remove, bundle)
+		}
+	}
+	return s.removeObjects(ctx, remove)
+}
+
+// Compact rolls every day before the given time that still has per message
+// objects into a single bundle per chat and day. It returns the number of
+// days compacted.
+func (s *S3MessageStorage) Compact(ctx context.Context, before time.Time) (int, error) {
+	chatIDs, err := s.ListChatIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+	for _, chatID := range chatIDs {
+		n, err := s.compactChat(ctx, chatID, before)
+		compacted += n
+		if err != nil {
+			return compacted, err
+		}
+	}
+	return compacted, nil
+}
+
+// compactChat compacts the days of a chat before the given time
+func (s *S3MessageStorage) compactChat(ctx context.Context, chatID int64, before time.Time) (int, error) {
+	query := MessageQuery{ChatID: chatID, Until: before}
+	keys, err := s.listKeys(ctx, query, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+	for _, day := range groupDays(keys) {
+		if (len(day.keys) == 0 && len(day.bundles) < 2) || !s.dayWithin(day.prefix, query) {
+			continue
+		}
+		if err := s.compactDay(ctx, day); err != nil {
+			return compacted, fmt.Errorf("failed to compact %s: %w", day.prefix, err)
+		}
+		compacted++
+	}
+	return compacted, nil
+}
+
+// runCompaction compacts completed days every compactionInterval until ctx is done
+func runCompaction(ctx context.Context, s *S3MessageStorage) {
+	ticker := time.NewTicker(compactionInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		compacted, err := s.Compact(ctx, today)
+		if err != nil {
+			log.Printf("Failed to compact S3 messages: %v", err)
+		} else if compacted > 0 {
+			log.Printf("Compacted %d days of S3 messages", compacted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
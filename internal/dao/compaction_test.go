@@ -0,0 +1,142 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3Compact(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newFakeS3(t)
+	s := NewS3MessageStorage(client, "xbot")
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var want []string
+	for day := 3; day > 0; day-- {
+		for i := 0; i < 3; i++ {
+			text := fmt.Sprintf("d%d-m%d", day, i)
+			saveAt(t, s, 100, text, today.AddDate(0, 0, -day).Add(time.Duration(i+1)*time.Hour))
+			want = append(want, text)
+		}
+	}
+	saveAt(t, s, 100, "today", now)
+	want = append(want, "today")
+
+	query := MessageQuery{ChatID: 100}
+	before := fake.requests.Load()
+	assertTexts(t, queryTexts(t, s, query), want...)
+	uncompacted := fake.requests.Load() - before
+
+	compacted, err := s.Compact(ctx, today)
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if compacted != 3 {
+		t.Errorf("compacted = %d, want 3", compacted)
+	}
+
+	bundles := 0
+	for _, key := range fake.keys() {
+		if isBundleKey(key) {
+			bundles++
+			if !strings.HasSuffix(key, "bundle-3.ndjson.gz") {
+				t.Errorf("unexpected bundle %s", key)
+			}
+		}
+	}
+	if bundles != 3 || len(fake.keys()) != 4 {
+		t.Errorf("keys after compaction = %q", fake.keys())
+	}
+
+	before = fake.requests.Load()
+	assertTexts(t, queryTexts(t, s, query), want...)
+	if got := fake.requests.Load() - before; got >= uncompacted {
+		t.Errorf("query after compaction took %d requests, want fewer than %d", got, uncompacted)
+	}
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100, Limit: 2}), "d1-m2", "today")
+
+	// Compacting again is a no-op
+	if compacted, err := s.Compact(ctx, today); err != nil || compacted != 0 {
+		t.Errorf("Compact again = %d, %v, want 0", compacted, err)
+	}
+
+	// Saving into a compacted day replaces the bundled message until the next compaction
+	page, err := s.QueryMessages(ctx, MessageQuery{ChatID: 100, Limit: 1, Until: today})
+	if err != nil {
+		t.Fatalf("QueryMessages: %v", err)
+	}
+	edited := page.Messages[0]
+	edited.Update.Message.Text = "edited"
+	if err := s.SaveMessage(ctx, edited); err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100, Since: today.AddDate(0, 0, -1)}), "d1-m0", "d1-m1", "edited", "today")
+	if _, err := s.Compact(ctx, today); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100, Since: today.AddDate(0, 0, -1)}), "d1-m0", "d1-m1", "edited", "today")
+
+	// Deleting part of a bundle rewrites it, whole days are deleted by key
+	n, err := s.DeleteMessages(ctx, MessageQuery{ChatID: 100, Until: today.AddDate(0, 0, -2).Add(2 * time.Hour)})
+	if err != nil {
+		t.Fatalf("DeleteMessages: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("deleted = %d, want 4", n)
+	}
+	assertTexts(t, queryTexts(t, s, query), "d2-m1", "d2-m2", "d1-m0", "d1-m1", "edited", "today")
+
+	n, err = s.DeleteMessages(ctx, MessageQuery{ChatID: 100, SenderID: 7})
+	if err != nil {
+		t.Fatalf("DeleteMessages: %v", err)
+	}
+	if n != 6 {
+		t.Errorf("deleted by sender = %d, want 6", n)
+	}
+	if keys := fake.keys(); len(keys) != 0 {
+		t.Errorf("keys after delete = %q", keys)
+	}
+}
+
+func TestS3CompactSeveralBundles(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newFakeS3(t)
+	s := NewS3MessageStorage(client, "xbot")
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	day := today.AddDate(0, 0, -1)
+	first := saveAt(t, s, 100, "first", day.Add(time.Hour))
+	saveAt(t, s, 100, "second", day.Add(2*time.Hour))
+	saveAt(t, s, 100, "fourth", day.Add(4*time.Hour))
+	if _, err := s.Compact(ctx, today); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	// A second bundle left by an interrupted run, holding a message of the first
+	late := &Message{Update: textUpdate(3, 100, 7, "third"), CreatedAt: day.Add(3 * time.Hour).Unix()}
+	late.prepare(now)
+	prefix := s.dayPrefix(100, day)
+	if _, err := s.writeBundle(ctx, prefix, []*Message{first, late}); err != nil {
+		t.Fatalf("writeBundle: %v", err)
+	}
+
+	query := MessageQuery{ChatID: 100, Until: today}
+	assertTexts(t, queryTexts(t, s, query), "first", "second", "third", "fourth")
+
+	if compacted, err := s.Compact(ctx, today); err != nil || compacted != 1 {
+		t.Fatalf("Compact = %d, %v, want 1", compacted, err)
+	}
+	if keys := fake.keys(); len(keys) != 1 || !strings.HasSuffix(keys[0], "bundle-4.ndjson.gz") {
+		t.Errorf("keys after compaction = %q", keys)
+	}
+	assertTexts(t, queryTexts(t, s, query), "first", "second", "third", "fourth")
+
+	if deleted, err := s.DeleteMessages(ctx, query); err != nil || deleted != 4 {
+		t.Errorf("DeleteMessages = %d, %v, want 4", deleted, err)
+	}
+}
@@ -0,0 +1,81 @@
+package dao
+
+import (
+	"context"
+	"time"
+)
+
+const defaultCopyBatchSize = 500
+
+// CopyOptions controls CopyMessages
+type CopyOptions struct {
+	ChatID int64
+	Since  time.Time
+	Until  time.Time
+	// BatchSize is the number of messages read per page
+	BatchSize int
+	// Cursor resumes a previous copy from CopyProgress.Cursor
+	Cursor string
+	// DryRun reads the source without writing to the destination
+	DryRun bool
+	// Progress is called after every batch
+	Progress func(CopyProgress)
+}
+
+// CopyProgress reports the state of a running copy
+type CopyProgress struct {
+	ChatID int64
+	// Copied is the number of messages copied so far
+	Copied int
+	// Oldest is the creation time of the oldest message copied so far
+	Oldest time.Time
+	// Cursor resumes the copy after this batch, empty when the copy is complete
+	Cursor string
+}
+
+// CopyMessages streams the messages of a chat from one storage to another,
+// newest first. Messages keep their ID and creation time, so copying the same
+// messages again replaces them instead of creating duplicates.
+func CopyMessages(ctx context.Context, from, to MessageStorage, opts CopyOptions) (int, error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultCopyBatchSize
+	}
+
+	progress := CopyProgress{ChatID: opts.ChatID}
+	cursor := opts.Cursor
+	for {
+		page, err := from.QueryMessages(ctx, MessageQuery{
+			ChatID: opts.ChatID,
+			Since:  opts.Since,
+			Until:  opts.Until,
+			Limit:  batchSize,
+			Cursor: cursor,
+		})
+		if err != nil {
+			return progress.Copied, err
+		}
+
+		for _, message := range page.Messages {
+			if !opts.DryRun {
+				if err := to.SaveMessage(ctx, message); err != nil {
+					return progress.Copied, err
+				}
+			}
+			progress.Copied++
+		}
+		if len(page.Messages) > 0 {
+			progress.Oldest = time.Unix(page.Messages[0].CreatedAt, 0)
+		}
+
+		progress.Cursor = page.NextCursor
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+
+		if page.NextCursor == "" {
+			return progress.Copied, nil
+		}
+		cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,51 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCopyMessages(t *testing.T) {
+	ctx := context.Background()
+	from := NewMemoryMessageStorage()
+	to := NewMemoryMessageStorage()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		saveAt(t, from, 100, fmt.Sprintf("m%d", i), now.Add(time.Duration(i-5)*time.Minute))
+	}
+
+	// Stop after the first batch to simulate an interrupted copy
+	var cursor string
+	_, err := CopyMessages(ctx, from, to, CopyOptions{
+		ChatID:    100,
+		BatchSize: 2,
+		Progress: func(p CopyProgress) {
+			if cursor == "" {
+				cursor = p.Cursor
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("CopyMessages: %v", err)
+	}
+
+	// Resuming and copying everything again must not duplicate messages
+	for _, resume := range []string{cursor, ""} {
+		if _, err := CopyMessages(ctx, from, to, CopyOptions{ChatID: 100, BatchSize: 2, Cursor: resume}); err != nil {
+			t.Fatalf("CopyMessages: %v", err)
+		}
+	}
+	assertTexts(t, queryTexts(t, to, MessageQuery{ChatID: 100}), "m0", "m1", "m2", "m3", "m4")
+
+	dry := NewMemoryMessageStorage()
+	copied, err := CopyMessages(ctx, from, dry, CopyOptions{ChatID: 100, DryRun: true})
+	if err != nil {
+		t.Fatalf("CopyMessages: %v", err)
+	}
+	if copied != 5 {
+		t.Errorf("dry run copied = %d, want 5", copied)
+	}
+	assertTexts(t, queryTexts(t, dry, MessageQuery{ChatID: 100}))
+}
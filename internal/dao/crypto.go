@@ -0,0 +1,544 @@
+package dao
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/minio/minio-go/v7"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.orx.me/xbot/internal/conf"
+)
+
+// keyObjectPrefix keeps the data keys apart from the chat prefixes of the S3
+// message storage
+const keyObjectPrefix = "keys/"
+
+const (
+	// keyCacheTTL is how long the data keys of a chat are used before they are
+	// read again, so a key rotated by another process is picked up
+	keyCacheTTL = 10 * time.Minute
+	// keyRetireGrace is how long a replaced data key is kept. Processes may
+	// seal messages with it until they read the keys again.
+	keyRetireGrace = 24 * time.Hour
+)
+
+// ErrNotEncrypted is returned by RotateKeys for storages without encryption
+var ErrNotEncrypted = errors.New("message storage is not encrypted")
+
+// Sealed is the encrypted content of a message
+type Sealed struct {
+	// KeyID is the ID of the data key of the chat that encrypted the message
+	KeyID string `bson:"key_id"`
+	Nonce []byte `bson:"nonce"`
+	Data  []byte `bson:"data"`
+}
+
+// sealedContent are the fields of a Message that are encrypted. The IDs and
+// times stay in the clear so messages can still be queried.
+type sealedContent struct {
+	Update         *models.Update  `json:"update,omitempty"`
+	Edited         *models.Message `json:"edited,omitempty"`
+	Reactions      []Reaction      `json:"reactions,omitempty"`
+	ReactionCounts []ReactionCount `json:"reaction_counts,omitempty"`
+	Embedding      []float32       `json:"embedding,omitempty"`
+	Attachments    []Attachment    `json:"attachments,omitempty"`
+}
+
+// DataKey is a data key of a chat, wrapped by a master key
+type DataKey struct {
+	ID string `bson:"id" json:"id"`
+	// MasterKeyID identifies the master key that wrapped the data key
+	MasterKeyID string `bson:"master_key_id" json:"master_key_id"`
+	Wrapped     []byte `bson:"wrapped" json:"wrapped"`
+	CreatedAt   int64  `bson:"created_at" json:"created_at"`
+	// RetiredAt is when a newer key replaced it as the current key
+	RetiredAt int64 `bson:"retired_at,omitempty" json:"retired_at,omitempty"`
+}
+
+// KeyStore stores the wrapped data keys of each chat
+type KeyStore interface {
+	// LoadKeys returns the data keys of a chat, oldest first
+	LoadKeys(ctx context.Context, chatID int64) ([]DataKey, error)
+	// SaveKeys replaces the data keys of a chat
+	SaveKeys(ctx context.Context, chatID int64, keys []DataKey) error
+	// CreateKeys stores the first data keys of a chat unless it already has
+	// some, and reports whether they were stored
+	CreateKeys(ctx context.Context, chatID int64, keys []DataKey) (bool, error)
+}
+
+// Keyring encrypts messages with a data key per chat. Data keys are stored
+// wrapped by the master key, older master keys can still unwrap the data keys
+// they wrapped until the keys are rotated.
+type Keyring struct {
+	masterID string
+	master   cipher.AEAD
+	// masters are every usable master key by ID, including the current one
+	masters map[string]cipher.AEAD
+	store   KeyStore
+
+	mu    sync.Mutex
+	chats map[int64]*chatKeys
+}
+
+// chatKeys are the unwrapped data keys of a chat
+type chatKeys struct {
+	stored   []DataKey
+	current  string
+	aeads    map[string]cipher.AEAD
+	loadedAt time.Time
+}
+
+// NewKeyring creates a keyring from base64 encoded 256 bit master keys
+func NewKeyring(masterKey string, oldMasterKeys []string, store KeyStore) (*Keyring, error) {
+	k := &Keyring{
+		masters: make(map[string]cipher.AEAD),
+		store:   store,
+		chats:   make(map[int64]*chatKeys),
+	}
+	for i, encoded := range append([]string{masterKey}, oldMasterKeys...) {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("master key %d is not a base64 encoded 32 byte key", i)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:4])
+		if i == 0 {
+			k.masterID = id
+			k.master = aead
+		}
+		k.masters[id] = aead
+	}
+	return k, nil
+}
+
+// configuredKeyring returns the keyring of the configured master key, nil
+// when encryption is disabled
+func configuredKeyring(store KeyStore) (*Keyring, error) {
+	config := conf.Conf.Encryption
+	if config.MasterKey == "" {
+		return nil, nil
+	}
+	return NewKeyring(config.MasterKey, config.OldMasterKeys, store)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keys returns the data keys of a chat, creating its first key if needed.
+// reload reads the keys again from the store, they are also read again once
+// cached for keyCacheTTL.
+func (k *Keyring) keys(ctx context.Context, chatID int64, reload bool) (*chatKeys, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if keys, ok := k.chats[chatID]; ok && !reload && time.Since(keys.loadedAt) < keyCacheTTL {
+		return keys, nil
+	}
+	stored, err := k.store.LoadKeys(ctx, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load data keys of chat %d: %w", chatID, err)
+	}
+	if len(stored) == 0 {
+		key, err := k.newDataKey(chatID)
+		if err != nil {
+			return nil, err
+		}
+		stored = []DataKey{key}
+		// Another process may create the first key at the same time, the one
+		// stored first is used by both
+		created, err := k.store.CreateKeys(ctx, chatID, stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save data key of chat %d: %w", chatID, err)
+		}
+		if !created {
+			if stored, err = k.store.LoadKeys(ctx, chatID); err != nil {
+				return nil, fmt.Errorf("failed to load data keys of chat %d: %w", chatID, err)
+			}
+		}
+	}
+	return k.setKeys(chatID, stored)
+}
+
+// setKeys unwraps the stored data keys of a chat and caches them
+func (k *Keyring) setKeys(chatID int64, stored []DataKey) (*chatKeys, error) {
+	keys := &chatKeys{stored: stored, aeads: make(map[string]cipher.AEAD, len(stored)), loadedAt: time.Now()}
+	for _, key := range stored {
+		raw, err := k.unwrap(chatID, key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return nil, err
+		}
+		keys.aeads[key.ID] = aead
+		keys.current = key.ID
+	}
+	k.chats[chatID] = keys
+	return keys, nil
+}
+
+// newDataKey generates a data key for a chat wrapped by the master key
+func (k *Keyring) newDataKey(chatID int64) (DataKey, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return DataKey{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return DataKey{}, err
+	}
+	key := DataKey{ID: hex.EncodeToString(id), CreatedAt: time.Now().Unix()}
+	return k.wrap(chatID, key, raw)
+}
+
+// wrap encrypts a data key with the master key, bound to the chat
+func (k *Keyring) wrap(chatID int64, key DataKey, raw []byte) (DataKey, error) {
+	nonce := make([]byte, k.master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return DataKey{}, err
+	}
+	key.MasterKeyID = k.masterID
+	key.Wrapped = k.master.Seal(nonce, nonce, raw, keyAAD(chatID, key.ID))
+	return key, nil
+}
+
+// unwrap decrypts a data key with the master key that wrapped it
+func (k *Keyring) unwrap(chatID int64, key DataKey) ([]byte, error) {
+	master, ok := k.masters[key.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("data key %s of chat %d is wrapped by unknown master key %s",
+			key.ID, chatID, key.MasterKeyID)
+	}
+	n := master.NonceSize()
+	if len(key.Wrapped) < n {
+		return nil, fmt.Errorf("data key %s of chat %d is truncated", key.ID, chatID)
+	}
+	raw, err := master.Open(nil, key.Wrapped[:n], key.Wrapped[n:], keyAAD(chatID, key.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key %s of chat %d: %w", key.ID, chatID, err)
+	}
+	return raw, nil
+}
+
+// Rotate gives a chat a new current data key and wraps its older data keys
+// with the current master key, so older master keys are no longer needed
+func (k *Keyring) Rotate(ctx context.Context, chatID int64) error {
+	keys, err := k.keys(ctx, chatID, true)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now().Unix()
+	var stored []DataKey
+	for _, key := range keys.stored {
+		raw, err := k.unwrap(chatID, key)
+		if err != nil {
+			return err
+		}
+		if key, err = k.wrap(chatID, key, raw); err != nil {
+			return err
+		}
+		if key.RetiredAt == 0 {
+			// Also keys retired before the time was recorded
+			key.RetiredAt = now
+		}
+		stored = append(stored, key)
+	}
+	key, err := k.newDataKey(chatID)
+	if err != nil {
+		return err
+	}
+	stored = append(stored, key)
+
+	if err := k.store.SaveKeys(ctx, chatID, stored); err != nil {
+		return fmt.Errorf("failed to save data keys of chat %d: %w", chatID, err)
+	}
+	_, err = k.setKeys(chatID, stored)
+	return err
+}
+
+// Prune drops the data keys of a chat retired more than keyRetireGrace ago.
+// Messages sealed with them must have been sealed again since.
+func (k *Keyring) Prune(ctx context.Context, chatID int64) error {
+	keys, err := k.keys(ctx, chatID, true)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	retiredBefore := time.Now().Add(-keyRetireGrace).Unix()
+	var stored []DataKey
+	for _, key := range keys.stored {
+		if key.ID == keys.current || key.RetiredAt > retiredBefore {
+			stored = append(stored, key)
+		}
+	}
+	if err := k.store.SaveKeys(ctx, chatID, stored); err != nil {
+		return fmt.Errorf("failed to save data keys of chat %d: %w", chatID, err)
+	}
+	_, err = k.setKeys(chatID, stored)
+	return err
+}
+
+// seal returns a copy of the message with its content encrypted by the
+// current data key of the chat
+func (k *Keyring) seal(ctx context.Context, m *Message) (*Message, error) {
+	keys, err := k.keys(ctx, m.ChatID, false)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(sealedContent{
+		Update:         m.Update,
+		Edited:         m.Edited,
+		Reactions:      m.Reactions,
+		ReactionCounts: m.ReactionCounts,
+		Embedding:      m.Embedding,
+		Attachments:    m.Attachments,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	aead := keys.aeads[keys.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := *m
+	sealed.Update = nil
+	sealed.Edited = nil
+	sealed.Reactions = nil
+	sealed.ReactionCounts = nil
+	sealed.Embedding = nil
+	sealed.Attachments = nil
+	sealed.Sealed = &Sealed{
+		KeyID: keys.current,
+		Nonce: nonce,
+		Data:  aead.Seal(nil, nonce, plaintext, messageAAD(m)),
+	}
+	return &sealed, nil
+}
+
+// open decrypts the content of a sealed message in place, messages stored
+// before encryption was enabled are left as they are
+func (k *Keyring) open(ctx context.Context, m *Message) error {
+	if m.Sealed == nil {
+		return nil
+	}
+	keys, err := k.keys(ctx, m.ChatID, false)
+	if err != nil {
+		return err
+	}
+	aead, ok := keys.aeads[m.Sealed.KeyID]
+	if !ok {
+		// The key may have been added by a rotation in another process
+		if keys, err = k.keys(ctx, m.ChatID, true); err != nil {
+			return err
+		}
+		if aead, ok = keys.aeads[m.Sealed.KeyID]; !ok {
+			return fmt.Errorf("message %s is sealed with unknown data key %s", m.ID.Hex(), m.Sealed.KeyID)
+		}
+	}
+
+	plaintext, err := aead.Open(nil, m.Sealed.Nonce, m.Sealed.Data, messageAAD(m))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt message %s: %w", m.ID.Hex(), err)
+	}
+	var content sealedContent
+	if err := json.Unmarshal(plaintext, &content); err != nil {
+		return fmt.Errorf("failed to unmarshal message %s: %w", m.ID.Hex(), err)
+	}
+	m.Update = content.Update
+	m.Edited = content.Edited
+	m.Reactions = content.Reactions
+	m.ReactionCounts = content.ReactionCounts
+	m.Embedding = content.Embedding
+	m.Attachments = content.Attachments
+	m.Sealed = nil
+	return nil
+}
+
+// messageAAD binds the ciphertext to the message so it cannot be moved
+func messageAAD(m *Message) []byte {
+	return []byte(strconv.FormatInt(m.ChatID, 10) + "/" + m.ID.Hex())
+}
+
+// keyAAD binds a wrapped data key to its chat
+func keyAAD(chatID int64, keyID string) []byte {
+	return []byte(strconv.FormatInt(chatID, 10) + "/" + keyID)
+}
+
+// mongoKeyStore stores the data keys of each chat as a document
+type mongoKeyStore struct {
+	coll *mongo.Collection
+}
+
+type chatKeysDoc struct {
+	ChatID int64     `bson:"_id"`
+	Keys   []DataKey `bson:"keys"`
+}
+
+func (s *mongoKeyStore) LoadKeys(ctx context.Context, chatID int64) ([]DataKey, error) {
+	var doc chatKeysDoc
+	err := s.coll.FindOne(ctx, bson.M{"_id": chatID}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return doc.Keys, err
+}
+
+func (s *mongoKeyStore) SaveKeys(ctx context.Context, chatID int64, keys []DataKey) error {
+	_, err := s.coll.ReplaceOne(ctx, bson.M{"_id": chatID}, chatKeysDoc{ChatID: chatID, Keys: keys},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoKeyStore) CreateKeys(ctx context.Context, chatID int64, keys []DataKey) (bool, error) {
+	_, err := s.coll.InsertOne(ctx, chatKeysDoc{ChatID: chatID, Keys: keys})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// s3KeyStore stores the data keys of each chat as "keys/<chatID>.json"
+type s3KeyStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s *s3KeyStore) key(chatID int64) string {
+	return keyObjectPrefix + strconv.FormatInt(chatID, 10) + ".json"
+}
+
+func (s *s3KeyStore) LoadKeys(ctx context.Context, chatID int64) ([]DataKey, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(chatID), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	var buffer bytes.Buffer
+	if _, err := buffer.ReadFrom(obj); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []DataKey
+	if err := json.Unmarshal(buffer.Bytes(), &keys); err != nil {
+		return nil, fmt.Errorf("error unmarshaling data keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (s *s3KeyStore) SaveKeys(ctx context.Context, chatID int64, keys []DataKey) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, s.key(chatID), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+func (s *s3KeyStore) CreateKeys(ctx context.Context, chatID int64, keys []DataKey) (bool, error) {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return false, err
+	}
+	opts := minio.PutObjectOptions{ContentType: "application/json"}
+	opts.SetMatchETagExcept("*")
+	_, err = s.client.PutObject(ctx, s.bucket, s.key(chatID), bytes.NewReader(data), int64(len(data)), opts)
+	if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RotateOptions controls RotateKeys
+type RotateOptions struct {
+	// BatchSize is the number of messages read per page
+	BatchSize int
+	// Prune drops the data keys of the chat retired more than keyRetireGrace
+	// ago once its messages are encrypted with the new one. Processes still
+	// sealing with a just retired key may have used it after the messages
+	// were read, so it is dropped by a later rotation.
+	Prune bool
+	// Progress is called after every batch
+	Progress func(CopyProgress)
+}
+
+// RotateKeys gives a chat a new data key and encrypts every stored message of
+// the chat again with it, including messages stored before encryption was
+// enabled. It returns the number of messages encrypted.
+func RotateKeys(ctx context.Context, storage MessageStorage, chatID int64, opts RotateOptions) (int, error) {
+	var keys *Keyring
+	switch s := storage.(type) {
+	case *MongoDBStorage:
+		keys = s.keys
+	case *S3MessageStorage:
+		keys = s.keys
+	}
+	if keys == nil {
+		return 0, ErrNotEncrypted
+	}
+
+	if err := keys.Rotate(ctx, chatID); err != nil {
+		return 0, err
+	}
+	// Saving a message seals it with the current data key of the chat
+	rotated, err := CopyMessages(ctx, storage, storage, CopyOptions{
+		ChatID:    chatID,
+		BatchSize: opts.BatchSize,
+		Progress:  opts.Progress,
+	})
+	if err != nil {
+		return rotated, err
+	}
+	if s3Storage, ok := storage.(*S3MessageStorage); ok {
+		// Bundles still hold the messages sealed with the older keys, rolling
+		// the saved messages into them seals them with the new one
+		if _, err := s3Storage.compactChat(ctx, chatID, time.Now().AddDate(0, 0, 1)); err != nil {
+			return rotated, err
+		}
+	}
+
+	if opts.Prune {
+		if err := keys.Prune(ctx, chatID); err != nil {
+			return rotated, err
+		}
+	}
+	return rotated, nil
+}
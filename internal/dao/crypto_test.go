@@ -0,0 +1,151 @@
+package dao
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"go.orx.me/xbot/internal/conf"
+)
+
+var (
+	testMasterKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newMasterKey  = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+func newTestKeyring(t *testing.T, store KeyStore, masterKey string, oldMasterKeys ...string) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(masterKey, oldMasterKeys, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRotateKeys(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newFakeS3(t)
+	store := &s3KeyStore{client: client, bucket: "xbot"}
+
+	// Messages stored before encryption was enabled stay readable
+	s := NewS3MessageStorage(client, "xbot")
+	now := time.Now()
+	saveAt(t, s, 100, "plain secret", now.AddDate(0, 0, -2))
+	s.keys = newTestKeyring(t, store, testMasterKey)
+	saveAt(t, s, 100, "sealed secret", now.AddDate(0, 0, -1))
+	saveAt(t, s, 100, "today secret", now)
+	if _, err := s.Compact(ctx, now.AddDate(0, 0, -1)); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100}), "plain secret", "sealed secret", "today secret")
+	if got := fake.find("sealed secret"); len(got) > 0 {
+		t.Errorf("plaintext stored in %q", got)
+	}
+
+	// A new master key reads the data keys of the old one until they are rotated
+	s.keys = newTestKeyring(t, store, newMasterKey, testMasterKey)
+	n, err := RotateKeys(ctx, s, 100, RotateOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("RotateKeys: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("rotated = %d, want 3", n)
+	}
+	if got := fake.find("secret"); len(got) > 0 {
+		t.Errorf("plaintext stored in %q", got)
+	}
+	// The key retired by this rotation may still be in use by other processes
+	keys, err := store.LoadKeys(ctx, 100)
+	if err != nil || len(keys) != 2 || keys[0].RetiredAt == 0 || keys[1].RetiredAt != 0 {
+		t.Fatalf("keys after prune = %v, %v", keys, err)
+	}
+
+	// It is dropped by a rotation after the grace period
+	keys[0].RetiredAt = now.Add(-keyRetireGrace - time.Minute).Unix()
+	if err := store.SaveKeys(ctx, 100, keys); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RotateKeys(ctx, s, 100, RotateOptions{Prune: true}); err != nil {
+		t.Fatalf("RotateKeys: %v", err)
+	}
+	pruned, err := store.LoadKeys(ctx, 100)
+	if err != nil || len(pruned) != 2 || pruned[0].ID != keys[1].ID {
+		t.Fatalf("keys after the second prune = %v, %v", pruned, err)
+	}
+
+	s.keys = newTestKeyring(t, store, newMasterKey)
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100, SenderID: 7}), "plain secret", "sealed secret", "today secret")
+
+	// Without the master key the messages cannot be read
+	s.keys = newTestKeyring(t, store, testMasterKey)
+	if _, err := s.QueryMessages(ctx, MessageQuery{ChatID: 100}); err == nil {
+		t.Error("QueryMessages with the old master key succeeded")
+	}
+
+	if _, err := RotateKeys(ctx, NewMemoryMessageStorage(), 100, RotateOptions{}); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("RotateKeys on a plain storage = %v, want ErrNotEncrypted", err)
+	}
+}
+
+// staleKeyStore misses the keys of a chat on the first load, as a process
+// racing another one to create the first key
+type staleKeyStore struct {
+	KeyStore
+	loaded bool
+}
+
+func (s *staleKeyStore) LoadKeys(ctx context.Context, chatID int64) ([]DataKey, error) {
+	if !s.loaded {
+		s.loaded = true
+		return nil, nil
+	}
+	return s.KeyStore.LoadKeys(ctx, chatID)
+}
+
+func TestKeyringFirstKey(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newFakeS3(t)
+	store := &s3KeyStore{client: client, bucket: "xbot"}
+
+	first := newTestKeyring(t, store, testMasterKey)
+	second := newTestKeyring(t, &staleKeyStore{KeyStore: store}, testMasterKey)
+	firstKeys, err := first.keys(ctx, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondKeys, err := second.keys(ctx, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstKeys.current != secondKeys.current {
+		t.Errorf("keyrings use data keys %s and %s, want the same", firstKeys.current, secondKeys.current)
+	}
+	if keys, err := store.LoadKeys(ctx, 100); err != nil || len(keys) != 1 {
+		t.Errorf("stored keys = %v, %v, want one", keys, err)
+	}
+}
+
+func TestCheckEncryption(t *testing.T) {
+	old := conf.Conf.Encryption
+	t.Cleanup(func() { conf.Conf.Encryption = old })
+
+	conf.Conf.Encryption = conf.EncryptionConfig{}
+	if err := CheckEncryption(storageTypeLocal); err != nil {
+		t.Errorf("CheckEncryption without a master key = %v", err)
+	}
+
+	conf.Conf.Encryption = conf.EncryptionConfig{MasterKey: testMasterKey}
+	for _, storage := range []string{storageTypeMongoDB, storageTypeS3} {
+		if err := CheckEncryption(storage); err != nil {
+			t.Errorf("CheckEncryption(%s) = %v", storage, err)
+		}
+	}
+	for _, storage := range []string{storageTypeLocal, storageTypeMySQL, ""} {
+		if err := CheckEncryption(storage); err == nil {
+			t.Errorf("CheckEncryption(%q) accepted a storage storing plaintext", storage)
+		}
+	}
+}
@@ -12,22 +12,55 @@ import (
 // ErrNoStorage is returned when no storage is configured
 var ErrNoStorage = errors.New("no message storage configured")
 
+// CheckEncryption returns an error when a master key is configured but the
+// message storage of the given type cannot encrypt, so messages are not
+// stored in the clear against the configuration. Storages that are only read
+// need no check.
+func CheckEncryption(storageType string) error {
+	if conf.Conf.Encryption.MasterKey == "" {
+		return nil
+	}
+	switch storageType {
+	case storageTypeMongoDB, storageTypeS3:
+		return nil
+	}
+	if storageType == "" {
+		storageType = storageTypeLocal
+	}
+	return fmt.Errorf("message storage %s cannot encrypt messages, use mongodb or s3 with encryption.masterKey", storageType)
+}
+
 // Init initializes all database connections and storage components
 func Init(ctx context.Context) error {
 	log.Println("Initializing data access layer...")
 
-	InitMongo(context.Background())
+	if err := InitMongo(context.Background()); err != nil {
+		log.Printf("MongoDB not available: %v", err)
+	} else if err := ensureUsageIndexes(ctx, usageColl); err != nil {
+		log.Printf("Failed to create usage indexes: %v", err)
+	}
 
 	// Message storage configuration
 	storage := conf.Conf.MessageStorage
 	log.Printf("Message storage configuration: %s", storage)
+	if err := CheckEncryption(storage); err != nil {
+		return err
+	}
 
 	// Initialize based on configuration or initialize both with priority
 	switch storage {
 	case storageTypeMongoDB:
-		defaultMessageStorage = &MongoDBStorage{
-			messagesColl: messagesColl,
+		if messagesColl == nil {
+			return fmt.Errorf("failed to initialize configured storage MongoDB: %w", ErrNoMongo)
+		}
+		if err := ensureMessageIndexes(ctx, messagesColl); err != nil {
+			log.Printf("Failed to create message indexes: %v", err)
+		}
+		mongoStorage, err := newMongoDBStorage(messagesColl)
+		if err != nil {
+			return fmt.Errorf("failed to initialize configured storage MongoDB: %w", err)
 		}
+		defaultMessageStorage = mongoStorage
 
 	case storageTypeS3:
 		// Initialize only S3/MinIO
@@ -37,9 +70,78 @@ func Init(ctx context.Context) error {
 			return fmt.Errorf("failed to initialize configured storage S3: %w", errMinio)
 		}
 		log.Println("MinIO initialized and set as message storage")
+		if s3Storage, ok := defaultMessageStorage.(*S3MessageStorage); ok {
+			go runCompaction(context.Background(), s3Storage)
+		}
+
+	case storageTypeMySQL:
+		if err := InitMySQL(ctx); err != nil {
+			return fmt.Errorf("failed to initialize configured storage MySQL: %w", err)
+		}
+
+	case storageTypeLocal, "":
+		// Local disk storage is the default so no external service is needed
+		if err := InitLocal(); err != nil {
+			return fmt.Errorf("failed to initialize configured storage local: %w", err)
+		}
 
 	default:
+		return fmt.Errorf("unknown message storage %q", storage)
+	}
+
+	if !conf.Conf.HistoryCache.Disabled && defaultMessageStorage != nil {
+		defaultMessageStorage = NewCachedMessageStorage(defaultMessageStorage,
+			conf.Conf.HistoryCache.ChatMessages, conf.Conf.HistoryCache.Chats)
+	}
+
+	if err := InitMediaArchive(ctx); err != nil {
+		return fmt.Errorf("failed to initialize media archive: %w", err)
+	}
+
+	if retentionEnabled() && defaultMessageStorage != nil {
+		go runRetention(context.Background())
 	}
 
 	return nil
 }
+
+// NewMessageStorage creates a message storage of the given type from the
+// configuration without changing the default message storage. MongoDB must
+// have been initialized by Init or InitMongo first.
+func NewMessageStorage(ctx context.Context, storageType string) (MessageStorage, error) {
+	switch storageType {
+	case storageTypeMongoDB:
+		if messagesColl == nil {
+			return nil, ErrNoMongo
+		}
+		return newMongoDBStorage(messagesColl)
+
+	case storageTypeS3:
+		if minioClient == nil {
+			if conf.Conf.S3.Endpoint == "" {
+				return nil, errors.New("s3 endpoint is not configured")
+			}
+			if err := initMinioClient(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return newConfiguredS3Storage(minioClient, conf.Conf.S3.Bucket)
+
+	case storageTypeMySQL:
+		db := sqlDB
+		if db == nil {
+			var err error
+			db, err = openMySQL(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewMySQLMessageStorage(db), nil
+
+	case storageTypeLocal, "":
+		return NewLocalMessageStorage(localStorageDir())
+
+	default:
+		return nil, fmt.Errorf("unknown message storage %q", storageType)
+	}
+}
@@ -0,0 +1,260 @@
+package dao
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.orx.me/xbot/internal/conf"
+)
+
+const defaultLocalStorageDir = "data"
+
+// LocalMessageStorage stores messages on the local disk as one append-only
+// JSON lines file per chat. When a message ID appears more than once the last
+// line wins.
+type LocalMessageStorage struct {
+	mu    sync.Mutex
+	dir   string
+	index *messageIndex
+}
+
+// NewLocalMessageStorage creates a new LocalMessageStorage in dir
+func NewLocalMessageStorage(dir string) (*LocalMessageStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &LocalMessageStorage{
+		dir:   dir,
+		index: newMessageIndex(),
+	}, nil
+}
+
+// InitLocal sets up LocalMessageStorage as the default message storage
+func InitLocal() error {
+	dir := localStorageDir()
+	storage, err := NewLocalMessageStorage(dir)
+	if err != nil {
+		return err
+	}
+	defaultMessageStorage = storage
+	log.Printf("LocalMessageStorage initialized in %s and set as default message storage", dir)
+
+	return nil
+}
+
+// localStorageDir returns the configured local storage directory
+func localStorageDir() string {
+	if conf.Conf.LocalStorage.Dir == "" {
+		return defaultLocalStorageDir
+	}
+	return conf.Conf.LocalStorage.Dir
+}
+
+// chatFile returns the path of the file holding the messages of a chat
+func (s *LocalMessageStorage) chatFile(chatID int64) string {
+	return filepath.Join(s.dir, strconv.FormatInt(chatID, 10)+".jsonl")
+}
+
+// SaveMessage appends a message to the chat file
+func (s *LocalMessageStorage) SaveMessage(ctx context.Context, message *Message) error {
+	message.prepare(time.Now())
+
+	line, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	line = append(line, '\n')
+
+	if err := s.appendChat(message.ChatID, line); err != nil {
+		return err
+	}
+	s.index.add(message)
+	return nil
+}
+
+// appendChat appends a line to the file of a chat
+func (s *LocalMessageStorage) appendChat(chatID int64, line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.chatFile(chatID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open chat file: %w", err)
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return f.Close()
+}
+
+// GetMessageByChatID retrieves messages from the last 7 days for a specific chat ID
+func (s *LocalMessageStorage) GetMessageByChatID(ctx context.Context, chatID int64) ([]*Message, error) {
+	page, err := s.QueryMessages(ctx, MessageQuery{
+		ChatID: chatID,
+		Since:  historySince(time.Now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+// QueryMessages retrieves the messages matching the query
+func (s *LocalMessageStorage) QueryMessages(ctx context.Context, query MessageQuery) (*MessagePage, error) {
+	messages, err := s.readChat(query.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	return filterMessages(messages, query)
+}
+
+// DeleteMessages rewrites the chat file without the messages matching the query
+func (s *LocalMessageStorage) DeleteMessages(ctx context.Context, query MessageQuery) (int, error) {
+	cursor, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages, err := s.readChatLocked(query.ChatID)
+	if err != nil {
+		return 0, err
+	}
+
+	kept := make([]*Message, 0, len(messages))
+	for _, m := range messages {
+		if !query.match(m, cursor) {
+			kept = append(kept, m)
+		}
+	}
+	deleted := len(messages) - len(kept)
+	if deleted == 0 {
+		return 0, nil
+	}
+	if err := s.writeChatLocked(query.ChatID, kept); err != nil {
+		return 0, err
+	}
+	s.index.invalidate(query.ChatID)
+	return deleted, nil
+}
+
+// Search searches the messages of a chat with an in-memory inverted index
+func (s *LocalMessageStorage) Search(ctx context.Context, chatID int64, query string, opts SearchOptions) ([]*SearchResult, error) {
+	return s.index.search(ctx, s, chatID, query, opts)
+}
+
+// ListChatIDs returns the IDs of every chat with stored messages
+func (s *LocalMessageStorage) ListChatIDs(ctx context.Context) ([]int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+
+	var chatIDs []int64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".jsonl")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		chatID, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	return chatIDs, nil
+}
+
+// readChat reads every message stored for a chat
+func (s *LocalMessageStorage) readChat(chatID int64) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readChatLocked(chatID)
+}
+
+// readChatLocked reads every message stored for a chat, s.mu must be held
+func (s *LocalMessageStorage) readChatLocked(chatID int64) ([]*Message, error) {
+	f, err := os.Open(s.chatFile(chatID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open chat file: %w", err)
+	}
+	defer f.Close()
+
+	var messages []*Message
+	index := make(map[bson.ObjectID]int)
+	scanner := bufio.NewScanner(f)
+	// Updates can be larger than the default 64KB token size
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var message Message
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return nil, fmt.Errorf("error unmarshaling message from %s: %w", f.Name(), err)
+		}
+		if i, ok := index[message.ID]; ok {
+			messages[i] = &message
+			continue
+		}
+		index[message.ID] = len(messages)
+		messages = append(messages, &message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chat file: %w", err)
+	}
+
+	return messages, nil
+}
+
+// writeChatLocked replaces the chat file with the given messages, s.mu must be held
+func (s *LocalMessageStorage) writeChatLocked(chatID int64, messages []*Message) error {
+	path := s.chatFile(chatID)
+	if len(messages) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove chat file: %w", err)
+		}
+		return nil
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial chat file
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create chat file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, m := range messages {
+		if err := enc.Encode(m); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write message: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write chat file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write chat file: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,342 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/minio/minio-go/v7"
+	"go.orx.me/xbot/internal/conf"
+)
+
+const (
+	mediaStorageS3    = "s3"
+	mediaStorageLocal = "local"
+
+	// mediaKeyPrefix keeps archived files apart from the chat prefixes of the
+	// S3 message storage
+	mediaKeyPrefix = "media"
+)
+
+var (
+	mediaStore MediaStore
+)
+
+// Attachment is a file of a message copied to the media archive
+type Attachment struct {
+	// Kind is the kind of file, e.g. "photo", "voice" or "document"
+	Kind         string `bson:"kind"`
+	FileID       string `bson:"file_id"`
+	FileUniqueID string `bson:"file_unique_id"`
+	// Key is the key of the file in the media archive
+	Key      string `bson:"key"`
+	Size     int64  `bson:"size"`
+	MIMEType string `bson:"mime_type,omitempty" json:",omitempty"`
+	FileName string `bson:"file_name,omitempty" json:",omitempty"`
+}
+
+// MessageFile is a file attached to a Telegram message
+type MessageFile struct {
+	Kind         string
+	FileID       string
+	FileUniqueID string
+	Size         int64
+	MIMEType     string
+	FileName     string
+}
+
+// MessageFiles returns the files of a message worth archiving. Only the
+// largest size of a photo is kept.
+func MessageFiles(message *models.Message) []MessageFile {
+	var files []MessageFile
+	if n := len(message.Photo); n > 0 {
+		// Sizes are sent smallest first
+		p := message.Photo[n-1]
+		files = append(files, MessageFile{"photo", p.FileID, p.FileUniqueID, int64(p.FileSize), "image/jpeg", ""})
+	}
+	if v := message.Voice; v != nil {
+		files = append(files, MessageFile{"voice", v.FileID, v.FileUniqueID, v.FileSize, v.MimeType, ""})
+	}
+	if a := message.Audio; a != nil {
+		files = append(files, MessageFile{"audio", a.FileID, a.FileUniqueID, a.FileSize, a.MimeType, a.FileName})
+	}
+	if d := message.Document; d != nil {
+		files = append(files, MessageFile{"document", d.FileID, d.FileUniqueID, d.FileSize, d.MimeType, d.FileName})
+	}
+	if v := message.Video; v != nil {
+		files = append(files, MessageFile{"video", v.FileID, v.FileUniqueID, v.FileSize, v.MimeType, v.FileName})
+	}
+	if v := message.VideoNote; v != nil {
+		files = append(files, MessageFile{"video_note", v.FileID, v.FileUniqueID, int64(v.FileSize), "video/mp4", ""})
+	}
+	if a := message.Animation; a != nil {
+		files = append(files, MessageFile{"animation", a.FileID, a.FileUniqueID, a.FileSize, a.MimeType, a.FileName})
+	}
+	return files
+}
+
+// Attachment returns the archived copy of a file, nil if it is not archived
+func (m *Message) Attachment(fileUniqueID string) *Attachment {
+	for i := range m.Attachments {
+		if m.Attachments[i].FileUniqueID == fileUniqueID {
+			return &m.Attachments[i]
+		}
+	}
+	return nil
+}
+
+// MediaStore stores archived files by key
+type MediaStore interface {
+	// Put stores a file, size is -1 when unknown
+	Put(ctx context.Context, key string, r io.Reader, size int64, mimeType string) error
+	// Get opens a stored file
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes a stored file, a missing key is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// InitMediaArchive sets up the media store when the archive is enabled
+func InitMediaArchive(ctx context.Context) error {
+	config := conf.Conf.MediaArchive
+	if !config.Enabled {
+		return nil
+	}
+
+	storage := config.Storage
+	if storage == "" {
+		storage = mediaStorageLocal
+		if conf.Conf.S3.Endpoint != "" {
+			storage = mediaStorageS3
+		}
+	}
+
+	switch storage {
+	case mediaStorageS3:
+		if minioClient == nil {
+			if conf.Conf.S3.Endpoint == "" {
+				return errors.New("s3 endpoint is not configured")
+			}
+			if err := initMinioClient(ctx); err != nil {
+				return err
+			}
+		}
+		mediaStore = NewS3MediaStore(minioClient, conf.Conf.S3.Bucket)
+
+	case mediaStorageLocal:
+		dir := config.Dir
+		if dir == "" {
+			dir = filepath.Join(localStorageDir(), mediaKeyPrefix)
+		}
+		store, err := NewLocalMediaStore(dir)
+		if err != nil {
+			return err
+		}
+		mediaStore = store
+
+	default:
+		return fmt.Errorf("unknown media storage %q", storage)
+	}
+
+	log.Printf("Media archive initialized in %s storage", storage)
+	return nil
+}
+
+// GetMediaStore returns the media store, nil when the archive is disabled
+func GetMediaStore() MediaStore {
+	return mediaStore
+}
+
+// MediaKey returns the archive key of a file of a stored message:
+// "media/chatID/year/month/day/<message ID>-<file unique ID><ext>"
+func MediaKey(message *Message, fileUniqueID, ext string) string {
+	created := time.Unix(message.CreatedAt, 0)
+	return fmt.Sprintf("%s/%d/%s/%s-%s%s", mediaKeyPrefix, message.ChatID,
+		created.Format("2006/01/02"), message.ID.Hex(), fileUniqueID, ext)
+}
+
+// S3MediaStore stores archived files in an S3 bucket
+type S3MediaStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3MediaStore creates a media store in the bucket
+func NewS3MediaStore(client *minio.Client, bucket string) *S3MediaStore {
+	return &S3MediaStore{client: client, bucket: bucket}
+}
+
+// Put uploads a file to the bucket
+func (s *S3MediaStore) Put(ctx context.Context, key string, r io.Reader, size int64, mimeType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: mimeType,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return nil
+}
+
+// Get downloads a file from the bucket
+func (s *S3MediaStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	// GetObject is lazy, errors such as a missing key only show on Stat or Read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	return object, nil
+}
+
+// Delete removes a file from the bucket
+func (s *S3MediaStore) Delete(ctx context.Context, key string) error {
+	// S3 reports success for missing keys
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// LocalMediaStore stores archived files in a directory, the key is the path
+type LocalMediaStore struct {
+	dir string
+}
+
+// NewLocalMediaStore creates a media store in dir, creating it if needed
+func NewLocalMediaStore(dir string) (*LocalMediaStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create media directory: %w", err)
+	}
+	return &LocalMediaStore{dir: dir}, nil
+}
+
+// Put writes a file, it only appears under its key once completely written
+func (s *LocalMediaStore) Put(ctx context.Context, key string, r io.Reader, size int64, mimeType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create media directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", key, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return nil
+}
+
+// Get opens a stored file
+func (s *LocalMediaStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	return f, nil
+}
+
+// Delete removes a stored file
+func (s *LocalMediaStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// path returns the file of a key, rejecting keys outside the directory
+func (s *LocalMediaStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid media key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// SetAttachments records archived files on a stored message, replacing
+// attachments of the same file
+func SetAttachments(ctx context.Context, storage MessageStorage, message *Message, attachments []Attachment) error {
+	return updateStored(ctx, storage, message, func(stored *Message) bool {
+		for _, a := range attachments {
+			stored.Attachments = slices.DeleteFunc(stored.Attachments, func(old Attachment) bool {
+				return old.FileUniqueID == a.FileUniqueID
+			})
+			stored.Attachments = append(stored.Attachments, a)
+		}
+		return true
+	})
+}
+
+// DeleteMessages deletes the messages matching the query from the storage
+// together with their archived files
+func DeleteMessages(ctx context.Context, storage MessageStorage, query MessageQuery) (int, error) {
+	keys, err := attachmentKeys(ctx, storage, query)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := storage.DeleteMessages(ctx, query)
+	if err != nil {
+		return deleted, err
+	}
+	// Files go after their messages, a failure leaves files nothing refers to
+	// rather than messages referring to missing files
+	return deleted, deleteMedia(ctx, keys)
+}
+
+// attachmentKeys returns the archive keys of the files of the messages
+// matching the query, none when the archive is disabled
+func attachmentKeys(ctx context.Context, storage MessageStorage, query MessageQuery) ([]string, error) {
+	if mediaStore == nil {
+		return nil, nil
+	}
+	query.Limit = 0
+	query.Cursor = ""
+	page, err := storage.QueryMessages(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, m := range page.Messages {
+		for _, a := range m.Attachments {
+			keys = append(keys, a.Key)
+		}
+	}
+	return keys, nil
+}
+
+// deleteMedia removes files from the media archive
+func deleteMedia(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := mediaStore.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package dao
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.orx.me/xbot/internal/conf"
+)
+
+func TestMediaStores(t *testing.T) {
+	client, _ := newFakeS3(t)
+	local, err := NewLocalMediaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]MediaStore{
+		"S3":    NewS3MediaStore(client, "bucket"),
+		"Local": local,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := "media/100/2025/01/02/abc-unique.ogg"
+			if err := store.Put(ctx, key, strings.NewReader("voice"), 5, "audio/ogg"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			r, err := store.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			body, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || string(body) != "voice" {
+				t.Errorf("Get = %q, %v, want voice", body, err)
+			}
+
+			if r, err := store.Get(ctx, "media/100/missing"); err == nil {
+				r.Close()
+				t.Error("Get of a missing key succeeded")
+			}
+
+			if err := store.Delete(ctx, key); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if r, err := store.Get(ctx, key); err == nil {
+				r.Close()
+				t.Error("Get of a deleted key succeeded")
+			}
+			if err := store.Delete(ctx, key); err != nil {
+				t.Errorf("Delete of a missing key: %v", err)
+			}
+		})
+	}
+
+	if err := local.Put(context.Background(), "../escape", strings.NewReader("x"), 1, ""); err == nil {
+		t.Error("Put outside the media directory succeeded")
+	}
+}
+
+func TestSetAttachments(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryMessageStorage()
+	m := saveAt(t, s, 100, "photo", time.Now().Add(-time.Minute))
+
+	key := MediaKey(m, "unique", ".jpg")
+	if !strings.HasPrefix(key, "media/100/") || !strings.HasSuffix(key, m.ID.Hex()+"-unique.jpg") {
+		t.Errorf("MediaKey = %q", key)
+	}
+
+	first := Attachment{Kind: "photo", FileUniqueID: "unique", Key: key, Size: 1}
+	second := Attachment{Kind: "document", FileUniqueID: "doc", Key: "media/doc", Size: 2}
+	if err := SetAttachments(ctx, s, m, []Attachment{first, second}); err != nil {
+		t.Fatalf("SetAttachments: %v", err)
+	}
+	// Archiving the same file again replaces its attachment
+	first.Size = 3
+	if err := SetAttachments(ctx, s, m, []Attachment{first}); err != nil {
+		t.Fatalf("SetAttachments: %v", err)
+	}
+
+	stored, err := GetMessage(ctx, s, 100, m.ID, m.CreatedAt)
+	if err != nil || stored == nil {
+		t.Fatalf("GetMessage = %v, %v", stored, err)
+	}
+	if got := stored.Attachments; len(got) != 2 || got[0] != second || got[1] != first {
+		t.Errorf("Attachments = %+v", got)
+	}
+}
+
+func TestDeleteMessagesMedia(t *testing.T) {
+	old := conf.Conf.Retention
+	t.Cleanup(func() { conf.Conf.Retention = old })
+	conf.Conf.Retention = conf.RetentionConfig{Days: 30}
+
+	client, fake := newFakeS3(t)
+	t.Cleanup(func() { mediaStore = nil })
+	mediaStore = NewS3MediaStore(client, "bucket")
+
+	ctx := context.Background()
+	s := NewMemoryMessageStorage()
+	now := time.Now()
+	archive := func(m *Message, id string) string {
+		t.Helper()
+		key := MediaKey(m, id, ".jpg")
+		if err := mediaStore.Put(ctx, key, strings.NewReader(id), int64(len(id)), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetAttachments(ctx, s, m, []Attachment{{Kind: "photo", FileUniqueID: id, Key: key}}); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	archive(saveAt(t, s, 100, "old", now.AddDate(0, 0, -40)), "old")
+	newKey := archive(saveAt(t, s, 100, "new", now.AddDate(0, 0, -1)), "new")
+
+	if _, err := PurgeExpired(ctx, s, now); err != nil {
+		t.Fatalf("PurgeExpired: %v", err)
+	}
+	if keys := fake.keys(); !slices.Equal(keys, []string{"bucket/" + newKey}) {
+		t.Errorf("objects after the purge = %v, want the new file only", keys)
+	}
+
+	deleted, err := DeleteMessages(ctx, s, MessageQuery{ChatID: 100, SenderID: 7})
+	if err != nil || deleted != 1 {
+		t.Fatalf("DeleteMessages = %d, %v, want 1", deleted, err)
+	}
+	if keys := fake.keys(); len(keys) != 0 {
+		t.Errorf("objects after deleting the messages = %v, want none", keys)
+	}
+}
@@ -0,0 +1,101 @@
+package dao
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryMessageStorage keeps messages in process memory. Nothing survives a
+// restart, it is meant for tests and local experiments.
+type MemoryMessageStorage struct {
+	mu       sync.RWMutex
+	messages map[int64][]*Message
+}
+
+// NewMemoryMessageStorage creates a new empty MemoryMessageStorage
+func NewMemoryMessageStorage() *MemoryMessageStorage {
+	return &MemoryMessageStorage{
+		messages: make(map[int64][]*Message),
+	}
+}
+
+// SaveMessage stores a copy of the message
+func (s *MemoryMessageStorage) SaveMessage(ctx context.Context, message *Message) error {
+	message.prepare(time.Now())
+
+	stored := *message
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.messages[message.ChatID] {
+		if m.ID == message.ID {
+			s.messages[message.ChatID][i] = &stored
+			return nil
+		}
+	}
+	s.messages[message.ChatID] = append(s.messages[message.ChatID], &stored)
+	return nil
+}
+
+// GetMessageByChatID retrieves messages from the last 7 days for a specific chat ID
+func (s *MemoryMessageStorage) GetMessageByChatID(ctx context.Context, chatID int64) ([]*Message, error) {
+	page, err := s.QueryMessages(ctx, MessageQuery{
+		ChatID: chatID,
+		Since:  historySince(time.Now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+// QueryMessages retrieves the messages matching the query
+func (s *MemoryMessageStorage) QueryMessages(ctx context.Context, query MessageQuery) (*MessagePage, error) {
+	s.mu.RLock()
+	messages := make([]*Message, 0, len(s.messages[query.ChatID]))
+	for _, m := range s.messages[query.ChatID] {
+		copied := *m
+		messages = append(messages, &copied)
+	}
+	s.mu.RUnlock()
+
+	return filterMessages(messages, query)
+}
+
+// DeleteMessages deletes the messages matching the query
+func (s *MemoryMessageStorage) DeleteMessages(ctx context.Context, query MessageQuery) (int, error) {
+	cursor, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.messages[query.ChatID][:0]
+	deleted := 0
+	for _, m := range s.messages[query.ChatID] {
+		if query.match(m, cursor) {
+			deleted++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	s.messages[query.ChatID] = kept
+	return deleted, nil
+}
+
+// ListChatIDs returns the IDs of every chat with stored messages
+func (s *MemoryMessageStorage) ListChatIDs(ctx context.Context) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chatIDs := make([]int64, 0, len(s.messages))
+	for chatID, messages := range s.messages {
+		if len(messages) > 0 {
+			chatIDs = append(chatIDs, chatID)
+		}
+	}
+	return chatIDs, nil
+}
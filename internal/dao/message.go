@@ -5,23 +5,36 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-telegram/bot/models"
 	"github.com/minio/minio-go/v7"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 const (
 	storageTypeMongoDB = "mongodb"
 	storageTypeS3      = "s3"
+	storageTypeLocal   = "local"
+	storageTypeMySQL   = "mysql"
 )
 
 type MessageStorage interface {
+	// SaveMessage stores a message, replacing the stored message with the same ID
 	SaveMessage(ctx context.Context, message *Message) error
+	// GetMessageByChatID returns the messages of the last DefaultHistoryWindow
 	GetMessageByChatID(ctx context.Context, chatID int64) ([]*Message, error)
+	QueryMessages(ctx context.Context, query MessageQuery) (*MessagePage, error)
+	// DeleteMessages deletes the messages matching the query, ignoring Limit
+	DeleteMessages(ctx context.Context, query MessageQuery) (int, error)
+	// ListChatIDs returns the IDs of every chat with stored messages
+	ListChatIDs(ctx context.Context) ([]int64, error)
 }
 
 type Message struct {
@@ -30,6 +43,126 @@ type Message struct {
 	ChatID    int64          `bson:"chat_id"`
 	CreatedAt int64          `bson:"created_at"`
 	UpdatedAt int64          `bson:"updated_at"`
+
+	// MessageID is the Telegram message ID within the chat
+	MessageID int `bson:"message_id,omitempty" json:",omitempty"`
+	// Edited is the latest edit of the message
+	Edited *models.Message `bson:"edited,omitempty" json:",omitempty"`
+	// DeletedAt is set when the message has been deleted in Telegram
+	DeletedAt int64 `bson:"deleted_at,omitempty" json:",omitempty"`
+	// Reactions are the reactions of each user to the message
+	Reactions []Reaction `bson:"reactions,omitempty" json:",omitempty"`
+	// ReactionCounts are the anonymous reactions to a channel post
+	ReactionCounts []ReactionCount `bson:"reaction_counts,omitempty" json:",omitempty"`
+
+	// Embedding is the embedding of the latest text, computed by EmbeddingModel
+	Embedding      []float32 `bson:"embedding,omitempty" json:",omitempty"`
+	EmbeddingModel string    `bson:"embedding_model,omitempty" json:",omitempty"`
+	// Attachments are the files of the message copied to the media archive
+	Attachments []Attachment `bson:"attachments,omitempty" json:",omitempty"`
+
+	// Sealed is the encrypted content of the message when the storage
+	// encrypts messages, the content fields above are empty then
+	Sealed *Sealed `bson:"sealed,omitempty" json:",omitempty"`
+	// FromID is the sender of the message as returned by SenderID, set when
+	// it is saved and kept in the clear when it is sealed so storages filter
+	// the messages of a user on it
+	FromID int64 `bson:"sender_id,omitempty" json:",omitempty"`
+}
+
+// Reaction is a reaction of a user or chat to a message
+type Reaction struct {
+	UserID int64 `bson:"user_id"`
+	// Emoji is the emoji, or the custom emoji ID, of the reaction
+	Emoji string `bson:"emoji"`
+}
+
+// ReactionCount is the number of anonymous reactions with the same emoji
+type ReactionCount struct {
+	Emoji string `bson:"emoji"`
+	Count int    `bson:"count"`
+}
+
+// original returns the message of the stored update, whatever its kind
+func (m *Message) original() *models.Message {
+	if m.Update == nil {
+		return nil
+	}
+	for _, message := range []*models.Message{
+		m.Update.Message,
+		m.Update.ChannelPost,
+		m.Update.BusinessMessage,
+		m.Update.EditedMessage,
+		m.Update.EditedChannelPost,
+		m.Update.EditedBusinessMessage,
+	} {
+		if message != nil {
+			return message
+		}
+	}
+	return nil
+}
+
+// Latest returns the latest version of the Telegram message, nil if the
+// update is not about a message
+func (m *Message) Latest() *models.Message {
+	if m.Edited != nil {
+		return m.Edited
+	}
+	return m.original()
+}
+
+// Text returns the latest text of the message
+func (m *Message) Text() string {
+	if latest := m.Latest(); latest != nil {
+		return latest.Text
+	}
+	return ""
+}
+
+// TelegramMessageID returns the Telegram message ID, also for messages
+// stored before MessageID was recorded
+func (m *Message) TelegramMessageID() int {
+	if m.MessageID != 0 {
+		return m.MessageID
+	}
+	if message := m.original(); message != nil {
+		return message.ID
+	}
+	return 0
+}
+
+// SenderID returns the ID of the user who sent the message, or 0 if unknown
+func (m *Message) SenderID() int64 {
+	message := m.original()
+	if message == nil {
+		return m.FromID
+	}
+	if message.From == nil {
+		return 0
+	}
+	return message.From.ID
+}
+
+// prepare fills in the fields set by every storage before saving a message.
+// CreatedAt is kept when already set so copied messages keep their original time.
+func (m *Message) prepare(now time.Time) {
+	if m.CreatedAt == 0 {
+		m.CreatedAt = now.Unix()
+	}
+	m.UpdatedAt = now.Unix()
+
+	// Handle potential nil values to avoid panic
+	if message := m.original(); message != nil {
+		m.ChatID = message.Chat.ID
+		m.MessageID = message.ID
+	}
+	m.FromID = m.SenderID()
+
+	// Generate a message ID if not exists
+	if m.ID.IsZero() {
+		m.ID = bson.NewObjectID()
+	}
 }
 
 var (
@@ -42,51 +175,209 @@ func GetMessageStorage() MessageStorage {
 
 type MongoDBStorage struct {
 	messagesColl *mongo.Collection
+	// keys encrypts the stored messages, nil stores them in the clear
+	keys *Keyring
 }
 
-func (s *MongoDBStorage) SaveMessage(ctx context.Context, message *Message) error {
-	now := time.Now().Unix()
-	message.CreatedAt = now
-	message.UpdatedAt = now
-	// Handle potential nil values to avoid panic
-	if message.Update != nil && message.Update.Message != nil {
-		message.ChatID = message.Update.Message.Chat.ID
+// newMongoDBStorage creates a MongoDBStorage encrypting messages when a
+// master key is configured
+func newMongoDBStorage(coll *mongo.Collection) (*MongoDBStorage, error) {
+	keys, err := configuredKeyring(&mongoKeyStore{coll: coll.Database().Collection(chatKeysCollection)})
+	if err != nil {
+		return nil, err
 	}
-	result, err := s.messagesColl.InsertOne(ctx, message)
-	if nil != err {
-		return err
+	return &MongoDBStorage{messagesColl: coll, keys: keys}, nil
+}
+
+func (s *MongoDBStorage) SaveMessage(ctx context.Context, message *Message) error {
+	message.prepare(time.Now())
+	doc := message
+	if s.keys != nil {
+		var err error
+		if doc, err = s.keys.seal(ctx, message); err != nil {
+			return err
+		}
 	}
-	message.ID = result.InsertedID.(bson.ObjectID)
-	return nil
+	_, err := s.messagesColl.ReplaceOne(ctx, bson.M{"_id": message.ID}, doc,
+		options.Replace().SetUpsert(true))
+	return err
 }
 
-// GetMessageByChatID retrieves all messages for a specific chat ID
+// GetMessageByChatID retrieves the messages of the last 7 days for a specific chat ID
 func (s *MongoDBStorage) GetMessageByChatID(ctx context.Context, chatID int64) ([]*Message, error) {
-	cursor, err := s.messagesColl.Find(ctx, bson.M{"chat_id": chatID})
+	page, err := s.QueryMessages(ctx, MessageQuery{
+		ChatID: chatID,
+		Since:  historySince(time.Now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+// mongoFilter builds the filter matching every condition of the query except Limit
+func mongoFilter(query MessageQuery, cursor *messageCursor) bson.M {
+	filter := bson.M{"chat_id": query.ChatID}
+	createdAt := bson.M{}
+	if !query.Since.IsZero() {
+		createdAt["$gte"] = query.Since.Unix()
+	}
+	if !query.Until.IsZero() {
+		createdAt["$lt"] = query.Until.Unix()
+	}
+	if len(createdAt) > 0 {
+		filter["created_at"] = createdAt
+	}
+	var and bson.A
+	if query.SenderID != 0 {
+		// Messages stored before sender_id was recorded for every message only
+		// have it in their update
+		legacy := bson.A{}
+		for _, kind := range []string{"message", "channel_post", "business_message",
+			"edited_message", "edited_channel_post", "edited_business_message"} {
+			legacy = append(legacy, bson.M{"update." + kind + ".from.id": query.SenderID})
+		}
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"sender_id": query.SenderID},
+			bson.M{"sender_id": bson.M{"$exists": false}, "$or": legacy},
+		}})
+	}
+	if query.MessageID != 0 {
+		// Messages stored before message_id was recorded only have it in the update
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"message_id": query.MessageID},
+			bson.M{"message_id": bson.M{"$exists": false}, "update.message.message_id": query.MessageID},
+		}})
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	if cursor != nil {
+		filter["$or"] = bson.A{
+			bson.M{"created_at": bson.M{"$lt": cursor.CreatedAt}},
+			bson.M{"created_at": cursor.CreatedAt, "_id": bson.M{"$lt": cursor.ID}},
+		}
+	}
+	return filter
+}
+
+// QueryMessages retrieves the messages matching the query
+func (s *MongoDBStorage) QueryMessages(ctx context.Context, query MessageQuery) (*MessagePage, error) {
+	cursor, err := decodeCursor(query.Cursor)
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(ctx)
+
+	filter := mongoFilter(query, cursor)
+
+	// Read newest first so the limit keeps the most recent messages
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}})
+	if query.Limit > 0 {
+		// Fetch one extra message to know whether there is an older page
+		opts.SetLimit(int64(query.Limit) + 1)
+	}
+
+	result, err := s.messagesColl.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close(ctx)
 
 	var messages []*Message
-	for cursor.Next(ctx) {
+	for result.Next(ctx) {
 		var message Message
-		if err := cursor.Decode(&message); err != nil {
+		if err := result.Decode(&message); err != nil {
 			return nil, err
 		}
+		if s.keys != nil {
+			if err := s.keys.open(ctx, &message); err != nil {
+				return nil, err
+			}
+		}
 		messages = append(messages, &message)
 	}
 
-	if err := cursor.Err(); err != nil {
+	if err := result.Err(); err != nil {
 		return nil, err
 	}
 
-	return messages, nil
+	slices.Reverse(messages)
+	return newMessagePage(messages, query.Limit), nil
+}
+
+// DeleteMessages deletes the messages matching the query
+func (s *MongoDBStorage) DeleteMessages(ctx context.Context, query MessageQuery) (int, error) {
+	cursor, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return 0, err
+	}
+	result, err := s.messagesColl.DeleteMany(ctx, mongoFilter(query, cursor))
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+// Search searches the messages of a chat with the text index of the
+// collection. Sealed messages cannot be indexed, they are scanned instead.
+func (s *MongoDBStorage) Search(ctx context.Context, chatID int64, query string, opts SearchOptions) ([]*SearchResult, error) {
+	if s.keys != nil {
+		return scanSearch(ctx, s, chatID, query, opts)
+	}
+	terms := strings.Fields(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	// Quoted terms must all be present, unquoted ones match any of them
+	for i, term := range terms {
+		terms[i] = `"` + strings.ReplaceAll(term, `"`, "") + `"`
+	}
+
+	filter := mongoFilter(MessageQuery{ChatID: chatID, Since: opts.Since, Until: opts.Until}, nil)
+	filter["$text"] = bson.M{"$search": strings.Join(terms, " ")}
+	filter["deleted_at"] = bson.M{"$exists": false}
+
+	score := bson.M{"$meta": "textScore"}
+	findOpts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "created_at", Value: -1}}).
+		SetLimit(int64(opts.limit()))
+
+	result, err := s.messagesColl.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close(ctx)
+
+	var results []*SearchResult
+	for result.Next(ctx) {
+		var doc struct {
+			Message `bson:",inline"`
+			Score   float64 `bson:"score"`
+		}
+		if err := result.Decode(&doc); err != nil {
+			return nil, err
+		}
+		results = append(results, &SearchResult{Message: &doc.Message, Score: doc.Score})
+	}
+	return results, result.Err()
+}
+
+// ListChatIDs returns the IDs of every chat with stored messages
+func (s *MongoDBStorage) ListChatIDs(ctx context.Context) ([]int64, error) {
+	var chatIDs []int64
+	if err := s.messagesColl.Distinct(ctx, "chat_id", bson.M{}).Decode(&chatIDs); err != nil {
+		return nil, err
+	}
+	return chatIDs, nil
 }
 
 type S3MessageStorage struct {
 	client *minio.Client
 	bucket string
+	index  *messageIndex
+	// keys encrypts the stored messages, nil stores them in the clear
+	keys *Keyring
 }
 
 // NewS3MessageStorage creates a new S3MessageStorage
@@ -94,44 +385,39 @@ func NewS3MessageStorage(client *minio.Client, bucket string) *S3MessageStorage
 	return &S3MessageStorage{
 		client: client,
 		bucket: bucket,
+		index:  newMessageIndex(),
+	}
+}
+
+// newConfiguredS3Storage creates an S3MessageStorage encrypting messages when
+// a master key is configured
+func newConfiguredS3Storage(client *minio.Client, bucket string) (*S3MessageStorage, error) {
+	keys, err := configuredKeyring(&s3KeyStore{client: client, bucket: bucket})
+	if err != nil {
+		return nil, err
 	}
+	s := NewS3MessageStorage(client, bucket)
+	s.keys = keys
+	return s, nil
 }
 
 // generateKey creates a key in the format "chatID/year/month/day/messageID.json"
 func (s *S3MessageStorage) generateKey(chatID int64, messageID string, t time.Time) string {
-	return fmt.Sprintf("%d/%04d/%02d/%02d/%s.json",
-		chatID,
-		t.Year(),
-		t.Month(),
-		t.Day(),
-		messageID)
+	return s.dayPrefix(chatID, t) + messageID + ".json"
 }
 
 // SaveMessage saves a message to S3 storage
 func (s *S3MessageStorage) SaveMessage(ctx context.Context, message *Message) error {
-	// Set the timestamp
-	now := time.Now()
-	message.CreatedAt = now.Unix()
-	message.UpdatedAt = now.Unix()
-
-	// Ensure chat ID is set
-	if message.Update != nil && message.Update.Message != nil {
-		message.ChatID = message.Update.Message.Chat.ID
-	}
-
-	// Generate a message ID if not exists
-	if message.ID.IsZero() {
-		message.ID = bson.NewObjectID()
-	}
+	message.prepare(time.Now())
 
 	// Convert message to JSON
-	messageJSON, err := json.Marshal(message)
+	messageJSON, err := s.marshal(ctx, message)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
 	// Generate key for S3
-	key := s.generateKey(message.ChatID, message.ID.Hex(), now)
+	key := s.generateKey(message.ChatID, message.ID.Hex(), time.Unix(message.CreatedAt, 0))
 
 	// Upload to S3
 	_, err = s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(messageJSON), int64(len(messageJSON)),
@@ -140,67 +426,328 @@ func (s *S3MessageStorage) SaveMessage(ctx context.Context, message *Message) er
 		return fmt.Errorf("failed to store message in S3: %w", err)
 	}
 
+	s.index.add(message)
 	return nil
 }
 
 // GetMessageByChatID retrieves messages from the last 7 days for a specific chat ID
 func (s *S3MessageStorage) GetMessageByChatID(ctx context.Context, chatID int64) ([]*Message, error) {
-	// Get the date range (today and 6 days before)
-	endDate := time.Now()
-	startDate := endDate.AddDate(0, 0, -6) // 7 days including today
+	page, err := s.QueryMessages(ctx, MessageQuery{
+		ChatID: chatID,
+		Since:  historySince(time.Now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+// QueryMessages retrieves the messages matching the query.
+//
+// Objects are keyed by day, so days are read newest first and reading stops
+// after the day that reaches the limit. A day is read whole: within it keys
+// sort by ObjectID, which is not the creation order of imported or copied
+// messages. Compacted days are read from their bundle in a single request.
+func (s *S3MessageStorage) QueryMessages(ctx context.Context, query MessageQuery) (*MessagePage, error) {
+	cursor, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.listKeys(ctx, query, cursor)
+	if err != nil {
+		return nil, err
+	}
 
 	var messages []*Message
+	// One extra message tells whether there is an older page
+	full := func() bool {
+		return query.Limit > 0 && len(messages) > query.Limit
+	}
+
+	days := groupDays(keys)
+	for i := len(days) - 1; i >= 0 && !full(); i-- {
+		day := days[i]
+		if len(day.bundles) > 0 {
+			dayMessages, err := s.readDay(ctx, day)
+			if err != nil {
+				return nil, err
+			}
+			for _, message := range dayMessages {
+				if query.match(message, cursor) {
+					messages = append(messages, message)
+				}
+			}
+			continue
+		}
+
+		for j := len(day.keys) - 1; j >= 0; j-- {
+			message, err := s.getMessage(ctx, day.keys[j])
+			if err != nil {
+				return nil, err
+			}
+			if query.match(message, cursor) {
+				messages = append(messages, message)
+			}
+		}
+	}
+
+	// Sort messages by creation time (oldest first)
+	sortMessages(messages)
+
+	return newMessagePage(messages, query.Limit), nil
+}
+
+// DeleteMessages deletes the messages matching the query. When the query only
+// filters by time, whole days inside the range are deleted by key without
+// reading the messages. Bundles partially matching the query are rewritten.
+func (s *S3MessageStorage) DeleteMessages(ctx context.Context, query MessageQuery) (int, error) {
+	cursor, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := s.listKeys(ctx, query, cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	var toDelete []string
+	for _, day := range groupDays(keys) {
+		if cursor == nil && query.SenderID == 0 && query.MessageID == 0 && s.dayWithin(day.prefix, query) {
+			count, err := s.dayCount(ctx, day)
+			if err != nil {
+				return 0, err
+			}
+			toDelete = append(toDelete, day.keys...)
+			toDelete = append(toDelete, day.bundles...)
+			deleted += count
+			continue
+		}
+
+		for _, key := range day.keys {
+			message, err := s.getMessage(ctx, key)
+			if err != nil {
+				return 0, err
+			}
+			if query.match(message, cursor) {
+				toDelete = append(toDelete, key)
+				deleted++
+			}
+		}
+
+		if len(day.bundles) == 0 {
+			continue
+		}
+		bundled, err := s.readBundles(ctx, day)
+		if err != nil {
+			return 0, err
+		}
+		kept := make([]*Message, 0, len(bundled))
+		for _, message := range bundled {
+			if !query.match(message, cursor) {
+				kept = append(kept, message)
+			}
+		}
+		if len(kept) == len(bundled) {
+			continue
+		}
+		deleted += len(bundled) - len(kept)
+		var key string
+		if len(kept) > 0 {
+			if key, err = s.writeBundle(ctx, day.prefix, kept); err != nil {
+				return 0, err
+			}
+		}
+		// The count in the key changes, but it can match another old bundle
+		for _, bundle := range day.bundles {
+			if bundle != key {
+				toDelete = append(toDelete, bundle)
+			}
+		}
+	}
+
+	if err := s.removeObjects(ctx, toDelete); err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		s.index.invalidate(query.ChatID)
+	}
+	return deleted, nil
+}
+
+// Search searches the messages of a chat with an in-memory inverted index
+func (s *S3MessageStorage) Search(ctx context.Context, chatID int64, query string, opts SearchOptions) ([]*SearchResult, error) {
+	return s.index.search(ctx, s, chatID, query, opts)
+}
+
+// ListChatIDs returns the IDs of every chat with stored messages
+func (s *S3MessageStorage) ListChatIDs(ctx context.Context) ([]int64, error) {
+	var chatIDs []int64
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{})
+	for object := range objects {
+		if object.Err != nil {
+			return nil, fmt.Errorf("error listing objects: %w", object.Err)
+		}
+		chatID, err := strconv.ParseInt(strings.TrimSuffix(object.Key, "/"), 10, 64)
+		if err != nil {
+			// Not a chat prefix
+			continue
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	return chatIDs, nil
+}
 
-	// Iterate through the last 7 days
-	for date := startDate; !date.After(endDate); date = date.AddDate(0, 0, 1) {
-		// Create prefix for this day
-		dayPrefix := fmt.Sprintf("%d/%04d/%02d/%02d/",
-			chatID,
-			date.Year(),
-			date.Month(),
-			date.Day())
+// keyDay returns the day a message key belongs to
+func (s *S3MessageStorage) keyDay(key string) (time.Time, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 5 {
+		return time.Time{}, false
+	}
+	day, err := time.ParseInLocation("2006/01/02", strings.Join(parts[1:4], "/"), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return day, true
+}
 
-		// List objects with this prefix
+// dayWithin reports whether the whole day of a key is inside the query time range
+func (s *S3MessageStorage) dayWithin(key string, query MessageQuery) bool {
+	day, ok := s.keyDay(key)
+	if !ok {
+		return false
+	}
+	if !query.Since.IsZero() && day.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && day.AddDate(0, 0, 1).After(query.Until) {
+		return false
+	}
+	return true
+}
+
+// removeObjects deletes objects in batches
+func (s *S3MessageStorage) removeObjects(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objectsCh)
+		for _, key := range keys {
+			objectsCh <- minio.ObjectInfo{Key: key}
+		}
+	}()
+
+	var firstErr error
+	for removeErr := range s.client.RemoveObjects(ctx, s.bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("error removing object %s: %w", removeErr.ObjectName, removeErr.Err)
+		}
+	}
+	return firstErr
+}
+
+// dayPrefix returns the key prefix of a chat for a given day
+func (s *S3MessageStorage) dayPrefix(chatID int64, t time.Time) string {
+	return fmt.Sprintf("%d/%04d/%02d/%02d/",
+		chatID,
+		t.Year(),
+		t.Month(),
+		t.Day())
+}
+
+// listKeys lists the object keys that may hold messages matching the query,
+// sorted oldest first
+func (s *S3MessageStorage) listKeys(ctx context.Context, query MessageQuery, cursor *messageCursor) ([]string, error) {
+	until := query.Until
+	if cursor != nil {
+		cursorTime := time.Unix(cursor.CreatedAt+1, 0)
+		if until.IsZero() || cursorTime.Before(until) {
+			until = cursorTime
+		}
+	}
+
+	// Without a lower bound every day of the chat has to be listed
+	var prefixes []string
+	if query.Since.IsZero() {
+		prefixes = []string{fmt.Sprintf("%d/", query.ChatID)}
+	} else {
+		end := until
+		if end.IsZero() {
+			end = time.Now()
+		}
+		start := time.Date(query.Since.Year(), query.Since.Month(), query.Since.Day(), 0, 0, 0, 0, query.Since.Location())
+		for date := start; date.Before(end); date = date.AddDate(0, 0, 1) {
+			prefixes = append(prefixes, s.dayPrefix(query.ChatID, date))
+		}
+	}
+
+	var keys []string
+	for _, prefix := range prefixes {
 		objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
-			Prefix:    dayPrefix,
+			Prefix:    prefix,
 			Recursive: true,
 		})
-
-		// Process each object
 		for object := range objects {
 			if object.Err != nil {
 				return nil, fmt.Errorf("error listing objects: %w", object.Err)
 			}
+			keys = append(keys, object.Key)
+		}
+	}
 
-			// Get the object
-			obj, err := s.client.GetObject(ctx, s.bucket, object.Key, minio.GetObjectOptions{})
-			if err != nil {
-				return nil, fmt.Errorf("error getting object %s: %w", object.Key, err)
-			}
+	sort.Strings(keys)
+	return keys, nil
+}
 
-			// Read the object
-			var buffer bytes.Buffer
-			if _, err := buffer.ReadFrom(obj); err != nil {
-				obj.Close()
-				return nil, fmt.Errorf("error reading object %s: %w", object.Key, err)
-			}
-			obj.Close()
+// getMessage reads a single message object
+func (s *S3MessageStorage) getMessage(ctx context.Context, key string) (*Message, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting object %s: %w", key, err)
+	}
+	defer obj.Close()
 
-			// Unmarshal the JSON
-			var message Message
-			if err := json.Unmarshal(buffer.Bytes(), &message); err != nil {
-				return nil, fmt.Errorf("error unmarshaling message from %s: %w", object.Key, err)
-			}
+	// Read the object
+	var buffer bytes.Buffer
+	if _, err := buffer.ReadFrom(obj); err != nil {
+		return nil, fmt.Errorf("error reading object %s: %w", key, err)
+	}
 
-			// Add to messages
-			messages = append(messages, &message)
-		}
+	// Unmarshal the JSON
+	message, err := s.unmarshal(ctx, buffer.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling message from %s: %w", key, err)
 	}
+	return message, nil
+}
 
-	// Sort messages by creation time (oldest first)
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].CreatedAt < messages[j].CreatedAt
-	})
+// marshal encodes a message as stored, sealed when the storage is encrypted
+func (s *S3MessageStorage) marshal(ctx context.Context, message *Message) ([]byte, error) {
+	if s.keys != nil {
+		sealed, err := s.keys.seal(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		message = sealed
+	}
+	return json.Marshal(message)
+}
 
-	return messages, nil
+// unmarshal decodes a stored message, opening it if it is sealed
+func (s *S3MessageStorage) unmarshal(ctx context.Context, data []byte) (*Message, error) {
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	if s.keys != nil {
+		if err := s.keys.open(ctx, &message); err != nil {
+			return nil, err
+		}
+	}
+	return &message, nil
 }
@@ -37,6 +37,23 @@ func InitMinio() error {
 		return nil
 	}
 
+	if err := initMinioClient(context.Background()); err != nil {
+		return err
+	}
+
+	// Create S3MessageStorage instance and set it as the default storage
+	s3Storage, err := newConfiguredS3Storage(minioClient, conf.Conf.S3.Bucket)
+	if err != nil {
+		return err
+	}
+	defaultMessageStorage = s3Storage
+	log.Println("S3MessageStorage initialized and set as default message storage")
+
+	return nil
+}
+
+// initMinioClient creates the MinIO client and makes sure the bucket exists
+func initMinioClient(ctx context.Context) error {
 	// Initialize MinIO client
 	var err error
 	minioClient, err = NewMinioClient()
@@ -45,7 +62,6 @@ func InitMinio() error {
 	}
 
 	// Check if bucket exists and create it if it doesn't
-	ctx := context.Background()
 	exists, err := minioClient.BucketExists(ctx, conf.Conf.S3.Bucket)
 	if err != nil {
 		return fmt.Errorf("failed to check if bucket exists: %w", err)
@@ -60,10 +76,5 @@ func InitMinio() error {
 		log.Printf("Bucket %s created successfully", conf.Conf.S3.Bucket)
 	}
 
-	// Create S3MessageStorage instance and set it as the default storage
-	s3Storage := NewS3MessageStorage(minioClient, conf.Conf.S3.Bucket)
-	defaultMessageStorage = s3Storage
-	log.Println("S3MessageStorage initialized and set as default message storage")
-
 	return nil
 }
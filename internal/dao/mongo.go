@@ -3,22 +3,31 @@ package dao
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	bmongo "butterfly.orx.me/core/store/mongo"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 	"go.orx.me/xbot/internal/conf"
 )
 
+// chatKeysCollection holds the data keys of each chat when messages are encrypted
+const chatKeysCollection = "chat_keys"
+
 var (
 	db           *mongo.Client
 	usersColl    *mongo.Collection
 	promtsColl   *mongo.Collection
 	messagesColl *mongo.Collection
 	pollColl     *mongo.Collection
+	usageColl    *mongo.Collection
 )
 
+// ErrNoMongo is returned by Mongo backed functions when MongoDB is not configured
+var ErrNoMongo = errors.New("mongo is not configured")
+
 type Promt struct {
 	ID        bson.ObjectID `bson:"_id,omitempty"`
 	ChatID    int64         `bson:"chat_id" json:"chat_id"`
@@ -36,11 +45,49 @@ func InitMongo(ctx context.Context) error {
 	promtsColl = db.Database(conf.Conf.DBName).Collection("promts")
 	messagesColl = db.Database(conf.Conf.DBName).Collection("messages")
 	pollColl = db.Database(conf.Conf.DBName).Collection("pulls")
+	usageColl = db.Database(conf.Conf.DBName).Collection("llm_usage")
 
 	return nil
 }
 
+// legacyExpireIndex is the TTL index on expire_at older versions created. It
+// expired messages on the retention of when they were saved, so it is dropped
+// and the retention job purges messages by their creation time instead.
+const legacyExpireIndex = "expire_at_1"
+
+// ensureMessageIndexes creates the indexes of the messages collection, the
+// text index serves Search
+func ensureMessageIndexes(ctx context.Context, coll *mongo.Collection) error {
+	err := coll.Indexes().DropOne(ctx, legacyExpireIndex)
+	var cmdErr mongo.CommandError
+	// 26 and 27 are NamespaceNotFound and IndexNotFound
+	if err != nil && !(errors.As(err, &cmdErr) && (cmdErr.Code == 26 || cmdErr.Code == 27)) {
+		return fmt.Errorf("failed to drop index %s: %w", legacyExpireIndex, err)
+	}
+
+	_, err = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "message_id", Value: 1}}},
+		{
+			Keys: bson.D{
+				{Key: "update.message.text", Value: "text"},
+				{Key: "update.channel_post.text", Value: "text"},
+				{Key: "edited.text", Value: "text"},
+			},
+			// Chats mix languages, so only split on whitespace and punctuation
+			Options: options.Index().SetDefaultLanguage("none"),
+		},
+	})
+	return err
+}
+
 func SavePromt(ctx context.Context, promt Promt) error {
+	if sqlDB != nil {
+		return savePromtSQL(ctx, promt)
+	}
+	if promtsColl == nil {
+		return ErrNoMongo
+	}
 	now := time.Now().Unix()
 	// get
 	_, err := GetPromt(ctx, promt.ChatID)
@@ -65,8 +112,20 @@ func SavePromt(ctx context.Context, promt Promt) error {
 	return err
 }
 
+// GetPromt returns the custom prompt of a chat, with an empty Promt when it
+// has none
 func GetPromt(ctx context.Context, chatID int64) (*Promt, error) {
+	if sqlDB != nil {
+		return getPromtSQL(ctx, chatID)
+	}
 	var promt Promt
+	if promtsColl == nil {
+		return &promt, ErrNoMongo
+	}
 	err := promtsColl.FindOne(ctx, bson.M{"chat_id": chatID}).Decode(&promt)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// The chat has no custom prompt
+		return &promt, nil
+	}
 	return &promt, err
 }
@@ -0,0 +1,253 @@
+package dao
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// UpdateChatID returns the ID of the chat an update belongs to, or 0 if it
+// does not belong to a chat
+func UpdateChatID(update *models.Update) int64 {
+	switch {
+	case update.DeletedBusinessMessages != nil:
+		return update.DeletedBusinessMessages.Chat.ID
+	case update.MessageReaction != nil:
+		return update.MessageReaction.Chat.ID
+	case update.MessageReactionCount != nil:
+		return update.MessageReactionCount.Chat.ID
+	}
+	if message := (&Message{Update: update}).original(); message != nil {
+		return message.Chat.ID
+	}
+	return 0
+}
+
+// ApplyUpdate records an update in the message history and returns the saved
+// message, if there is a single one. New messages are saved, edits, deletions
+// and reactions are applied to the stored message they refer to. Mutations of
+// messages that are not found within the DefaultHistoryWindow are saved as new
+// records for edits and dropped otherwise.
+func ApplyUpdate(ctx context.Context, storage MessageStorage, update *models.Update) (*Message, error) {
+	now := time.Now()
+
+	switch {
+	case update.EditedMessage != nil, update.EditedChannelPost != nil, update.EditedBusinessMessage != nil:
+		edited := (&Message{Update: update}).original()
+		defer lockMessage(edited.Chat.ID, edited.ID)()
+		message, err := findMessage(ctx, storage, edited.Chat.ID, edited.ID, now, true)
+		if err != nil {
+			return nil, err
+		}
+		if message == nil {
+			message = &Message{Update: update}
+		}
+		message.Edited = edited
+		return message, storage.SaveMessage(ctx, message)
+
+	case update.DeletedBusinessMessages != nil:
+		deleted := update.DeletedBusinessMessages
+		for _, messageID := range deleted.MessageIDs {
+			if err := deleteMessage(ctx, storage, deleted.Chat.ID, messageID, now); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+
+	case update.MessageReaction != nil:
+		reaction := update.MessageReaction
+		defer lockMessage(reaction.Chat.ID, reaction.MessageID)()
+		message, err := findMessage(ctx, storage, reaction.Chat.ID, reaction.MessageID, now, true)
+		if err != nil || message == nil {
+			return nil, err
+		}
+		message.Reactions = applyReaction(message.Reactions, reaction)
+		return message, storage.SaveMessage(ctx, message)
+
+	case update.MessageReactionCount != nil:
+		count := update.MessageReactionCount
+		defer lockMessage(count.Chat.ID, count.MessageID)()
+		message, err := findMessage(ctx, storage, count.Chat.ID, count.MessageID, now, true)
+		if err != nil || message == nil {
+			return nil, err
+		}
+		message.ReactionCounts = message.ReactionCounts[:0]
+		for _, r := range count.Reactions {
+			message.ReactionCounts = append(message.ReactionCounts, ReactionCount{
+				Emoji: reactionEmoji(r.Type),
+				Count: r.TotalCount,
+			})
+		}
+		return message, storage.SaveMessage(ctx, message)
+	}
+
+	message := &Message{Update: update}
+	return message, storage.SaveMessage(ctx, message)
+}
+
+// deleteMessage marks a stored message as deleted
+func deleteMessage(ctx context.Context, storage MessageStorage, chatID int64, messageID int, now time.Time) error {
+	defer lockMessage(chatID, messageID)()
+	message, err := findMessage(ctx, storage, chatID, messageID, now, true)
+	if err != nil || message == nil {
+		return err
+	}
+	message.DeletedAt = now.Unix()
+	return storage.SaveMessage(ctx, message)
+}
+
+// messageKey identifies a Telegram message
+type messageKey struct {
+	chatID    int64
+	messageID int
+}
+
+// messageLock is the lock of a message and the number of its holders and waiters
+type messageLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+var (
+	messageLocksMu sync.Mutex
+	messageLocks   = make(map[messageKey]*messageLock)
+)
+
+// lockMessage serializes the changes of a stored message within the process,
+// they read it and save it whole. It returns the unlock function.
+func lockMessage(chatID int64, messageID int) func() {
+	key := messageKey{chatID, messageID}
+	messageLocksMu.Lock()
+	l := messageLocks[key]
+	if l == nil {
+		l = &messageLock{}
+		messageLocks[key] = l
+	}
+	l.refs++
+	messageLocksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		messageLocksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(messageLocks, key)
+		}
+		messageLocksMu.Unlock()
+	}
+}
+
+// findMessage returns the stored message with the Telegram message ID, nil if
+// there is none in the DefaultHistoryWindow. Messages that are saved again
+// are read with their embedding.
+func findMessage(ctx context.Context, storage MessageStorage, chatID int64, messageID int, now time.Time, withEmbeddings bool) (*Message, error) {
+	page, err := storage.QueryMessages(ctx, MessageQuery{
+		ChatID:         chatID,
+		MessageID:      messageID,
+		Since:          historySince(now),
+		Limit:          1,
+		WithEmbeddings: withEmbeddings,
+	})
+	if err != nil || len(page.Messages) == 0 {
+		return nil, err
+	}
+	return page.Messages[0], nil
+}
+
+// FindMessage returns the stored message with the Telegram message ID, nil if
+// there is none in the DefaultHistoryWindow
+func FindMessage(ctx context.Context, storage MessageStorage, chatID int64, messageID int) (*Message, error) {
+	return findMessage(ctx, storage, chatID, messageID, time.Now(), false)
+}
+
+// GetMessage returns the stored message with the ID created at the given
+// unix time, nil if there is none
+func GetMessage(ctx context.Context, storage MessageStorage, chatID int64, id bson.ObjectID, createdAt int64) (*Message, error) {
+	return getStoredMessage(ctx, storage, chatID, id, createdAt, false)
+}
+
+// getStoredMessage is GetMessage, reading the embedding of a message saved again
+func getStoredMessage(ctx context.Context, storage MessageStorage, chatID int64, id bson.ObjectID, createdAt int64, withEmbeddings bool) (*Message, error) {
+	page, err := storage.QueryMessages(ctx, MessageQuery{
+		ChatID:         chatID,
+		Since:          time.Unix(createdAt, 0),
+		Until:          time.Unix(createdAt+1, 0),
+		WithEmbeddings: withEmbeddings,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range page.Messages {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// SetEmbedding stores the embedding of a message. The message is read again
+// first so an edit saved in the meantime is not overwritten.
+func SetEmbedding(ctx context.Context, storage MessageStorage, message *Message, model string, embedding []float32) error {
+	return updateStored(ctx, storage, message, func(stored *Message) bool {
+		if stored.Text() != message.Text() {
+			// The embedding is stale, the newer text gets its own
+			return false
+		}
+		stored.Embedding = embedding
+		stored.EmbeddingModel = model
+		return true
+	})
+}
+
+// updateStored reads a stored message again, applies update and saves it if
+// update reports a change. The message is locked meanwhile, so changes of the
+// message by the process are not overwritten.
+func updateStored(ctx context.Context, storage MessageStorage, message *Message, update func(*Message) bool) error {
+	defer lockMessage(message.ChatID, message.TelegramMessageID())()
+	stored, err := getStoredMessage(ctx, storage, message.ChatID, message.ID, message.CreatedAt, true)
+	if err != nil || stored == nil {
+		return err
+	}
+	if !update(stored) {
+		return nil
+	}
+	return storage.SaveMessage(ctx, stored)
+}
+
+// applyReaction replaces the reactions of the reacting user or chat
+func applyReaction(reactions []Reaction, update *models.MessageReactionUpdated) []Reaction {
+	var userID int64
+	if update.User != nil {
+		userID = update.User.ID
+	} else if update.ActorChat != nil {
+		userID = update.ActorChat.ID
+	}
+
+	kept := make([]Reaction, 0, len(reactions)+len(update.NewReaction))
+	for _, r := range reactions {
+		if r.UserID != userID {
+			kept = append(kept, r)
+		}
+	}
+	for _, r := range update.NewReaction {
+		kept = append(kept, Reaction{UserID: userID, Emoji: reactionEmoji(r)})
+	}
+	return kept
+}
+
+// reactionEmoji returns the emoji of a reaction, the custom emoji ID for
+// custom emoji and "paid" for paid reactions
+func reactionEmoji(r models.ReactionType) string {
+	switch {
+	case r.ReactionTypeEmoji != nil:
+		return r.ReactionTypeEmoji.Emoji
+	case r.ReactionTypeCustomEmoji != nil:
+		return r.ReactionTypeCustomEmoji.CustomEmojiID
+	case r.ReactionTypePaid != nil:
+		return "paid"
+	}
+	return ""
+}
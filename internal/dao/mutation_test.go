@@ -0,0 +1,134 @@
+package dao
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+func TestApplyUpdate(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryMessageStorage()
+
+	post := &models.Update{ID: 1, ChannelPost: &models.Message{ID: 10, Chat: models.Chat{ID: -100}, Text: "post"}}
+	// An edit of a message that was never stored is kept as a new record
+	edit := &models.Update{ID: 2, EditedMessage: &models.Message{ID: 11, Chat: models.Chat{ID: -100}, Text: "unseen"}}
+	deleted := &models.Update{ID: 3, DeletedBusinessMessages: &models.BusinessMessagesDeleted{
+		Chat:       models.Chat{ID: -100},
+		MessageIDs: []int{11},
+	}}
+	count := &models.Update{ID: 4, MessageReactionCount: &models.MessageReactionCountUpdated{
+		Chat:      models.Chat{ID: -100},
+		MessageID: 10,
+		Reactions: []models.ReactionCount{{
+			Type:       models.ReactionType{ReactionTypeEmoji: &models.ReactionTypeEmoji{Emoji: "🔥"}},
+			TotalCount: 3,
+		}},
+	}}
+	for _, update := range []*models.Update{post, edit, deleted, count} {
+		if got := UpdateChatID(update); got != -100 {
+			t.Errorf("UpdateChatID(%d) = %d, want -100", update.ID, got)
+		}
+		if _, err := ApplyUpdate(ctx, s, update); err != nil {
+			t.Fatalf("ApplyUpdate(%d): %v", update.ID, err)
+		}
+	}
+
+	page, err := s.QueryMessages(ctx, MessageQuery{ChatID: -100})
+	if err != nil {
+		t.Fatalf("QueryMessages: %v", err)
+	}
+	assertTexts(t, texts(page.Messages), "post", "unseen")
+	if got := page.Messages[0].ReactionCounts; len(got) != 1 || got[0] != (ReactionCount{Emoji: "🔥", Count: 3}) {
+		t.Errorf("ReactionCounts = %v", got)
+	}
+	if page.Messages[1].DeletedAt == 0 {
+		t.Error("deleted message has no DeletedAt")
+	}
+}
+
+func TestSetEmbedding(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryMessageStorage()
+	m := saveAt(t, s, 100, "hello", time.Now().Add(-time.Minute))
+
+	if err := SetEmbedding(ctx, s, m, "small", []float32{1, 2}); err != nil {
+		t.Fatalf("SetEmbedding: %v", err)
+	}
+	stored, err := GetMessage(ctx, s, 100, m.ID, m.CreatedAt)
+	if err != nil || stored == nil {
+		t.Fatalf("GetMessage = %v, %v", stored, err)
+	}
+	if stored.EmbeddingModel != "small" || len(stored.Embedding) != 2 {
+		t.Errorf("embedding not stored: %q %v", stored.EmbeddingModel, stored.Embedding)
+	}
+
+	// An embedding of text that has been edited since is dropped
+	stored.Edited = &models.Message{ID: stored.MessageID, Chat: models.Chat{ID: 100}, Text: "edited"}
+	if err := s.SaveMessage(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetEmbedding(ctx, s, m, "large", []float32{3}); err != nil {
+		t.Fatalf("SetEmbedding: %v", err)
+	}
+	stored, _ = GetMessage(ctx, s, 100, m.ID, m.CreatedAt)
+	if stored.EmbeddingModel != "small" {
+		t.Errorf("stale embedding stored with model %q", stored.EmbeddingModel)
+	}
+}
+
+// slowStorage widens the time between reading and saving a message
+type slowStorage struct {
+	MessageStorage
+}
+
+func (s slowStorage) QueryMessages(ctx context.Context, query MessageQuery) (*MessagePage, error) {
+	page, err := s.MessageStorage.QueryMessages(ctx, query)
+	time.Sleep(5 * time.Millisecond)
+	return page, err
+}
+
+func TestConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	s := slowStorage{NewMemoryMessageStorage()}
+	m := saveAt(t, s, 100, "hello", time.Now().Add(-time.Minute))
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		if err := SetEmbedding(ctx, s, m, "small", []float32{1, 2}); err != nil {
+			t.Errorf("SetEmbedding: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := SetAttachments(ctx, s, m, []Attachment{{FileUniqueID: "u", Key: "k"}}); err != nil {
+			t.Errorf("SetAttachments: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := ApplyUpdate(ctx, s, &models.Update{MessageReaction: &models.MessageReactionUpdated{
+			Chat:        m.Update.Message.Chat,
+			MessageID:   m.MessageID,
+			User:        &models.User{ID: 8},
+			NewReaction: []models.ReactionType{{ReactionTypeEmoji: &models.ReactionTypeEmoji{Emoji: "👍"}}},
+		}})
+		if err != nil {
+			t.Errorf("ApplyUpdate: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	stored, err := GetMessage(ctx, s, 100, m.ID, m.CreatedAt)
+	if err != nil || stored == nil {
+		t.Fatalf("GetMessage = %v, %v", stored, err)
+	}
+	if len(stored.Embedding) != 2 || len(stored.Attachments) != 1 || len(stored.Reactions) != 1 {
+		t.Errorf("stored message lost a change: %+v", stored)
+	}
+}
@@ -0,0 +1,424 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.orx.me/xbot/internal/conf"
+
+	// mysql driver
+	_ "github.com/go-sql-driver/mysql"
+)
+
+var (
+	sqlDB *sql.DB
+)
+
+// mysqlMigrations are applied in order, the index + 1 is the schema version.
+// Never edit an entry that has been released, append a new one instead.
+var mysqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS messages (
+		id CHAR(24) NOT NULL PRIMARY KEY,
+		chat_id BIGINT NOT NULL,
+		sender_id BIGINT NOT NULL DEFAULT 0,
+		payload LONGTEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		INDEX idx_messages_chat_created (chat_id, created_at, id)
+	) DEFAULT CHARSET=utf8mb4`,
+	`CREATE TABLE IF NOT EXISTS promts (
+		id CHAR(24) NOT NULL PRIMARY KEY,
+		chat_id BIGINT NOT NULL,
+		promt TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		UNIQUE KEY uk_promts_chat (chat_id)
+	) DEFAULT CHARSET=utf8mb4`,
+	`CREATE TABLE IF NOT EXISTS polls (
+		id CHAR(24) NOT NULL PRIMARY KEY,
+		type VARCHAR(64) NOT NULL,
+		date VARCHAR(16) NOT NULL,
+		chat_id BIGINT NOT NULL,
+		message_id BIGINT NOT NULL,
+		poll_id VARCHAR(128) NOT NULL,
+		poll LONGTEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		INDEX idx_polls_type_date (type, date),
+		INDEX idx_polls_poll_id (poll_id)
+	) DEFAULT CHARSET=utf8mb4`,
+	`ALTER TABLE messages
+		ADD COLUMN message_id BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN mutations LONGTEXT NULL,
+		ADD INDEX idx_messages_chat_message (chat_id, message_id)`,
+	`UPDATE messages SET message_id = COALESCE(
+		JSON_EXTRACT(payload, '$.message.message_id'),
+		JSON_EXTRACT(payload, '$.channel_post.message_id'), 0)
+		WHERE message_id = 0`,
+	`CREATE TABLE IF NOT EXISTS llm_usage (
+		id CHAR(24) NOT NULL PRIMARY KEY,
+		chat_id BIGINT NOT NULL,
+		user_id BIGINT NOT NULL,
+		task VARCHAR(32) NOT NULL,
+		model VARCHAR(255) NOT NULL,
+		prompt_tokens INT NOT NULL,
+		completion_tokens INT NOT NULL,
+		images INT NOT NULL,
+		latency_ms BIGINT NOT NULL,
+		cost DOUBLE NOT NULL,
+		error TEXT NULL,
+		created_at BIGINT NOT NULL,
+		INDEX idx_llm_usage_chat_created (chat_id, created_at),
+		INDEX idx_llm_usage_user_created (user_id, created_at)
+	) DEFAULT CHARSET=utf8mb4`,
+}
+
+// messageMutations are the fields of a Message changed by later updates,
+// stored as JSON in the mutations column
+type messageMutations struct {
+	Edited         *models.Message `json:"edited,omitempty"`
+	DeletedAt      int64           `json:"deleted_at,omitempty"`
+	Reactions      []Reaction      `json:"reactions,omitempty"`
+	ReactionCounts []ReactionCount `json:"reaction_counts,omitempty"`
+	Embedding      []float32       `json:"embedding,omitempty"`
+	EmbeddingModel string          `json:"embedding_model,omitempty"`
+	Attachments    []Attachment    `json:"attachments,omitempty"`
+}
+
+// InitMySQL connects to MySQL, applies the schema migrations and sets up
+// MySQLMessageStorage. Prompts, polls and model usage are stored in MySQL as
+// well.
+func InitMySQL(ctx context.Context) error {
+	db, err := openMySQL(ctx)
+	if err != nil {
+		return err
+	}
+
+	sqlDB = db
+	defaultMessageStorage = NewMySQLMessageStorage(db)
+	log.Println("MySQLMessageStorage initialized and set as default message storage")
+
+	return nil
+}
+
+// openMySQL connects to the configured MySQL and applies the schema migrations
+func openMySQL(ctx context.Context) (*sql.DB, error) {
+	if conf.Conf.MySQL.DSN == "" {
+		return nil, errors.New("mysql dsn is not configured")
+	}
+
+	db, err := sql.Open("mysql", conf.Conf.MySQL.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mysql: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to mysql: %w", err)
+	}
+	if err := migrateMySQL(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateMySQL applies the migrations that have not been applied yet
+func migrateMySQL(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT NOT NULL PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := current; i < len(mysqlMigrations); i++ {
+		version := i + 1
+		log.Printf("Applying mysql migration %d...", version)
+		if _, err := db.ExecContext(ctx, mysqlMigrations[i]); err != nil {
+			return fmt.Errorf("failed to apply mysql migration %d: %w", version, err)
+		}
+		_, err := db.ExecContext(ctx, "INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)",
+			version, time.Now().Unix())
+		if err != nil {
+			return fmt.Errorf("failed to record mysql migration %d: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// MySQLMessageStorage stores messages in a MySQL table
+type MySQLMessageStorage struct {
+	db *sql.DB
+}
+
+// NewMySQLMessageStorage creates a new MySQLMessageStorage
+func NewMySQLMessageStorage(db *sql.DB) *MySQLMessageStorage {
+	return &MySQLMessageStorage{
+		db: db,
+	}
+}
+
+// SaveMessage inserts or replaces a message in the messages table
+func (s *MySQLMessageStorage) SaveMessage(ctx context.Context, message *Message) error {
+	message.prepare(time.Now())
+
+	payload, err := json.Marshal(message.Update)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	mutations, err := json.Marshal(messageMutations{
+		Edited:         message.Edited,
+		DeletedAt:      message.DeletedAt,
+		Reactions:      message.Reactions,
+		ReactionCounts: message.ReactionCounts,
+		Embedding:      message.Embedding,
+		EmbeddingModel: message.EmbeddingModel,
+		Attachments:    message.Attachments,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal message mutations: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO messages (id, chat_id, sender_id, message_id, payload, mutations, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE chat_id = VALUES(chat_id), sender_id = VALUES(sender_id), message_id = VALUES(message_id),
+		payload = VALUES(payload), mutations = VALUES(mutations), created_at = VALUES(created_at), updated_at = VALUES(updated_at)`,
+		message.ID.Hex(), message.ChatID, message.SenderID(), message.MessageID, string(payload), string(mutations),
+		message.CreatedAt, message.UpdatedAt)
+	return err
+}
+
+// GetMessageByChatID retrieves messages from the last 7 days for a specific chat ID
+func (s *MySQLMessageStorage) GetMessageByChatID(ctx context.Context, chatID int64) ([]*Message, error) {
+	page, err := s.QueryMessages(ctx, MessageQuery{
+		ChatID: chatID,
+		Since:  historySince(time.Now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+// QueryMessages retrieves the messages matching the query
+func (s *MySQLMessageStorage) QueryMessages(ctx context.Context, query MessageQuery) (*MessagePage, error) {
+	cursor, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	conds, args := mysqlConds(query, cursor)
+
+	// Read newest first so the limit keeps the most recent messages
+	stmt := "SELECT id, chat_id, message_id, payload, mutations, created_at, updated_at FROM messages WHERE " +
+		strings.Join(conds, " AND ") + " ORDER BY created_at DESC, id DESC"
+	if query.Limit > 0 {
+		// Fetch one extra message to know whether there is an older page
+		stmt += " LIMIT ?"
+		args = append(args, query.Limit+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortMessages(messages)
+	return newMessagePage(messages, query.Limit), nil
+}
+
+// mysqlConds builds the WHERE conditions matching every condition of the query except Limit
+func mysqlConds(query MessageQuery, cursor *messageCursor) ([]string, []any) {
+	conds := []string{"chat_id = ?"}
+	args := []any{query.ChatID}
+	if !query.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, query.Since.Unix())
+	}
+	if !query.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, query.Until.Unix())
+	}
+	if query.SenderID != 0 {
+		conds = append(conds, "sender_id = ?")
+		args = append(args, query.SenderID)
+	}
+	if query.MessageID != 0 {
+		conds = append(conds, "message_id = ?")
+		args = append(args, query.MessageID)
+	}
+	if cursor != nil {
+		conds = append(conds, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, cursor.CreatedAt, cursor.CreatedAt, cursor.ID.Hex())
+	}
+	return conds, args
+}
+
+// DeleteMessages deletes the messages matching the query
+func (s *MySQLMessageStorage) DeleteMessages(ctx context.Context, query MessageQuery) (int, error) {
+	cursor, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return 0, err
+	}
+	conds, args := mysqlConds(query, cursor)
+	result, err := s.db.ExecContext(ctx, "DELETE FROM messages WHERE "+strings.Join(conds, " AND "), args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+// ListChatIDs returns the IDs of every chat with stored messages
+func (s *MySQLMessageStorage) ListChatIDs(ctx context.Context) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT chat_id FROM messages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chatIDs []int64
+	for rows.Next() {
+		var chatID int64
+		if err := rows.Scan(&chatID); err != nil {
+			return nil, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	return chatIDs, rows.Err()
+}
+
+func scanMessage(rows *sql.Rows) (*Message, error) {
+	var (
+		message   Message
+		id        string
+		payload   string
+		mutations sql.NullString
+	)
+	err := rows.Scan(&id, &message.ChatID, &message.MessageID, &payload, &mutations, &message.CreatedAt, &message.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	oid, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message id %s: %w", id, err)
+	}
+	message.ID = oid
+	if err := json.Unmarshal([]byte(payload), &message.Update); err != nil {
+		return nil, fmt.Errorf("error unmarshaling message %s: %w", id, err)
+	}
+	if mutations.Valid && mutations.String != "" {
+		var m messageMutations
+		if err := json.Unmarshal([]byte(mutations.String), &m); err != nil {
+			return nil, fmt.Errorf("error unmarshaling mutations of message %s: %w", id, err)
+		}
+		message.Edited = m.Edited
+		message.DeletedAt = m.DeletedAt
+		message.Reactions = m.Reactions
+		message.ReactionCounts = m.ReactionCounts
+		message.Embedding = m.Embedding
+		message.EmbeddingModel = m.EmbeddingModel
+		message.Attachments = m.Attachments
+	}
+	return &message, nil
+}
+
+func savePromtSQL(ctx context.Context, promt Promt) error {
+	now := time.Now().Unix()
+	_, err := sqlDB.ExecContext(ctx,
+		`INSERT INTO promts (id, chat_id, promt, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE promt = VALUES(promt), updated_at = VALUES(updated_at)`,
+		bson.NewObjectID().Hex(), promt.ChatID, promt.Promt, now, now)
+	return err
+}
+
+func getPromtSQL(ctx context.Context, chatID int64) (*Promt, error) {
+	var (
+		promt Promt
+		id    string
+	)
+	err := sqlDB.QueryRowContext(ctx,
+		"SELECT id, chat_id, promt, created_at, updated_at FROM promts WHERE chat_id = ?", chatID).
+		Scan(&id, &promt.ChatID, &promt.Promt, &promt.CreatedAt, &promt.UpdatedAt)
+	if err != nil {
+		// A chat without a prompt uses the default one
+		if errors.Is(err, sql.ErrNoRows) {
+			return &promt, nil
+		}
+		return &promt, err
+	}
+	promt.ID, _ = bson.ObjectIDFromHex(id)
+	return &promt, nil
+}
+
+func savePollSQL(ctx context.Context, poll Poll) error {
+	now := time.Now().Unix()
+	if poll.ID.IsZero() {
+		poll.ID = bson.NewObjectID()
+	}
+	payload, err := json.Marshal(poll.Poll)
+	if err != nil {
+		return fmt.Errorf("failed to marshal poll: %w", err)
+	}
+	_, err = sqlDB.ExecContext(ctx,
+		`INSERT INTO polls (id, type, date, chat_id, message_id, poll_id, poll, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		poll.ID.Hex(), poll.Type, poll.Date, poll.ChatID, poll.MessageID, poll.PollID, string(payload), now, now)
+	return err
+}
+
+// getPollSQL returns the first poll matching the condition, or nil if none
+func getPollSQL(ctx context.Context, cond string, args ...any) (*Poll, error) {
+	var (
+		poll    Poll
+		id      string
+		payload string
+	)
+	err := sqlDB.QueryRowContext(ctx,
+		"SELECT id, type, date, chat_id, message_id, poll_id, poll, created_at, updated_at FROM polls WHERE "+
+			cond+" LIMIT 1", args...).
+		Scan(&id, &poll.Type, &poll.Date, &poll.ChatID, &poll.MessageID, &poll.PollID, &payload,
+			&poll.CreatedAt, &poll.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	poll.ID, _ = bson.ObjectIDFromHex(id)
+	poll.Poll = new(models.Poll)
+	if err := json.Unmarshal([]byte(payload), poll.Poll); err != nil {
+		return nil, fmt.Errorf("error unmarshaling poll %s: %w", id, err)
+	}
+	return &poll, nil
+}
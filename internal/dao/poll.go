@@ -22,6 +22,12 @@ type Poll struct {
 }
 
 func SavePoll(ctx context.Context, Poll Poll) error {
+	if sqlDB != nil {
+		return savePollSQL(ctx, Poll)
+	}
+	if pollColl == nil {
+		return ErrNoMongo
+	}
 	now := time.Now().Unix()
 	Poll.CreatedAt = now
 	Poll.UpdatedAt = now
@@ -34,6 +40,13 @@ func SavePoll(ctx context.Context, Poll Poll) error {
 }
 
 func GetPollByTypeAndDate(ctx context.Context, PollType string, date string) (*Poll, bool, error) {
+	if sqlDB != nil {
+		poll, err := getPollSQL(ctx, "type = ? AND date = ?", PollType, date)
+		return poll, poll != nil, err
+	}
+	if pollColl == nil {
+		return nil, false, ErrNoMongo
+	}
 	var Poll Poll
 	err := pollColl.FindOne(ctx, bson.M{"type": PollType, "date": date}).Decode(&Poll)
 	if err != nil {
@@ -46,7 +59,12 @@ func GetPollByTypeAndDate(ctx context.Context, PollType string, date string) (*P
 }
 
 func GetPollByID(ctx context.Context, pollID string) (*Poll, error) {
-
+	if sqlDB != nil {
+		return getPollSQL(ctx, "poll_id = ?", pollID)
+	}
+	if pollColl == nil {
+		return nil, ErrNoMongo
+	}
 	var poll Poll
 	err := pollColl.FindOne(ctx, bson.M{"poll_id": pollID}).Decode(&poll)
 	if err != nil {
@@ -0,0 +1,156 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// DefaultHistoryWindow is the time window used by GetMessageByChatID
+const DefaultHistoryWindow = 7 * 24 * time.Hour
+
+// ErrInvalidCursor is returned when a query cursor cannot be decoded
+var ErrInvalidCursor = errors.New("invalid message cursor")
+
+// MessageQuery describes which messages to read from a MessageStorage.
+//
+// Matching messages are always returned oldest first. When Limit is set only
+// the most recent Limit messages are returned, and MessagePage.NextCursor can
+// be passed back as Cursor to fetch the page of older messages before them.
+type MessageQuery struct {
+	ChatID int64
+	// Since is inclusive, zero means no lower bound
+	Since time.Time
+	// Until is exclusive, zero means no upper bound
+	Until time.Time
+	// Limit is the maximum number of messages to return, zero means no limit
+	Limit int
+	// Cursor is the NextCursor of a previous page
+	Cursor string
+	// SenderID only returns messages sent by this user when non-zero
+	SenderID int64
+	// MessageID only returns the message with this Telegram message ID when non-zero
+	MessageID int
+	// WithEmbeddings reads the messages with their embeddings, which the
+	// history cache does not hold. Messages read to be saved again need it.
+	WithEmbeddings bool
+}
+
+// MessagePage is the result of a MessageQuery
+type MessagePage struct {
+	Messages   []*Message
+	NextCursor string
+}
+
+// messageCursor points at the oldest message of a page
+type messageCursor struct {
+	CreatedAt int64
+	ID        bson.ObjectID
+}
+
+func encodeCursor(m *Message) string {
+	return fmt.Sprintf("%d:%s", m.CreatedAt, m.ID.Hex())
+}
+
+func decodeCursor(s string) (*messageCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	createdAt, id, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	ts, err := strconv.ParseInt(createdAt, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	oid, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &messageCursor{CreatedAt: ts, ID: oid}, nil
+}
+
+// before reports whether m sorts strictly before the cursor
+func (c *messageCursor) before(m *Message) bool {
+	if m.CreatedAt != c.CreatedAt {
+		return m.CreatedAt < c.CreatedAt
+	}
+	return m.ID.Hex() < c.ID.Hex()
+}
+
+// lessMessage orders messages by creation time, then by ID
+func lessMessage(a, b *Message) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt < b.CreatedAt
+	}
+	return a.ID.Hex() < b.ID.Hex()
+}
+
+// sortMessages sorts messages oldest first
+func sortMessages(messages []*Message) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return lessMessage(messages[i], messages[j])
+	})
+}
+
+// match reports whether m satisfies every filter of the query except Limit
+func (q MessageQuery) match(m *Message, cursor *messageCursor) bool {
+	if m.ChatID != q.ChatID {
+		return false
+	}
+	if !q.Since.IsZero() && m.CreatedAt < q.Since.Unix() {
+		return false
+	}
+	if !q.Until.IsZero() && m.CreatedAt >= q.Until.Unix() {
+		return false
+	}
+	if q.SenderID != 0 && m.SenderID() != q.SenderID {
+		return false
+	}
+	if q.MessageID != 0 && m.TelegramMessageID() != q.MessageID {
+		return false
+	}
+	if cursor != nil && !cursor.before(m) {
+		return false
+	}
+	return true
+}
+
+// filterMessages applies the query to an arbitrary set of messages. It is used
+// by storages that cannot filter on the server side.
+func filterMessages(messages []*Message, q MessageQuery) (*MessagePage, error) {
+	cursor, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make([]*Message, 0, len(messages))
+	for _, m := range messages {
+		if q.match(m, cursor) {
+			matched = append(matched, m)
+		}
+	}
+	sortMessages(matched)
+	return newMessagePage(matched, q.Limit), nil
+}
+
+// newMessagePage keeps the most recent limit messages of a sorted slice
+func newMessagePage(messages []*Message, limit int) *MessagePage {
+	page := &MessagePage{Messages: messages}
+	if limit > 0 && len(messages) > limit {
+		page.Messages = messages[len(messages)-limit:]
+		page.NextCursor = encodeCursor(page.Messages[0])
+	}
+	return page
+}
+
+// historySince returns the start of the default history window
+func historySince(now time.Time) time.Time {
+	return now.Add(-DefaultHistoryWindow)
+}
@@ -0,0 +1,104 @@
+package dao
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.orx.me/xbot/internal/conf"
+)
+
+// retentionInterval is how often expired messages are purged
+const retentionInterval = time.Hour
+
+// retentionPolicy is the retention applied to the messages of a chat
+type retentionPolicy struct {
+	// days messages are kept, 0 keeps them forever
+	days    int
+	noStore bool
+}
+
+// retentionFor returns the retention policy of a chat
+func retentionFor(chatID int64) retentionPolicy {
+	for _, c := range conf.Conf.Retention.Chats {
+		if c.ChatID == chatID {
+			return retentionPolicy{days: c.Days, noStore: c.NoStore}
+		}
+	}
+	return retentionPolicy{days: conf.Conf.Retention.Days}
+}
+
+// cutoff returns the time before which messages are expired, zero if they never expire
+func (p retentionPolicy) cutoff(now time.Time) time.Time {
+	if p.noStore {
+		return now
+	}
+	if p.days <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, -p.days)
+}
+
+// RetentionCutoff returns the time before which messages of the chat are
+// expired, zero if they are kept forever
+func RetentionCutoff(chatID int64, now time.Time) time.Time {
+	return retentionFor(chatID).cutoff(now)
+}
+
+// ShouldStoreMessages reports whether messages of the chat may be stored
+func ShouldStoreMessages(chatID int64) bool {
+	return !retentionFor(chatID).noStore
+}
+
+// retentionEnabled reports whether any retention is configured
+func retentionEnabled() bool {
+	return conf.Conf.Retention.Days > 0 || len(conf.Conf.Retention.Chats) > 0
+}
+
+// PurgeExpired deletes the messages older than the retention of their chat
+// and their archived files
+func PurgeExpired(ctx context.Context, storage MessageStorage, now time.Time) (int, error) {
+	chatIDs, err := storage.ListChatIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, chatID := range chatIDs {
+		cutoff := retentionFor(chatID).cutoff(now)
+		if cutoff.IsZero() {
+			continue
+		}
+		n, err := DeleteMessages(ctx, storage, MessageQuery{
+			ChatID: chatID,
+			Until:  cutoff,
+		})
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// runRetention purges expired messages of the default storage every
+// retentionInterval until ctx is done
+func runRetention(ctx context.Context) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := PurgeExpired(ctx, defaultMessageStorage, time.Now())
+		if err != nil {
+			log.Printf("Failed to purge expired messages: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d expired messages", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
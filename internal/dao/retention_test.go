@@ -0,0 +1,43 @@
+package dao
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.orx.me/xbot/internal/conf"
+)
+
+func TestPurgeExpired(t *testing.T) {
+	old := conf.Conf.Retention
+	t.Cleanup(func() { conf.Conf.Retention = old })
+	conf.Conf.Retention = conf.RetentionConfig{
+		Days: 30,
+		Chats: []conf.ChatRetention{
+			{ChatID: 200, Days: 0},
+			{ChatID: 300, NoStore: true},
+		},
+	}
+
+	s := NewMemoryMessageStorage()
+	now := time.Now()
+	for _, chatID := range []int64{100, 200, 300} {
+		saveAt(t, s, chatID, "old", now.AddDate(0, 0, -40))
+		saveAt(t, s, chatID, "new", now.AddDate(0, 0, -1))
+	}
+
+	purged, err := PurgeExpired(context.Background(), s, now)
+	if err != nil {
+		t.Fatalf("PurgeExpired: %v", err)
+	}
+	if purged != 3 {
+		t.Errorf("purged = %d, want 3", purged)
+	}
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100}), "new")
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 200}), "old", "new")
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 300}))
+
+	if ShouldStoreMessages(300) || !ShouldStoreMessages(100) {
+		t.Error("ShouldStoreMessages does not follow the chat policy")
+	}
+}
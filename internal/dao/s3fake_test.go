@@ -0,0 +1,281 @@
+package dao
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// fakeS3 is a minimal in-memory S3 server supporting the object operations
+// used by the dao package, with path style addressing
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests atomic.Int64
+}
+
+// newFakeS3 starts a fake S3 server and returns a client connected to it
+func newFakeS3(t *testing.T) (*minio.Client, *fakeS3) {
+	t.Helper()
+
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewTLSServer(fake)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4("access", "secret", ""),
+		Secure:       true,
+		Transport:    srv.Client().Transport,
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, fake
+}
+
+// keys returns every stored object key, sorted
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// find returns the keys of the objects containing text, reading gzip
+// compressed objects uncompressed
+func (f *fakeS3) find(text string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k, body := range f.objects {
+		if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if data, err := io.ReadAll(zr); err == nil {
+				body = data
+			}
+		}
+		if bytes.Contains(body, []byte(text)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.list(w, bucket, query.Get("prefix"), query.Get("delimiter"))
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		f.deleteMany(w, r, bucket)
+	case key == "":
+		// Bucket level requests such as BucketExists or MakeBucket
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut:
+		f.put(w, r, bucket+"/"+key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.get(w, r, bucket+"/"+key)
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, bucket+"/"+key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) put(w http.ResponseWriter, r *http.Request, path string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body, err = decodeAWSChunked(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	f.mu.Lock()
+	if _, ok := f.objects[path]; ok && r.Header.Get("If-None-Match") == "*" {
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, `<Error><Code>PreconditionFailed</Code><Message>exists</Message><Key>%s</Key></Error>`, path)
+		return
+	}
+	f.objects[path] = body
+	f.mu.Unlock()
+
+	w.Header().Set("ETag", etag(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, path string) {
+	f.mu.Lock()
+	body, ok := f.objects[path]
+	f.mu.Unlock()
+	if !ok {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == http.MethodGet {
+			fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message><Key>%s</Key></Error>`, path)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", etag(body))
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+type fakeListResult struct {
+	XMLName        xml.Name           `xml:"ListBucketResult"`
+	Name           string             `xml:"Name"`
+	Prefix         string             `xml:"Prefix"`
+	KeyCount       int                `xml:"KeyCount"`
+	MaxKeys        int                `xml:"MaxKeys"`
+	IsTruncated    bool               `xml:"IsTruncated"`
+	Contents       []fakeListContent  `xml:"Contents"`
+	CommonPrefixes []fakeCommonPrefix `xml:"CommonPrefixes"`
+}
+
+type fakeCommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type fakeListContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix, delimiter string) {
+	result := fakeListResult{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+	seen := make(map[string]bool)
+	for _, path := range f.keys() {
+		key, ok := strings.CutPrefix(path, bucket+"/")
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, fakeCommonPrefix{Prefix: common})
+				}
+				continue
+			}
+		}
+		f.mu.Lock()
+		body := f.objects[path]
+		f.mu.Unlock()
+		result.Contents = append(result.Contents, fakeListContent{
+			Key:          key,
+			LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         etag(body),
+			Size:         len(body),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) deleteMany(w http.ResponseWriter, r *http.Request, bucket string) {
+	var req struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	for _, o := range req.Objects {
+		delete(f.objects, bucket+"/"+o.Key)
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, `<DeleteResult></DeleteResult>`)
+}
+
+func etag(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// decodeAWSChunked strips the aws-chunked framing of a streaming upload
+func decodeAWSChunked(body []byte) ([]byte, error) {
+	var out bytes.Buffer
+	r := bufio.NewReader(bytes.NewReader(body))
+	for {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return out.Bytes(), nil
+		}
+		if _, err := io.CopyN(&out, r, size); err != nil {
+			return nil, err
+		}
+		// Skip the CRLF after the chunk data
+		if _, err := r.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package dao
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	// defaultSearchLimit is the number of results returned when no limit is set
+	defaultSearchLimit = 10
+	// searchIndexChats is the number of chats kept in a messageIndex
+	searchIndexChats = 100
+	// searchIndexBatch is the page size used to build the index of a chat
+	searchIndexBatch = 1000
+)
+
+// SearchOptions narrows a full-text search
+type SearchOptions struct {
+	// Limit is the maximum number of results, zero uses the default
+	Limit int
+	// Since is inclusive, zero means no lower bound
+	Since time.Time
+	// Until is exclusive, zero means no upper bound
+	Until time.Time
+}
+
+func (o SearchOptions) limit() int {
+	if o.Limit <= 0 {
+		return defaultSearchLimit
+	}
+	return o.Limit
+}
+
+// SearchResult is a message matching a search, best matches have higher scores
+type SearchResult struct {
+	Message *Message
+	Score   float64
+}
+
+// MessageSearcher is implemented by message storages with full-text search
+type MessageSearcher interface {
+	// Search returns the messages of a chat containing every term of the query,
+	// best matches first
+	Search(ctx context.Context, chatID int64, query string, opts SearchOptions) ([]*SearchResult, error)
+}
+
+// Search runs a full-text search on the storage. Storages without a search
+// index are scanned.
+func Search(ctx context.Context, storage MessageStorage, chatID int64, query string, opts SearchOptions) ([]*SearchResult, error) {
+	if searcher, ok := storage.(MessageSearcher); ok {
+		return searcher.Search(ctx, chatID, query, opts)
+	}
+	return scanSearch(ctx, storage, chatID, query, opts)
+}
+
+// scanSearch searches the messages of a chat by reading all of them
+func scanSearch(ctx context.Context, storage MessageStorage, chatID int64, query string, opts SearchOptions) ([]*SearchResult, error) {
+	page, err := storage.QueryMessages(ctx, MessageQuery{ChatID: chatID, Since: opts.Since, Until: opts.Until})
+	if err != nil {
+		return nil, err
+	}
+	index := newChatIndex(chatID)
+	for _, m := range page.Messages {
+		index.add(m)
+	}
+	return index.search(query, opts), nil
+}
+
+// tokenize splits text into lower case search terms. Runs of CJK characters,
+// which are not separated by spaces, are split into overlapping bigrams.
+func tokenize(text string) []string {
+	var (
+		terms []string
+		word  []rune
+		cjk   []rune
+	)
+	flushWord := func() {
+		if len(word) > 0 {
+			terms = append(terms, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		switch len(cjk) {
+		case 0:
+		case 1:
+			terms = append(terms, string(cjk))
+		default:
+			for i := 0; i+1 < len(cjk); i++ {
+				terms = append(terms, string(cjk[i:i+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, unicode.ToLower(r))
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return terms
+}
+
+// chatIndex is the inverted index of the messages of a chat
+type chatIndex struct {
+	chatID int64
+	// postings maps each term to the number of times it appears in each message
+	postings map[string]map[bson.ObjectID]int
+	docs     map[bson.ObjectID]*indexedMessage
+}
+
+type indexedMessage struct {
+	message *Message
+	terms   []string
+}
+
+func newChatIndex(chatID int64) *chatIndex {
+	return &chatIndex{
+		chatID:   chatID,
+		postings: make(map[string]map[bson.ObjectID]int),
+		docs:     make(map[bson.ObjectID]*indexedMessage),
+	}
+}
+
+// add indexes the latest text of a message, replacing its previous version
+func (c *chatIndex) add(m *Message) {
+	c.remove(m.ID)
+	if m.DeletedAt != 0 {
+		return
+	}
+	terms := tokenize(m.Text())
+	if len(terms) == 0 {
+		return
+	}
+
+	c.docs[m.ID] = &indexedMessage{message: m, terms: terms}
+	for _, term := range terms {
+		if c.postings[term] == nil {
+			c.postings[term] = make(map[bson.ObjectID]int)
+		}
+		c.postings[term][m.ID]++
+	}
+}
+
+func (c *chatIndex) remove(id bson.ObjectID) {
+	doc, ok := c.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(c.postings[term], id)
+		if len(c.postings[term]) == 0 {
+			delete(c.postings, term)
+		}
+	}
+	delete(c.docs, id)
+}
+
+// search scores the messages containing every query term with tf-idf
+func (c *chatIndex) search(query string, opts SearchOptions) []*SearchResult {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	scores := make(map[bson.ObjectID]float64)
+	for i, term := range terms {
+		postings := c.postings[term]
+		idf := math.Log(1 + float64(len(c.docs))/float64(len(postings)+1))
+		next := make(map[bson.ObjectID]float64)
+		for id, tf := range postings {
+			if _, ok := scores[id]; i > 0 && !ok {
+				continue
+			}
+			next[id] = scores[id] + float64(tf)*idf/float64(len(c.docs[id].terms))
+		}
+		scores = next
+	}
+
+	since, until := opts.Since.Unix(), opts.Until.Unix()
+	results := make([]*SearchResult, 0, len(scores))
+	for id, score := range scores {
+		m := c.docs[id].message
+		if !opts.Since.IsZero() && m.CreatedAt < since || !opts.Until.IsZero() && m.CreatedAt >= until {
+			continue
+		}
+		results = append(results, &SearchResult{Message: m, Score: score})
+	}
+	sortSearchResults(results)
+
+	if len(results) > opts.limit() {
+		results = results[:opts.limit()]
+	}
+	return results
+}
+
+// sortSearchResults orders results by score, newest first on ties
+func sortSearchResults(results []*SearchResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return lessMessage(results[j].Message, results[i].Message)
+	})
+}
+
+// messageIndex keeps the inverted indexes of the most recently searched chats
+// in memory for storages that cannot search on the server side. The index of
+// a chat is built from the storage on its first search, then kept up to date
+// by the storage as messages are saved.
+type messageIndex struct {
+	mu sync.Mutex
+	// lru holds the indexed chats, most recently searched first
+	lru   *list.List
+	chats map[int64]*list.Element
+}
+
+// builtChatIndex is a chatIndex held by a messageIndex
+type builtChatIndex struct {
+	*chatIndex
+
+	// mu guards the chatIndex and ready
+	mu    sync.Mutex
+	ready bool
+	// building and pending are guarded by messageIndex.mu, messages saved
+	// while the index is built are applied once it is done
+	building bool
+	pending  []*Message
+}
+
+func newMessageIndex() *messageIndex {
+	return &messageIndex{
+		lru:   list.New(),
+		chats: make(map[int64]*list.Element),
+	}
+}
+
+// add indexes a saved message if its chat is indexed
+func (x *messageIndex) add(m *Message) {
+	copied := *m
+
+	x.mu.Lock()
+	e, ok := x.chats[m.ChatID]
+	if !ok {
+		x.mu.Unlock()
+		return
+	}
+	index := e.Value.(*builtChatIndex)
+	if index.building {
+		index.pending = append(index.pending, &copied)
+		x.mu.Unlock()
+		return
+	}
+	x.mu.Unlock()
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.add(&copied)
+}
+
+// invalidate drops the index of a chat after messages were deleted
+func (x *messageIndex) invalidate(chatID int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if e, ok := x.chats[chatID]; ok {
+		x.lru.Remove(e)
+		delete(x.chats, chatID)
+	}
+}
+
+// chat returns the index of a chat, adding an empty one if there is none
+func (x *messageIndex) chat(chatID int64) *builtChatIndex {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if e, ok := x.chats[chatID]; ok {
+		x.lru.MoveToFront(e)
+		return e.Value.(*builtChatIndex)
+	}
+
+	index := &builtChatIndex{chatIndex: newChatIndex(chatID), building: true}
+	x.chats[chatID] = x.lru.PushFront(index)
+	for x.lru.Len() > searchIndexChats {
+		oldest := x.lru.Back()
+		x.lru.Remove(oldest)
+		delete(x.chats, oldest.Value.(*builtChatIndex).chatID)
+	}
+	return index
+}
+
+// search searches a chat, building its index from the storage first if needed
+func (x *messageIndex) search(ctx context.Context, storage MessageStorage, chatID int64, query string, opts SearchOptions) ([]*SearchResult, error) {
+	index := x.chat(chatID)
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if !index.ready {
+		if err := x.build(ctx, storage, index); err != nil {
+			x.invalidate(chatID)
+			return nil, err
+		}
+	}
+	return index.search(query, opts), nil
+}
+
+// build reads every message of the chat into its index
+func (x *messageIndex) build(ctx context.Context, storage MessageStorage, index *builtChatIndex) error {
+	cursor := ""
+	for {
+		page, err := storage.QueryMessages(ctx, MessageQuery{
+			ChatID: index.chatID,
+			Limit:  searchIndexBatch,
+			Cursor: cursor,
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range page.Messages {
+			index.add(m)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, m := range index.pending {
+		index.add(m)
+	}
+	index.pending = nil
+	index.building = false
+	index.ready = true
+	return nil
+}
@@ -0,0 +1,39 @@
+package dao
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Hello, World! v2", "[hello world v2]"},
+		{"今天部署失败", "[今天 天部 部署 署失 失败]"},
+		{"用Go写的bot", "[用 go 写的 bot]"},
+		{"  ...  ", "[]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tokenize(tt.text)); got != tt.want {
+			t.Errorf("tokenize(%q) = %s, want %s", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearchCJK(t *testing.T) {
+	index := newChatIndex(100)
+	for i, text := range []string{"今天部署失败了", "明天再部署", "午饭吃什么"} {
+		m := &Message{Update: textUpdate(int64(i+1), 100, 7, text)}
+		m.prepare(time.Now())
+		index.add(m)
+	}
+
+	results := index.search("部署", SearchOptions{})
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	assertTexts(t, texts([]*Message{index.search("部署失败", SearchOptions{})[0].Message}), "今天部署失败了")
+}
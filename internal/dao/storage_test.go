@@ -0,0 +1,490 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// testMessageStorage runs the MessageStorage conformance suite. newStorage
+// must return an empty storage on every call.
+func testMessageStorage(t *testing.T, newStorage func(t *testing.T) MessageStorage) {
+	t.Run("Save", func(t *testing.T) {
+		s := newStorage(t)
+		ctx := context.Background()
+
+		m := &Message{Update: textUpdate(1, 100, 7, "hello")}
+		before := time.Now().Unix()
+		if err := s.SaveMessage(ctx, m); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+		if m.ID.IsZero() {
+			t.Error("SaveMessage did not set ID")
+		}
+		if m.ChatID != 100 {
+			t.Errorf("ChatID = %d, want 100", m.ChatID)
+		}
+		if m.CreatedAt < before || m.UpdatedAt < before {
+			t.Errorf("timestamps not set: created %d updated %d", m.CreatedAt, m.UpdatedAt)
+		}
+
+		got := queryTexts(t, s, MessageQuery{ChatID: 100})
+		assertTexts(t, got, "hello")
+	})
+
+	t.Run("SaveSameIDReplaces", func(t *testing.T) {
+		s := newStorage(t)
+		ctx := context.Background()
+
+		m := saveAt(t, s, 100, "before", time.Now().Add(-time.Minute))
+		again := &Message{ID: m.ID, Update: textUpdate(1, 100, 7, "after"), CreatedAt: m.CreatedAt}
+		if err := s.SaveMessage(ctx, again); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100}), "after")
+	})
+
+	t.Run("OrderByCreatedAt", func(t *testing.T) {
+		s := newStorage(t)
+		now := time.Now()
+
+		saveAt(t, s, 100, "third", now.Add(-1*time.Hour))
+		saveAt(t, s, 100, "first", now.Add(-3*time.Hour))
+		saveAt(t, s, 100, "second", now.Add(-2*time.Hour))
+
+		got := queryTexts(t, s, MessageQuery{ChatID: 100})
+		assertTexts(t, got, "first", "second", "third")
+
+		messages, err := s.GetMessageByChatID(context.Background(), 100)
+		if err != nil {
+			t.Fatalf("GetMessageByChatID: %v", err)
+		}
+		assertTexts(t, texts(messages), "first", "second", "third")
+	})
+
+	t.Run("ChatIsolation", func(t *testing.T) {
+		s := newStorage(t)
+		now := time.Now()
+
+		saveAt(t, s, 100, "a", now.Add(-2*time.Minute))
+		saveAt(t, s, 200, "b", now.Add(-1*time.Minute))
+		saveAt(t, s, -100, "c", now)
+
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100}), "a")
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 200}), "b")
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: -100}), "c")
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 300}))
+	})
+
+	t.Run("NilUpdateMessage", func(t *testing.T) {
+		s := newStorage(t)
+		ctx := context.Background()
+
+		m := &Message{Update: &models.Update{
+			ID:         2,
+			PollAnswer: &models.PollAnswer{PollID: "poll"},
+		}}
+		if err := s.SaveMessage(ctx, m); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+		if m.ChatID != 0 {
+			t.Errorf("ChatID = %d, want 0", m.ChatID)
+		}
+
+		page, err := s.QueryMessages(ctx, MessageQuery{ChatID: 0})
+		if err != nil {
+			t.Fatalf("QueryMessages: %v", err)
+		}
+		if len(page.Messages) != 1 || page.Messages[0].Update.PollAnswer == nil {
+			t.Fatalf("got %d messages, want the poll answer", len(page.Messages))
+		}
+	})
+
+	t.Run("TimeWindow", func(t *testing.T) {
+		s := newStorage(t)
+		now := time.Now()
+
+		saveAt(t, s, 100, "old", now.Add(-10*24*time.Hour))
+		saveAt(t, s, 100, "days", now.Add(-3*24*time.Hour))
+		saveAt(t, s, 100, "hours", now.Add(-3*time.Hour))
+		saveAt(t, s, 100, "recent", now.Add(-1*time.Minute))
+
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100}), "old", "days", "hours", "recent")
+		assertTexts(t, queryTexts(t, s, MessageQuery{
+			ChatID: 100,
+			Since:  now.Add(-4 * 24 * time.Hour),
+			Until:  now.Add(-2 * time.Hour),
+		}), "days", "hours")
+		assertTexts(t, queryTexts(t, s, MessageQuery{
+			ChatID: 100,
+			Since:  now.Add(-3 * time.Hour),
+		}), "hours", "recent")
+
+		messages, err := s.GetMessageByChatID(context.Background(), 100)
+		if err != nil {
+			t.Fatalf("GetMessageByChatID: %v", err)
+		}
+		assertTexts(t, texts(messages), "days", "hours", "recent")
+	})
+
+	t.Run("LimitAndCursor", func(t *testing.T) {
+		s := newStorage(t)
+		ctx := context.Background()
+		now := time.Now()
+
+		for i := 0; i < 5; i++ {
+			saveAt(t, s, 100, fmt.Sprintf("m%d", i), now.Add(time.Duration(i-5)*time.Minute))
+		}
+
+		page, err := s.QueryMessages(ctx, MessageQuery{ChatID: 100, Limit: 2})
+		if err != nil {
+			t.Fatalf("QueryMessages: %v", err)
+		}
+		assertTexts(t, texts(page.Messages), "m3", "m4")
+		if page.NextCursor == "" {
+			t.Fatal("expected a next cursor")
+		}
+
+		page, err = s.QueryMessages(ctx, MessageQuery{ChatID: 100, Limit: 2, Cursor: page.NextCursor})
+		if err != nil {
+			t.Fatalf("QueryMessages: %v", err)
+		}
+		assertTexts(t, texts(page.Messages), "m1", "m2")
+
+		page, err = s.QueryMessages(ctx, MessageQuery{ChatID: 100, Limit: 2, Cursor: page.NextCursor})
+		if err != nil {
+			t.Fatalf("QueryMessages: %v", err)
+		}
+		assertTexts(t, texts(page.Messages), "m0")
+		if page.NextCursor != "" {
+			t.Errorf("NextCursor = %q on the last page", page.NextCursor)
+		}
+
+		if _, err := s.QueryMessages(ctx, MessageQuery{ChatID: 100, Cursor: "garbage"}); err == nil {
+			t.Error("expected an error for an invalid cursor")
+		}
+	})
+
+	t.Run("SenderFilter", func(t *testing.T) {
+		s := newStorage(t)
+		ctx := context.Background()
+		now := time.Now()
+
+		for i, sender := range []int64{7, 8, 7} {
+			m := &Message{
+				Update:    textUpdate(int64(i), 100, sender, fmt.Sprintf("from %d #%d", sender, i)),
+				CreatedAt: now.Add(time.Duration(i) * time.Second).Unix(),
+			}
+			if err := s.SaveMessage(ctx, m); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+		}
+
+		// An edit of a message the bot did not see is stored on its own
+		edited := textUpdate(3, 100, 7, "edited only")
+		edited.EditedMessage, edited.Message = edited.Message, nil
+		if err := s.SaveMessage(ctx, &Message{Update: edited, CreatedAt: now.Add(3 * time.Second).Unix()}); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100, SenderID: 7}), "from 7 #0", "from 7 #2", "edited only")
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100, SenderID: 8}), "from 8 #1")
+	})
+
+	t.Run("DeleteMessages", func(t *testing.T) {
+		s := newStorage(t)
+		ctx := context.Background()
+		now := time.Now()
+
+		saveAt(t, s, 100, "old", now.Add(-10*24*time.Hour))
+		saveAt(t, s, 100, "recent", now.Add(-time.Hour))
+		saveAt(t, s, 200, "other chat", now.Add(-10*24*time.Hour))
+		m := &Message{Update: textUpdate(1, 100, 8, "from 8"), CreatedAt: now.Add(-time.Minute).Unix()}
+		if err := s.SaveMessage(ctx, m); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		deleted, err := s.DeleteMessages(ctx, MessageQuery{ChatID: 100, Until: now.Add(-24 * time.Hour)})
+		if err != nil {
+			t.Fatalf("DeleteMessages: %v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("deleted = %d, want 1", deleted)
+		}
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100}), "recent", "from 8")
+
+		deleted, err = s.DeleteMessages(ctx, MessageQuery{ChatID: 100, SenderID: 8})
+		if err != nil {
+			t.Fatalf("DeleteMessages: %v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("deleted = %d, want 1", deleted)
+		}
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100}), "recent")
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 200}), "other chat")
+
+		// A single message of days within the time range
+		first := saveAt(t, s, 300, "first", now.Add(-10*24*time.Hour))
+		saveAt(t, s, 300, "second", now.Add(-10*24*time.Hour+time.Second))
+		deleted, err = s.DeleteMessages(ctx, MessageQuery{
+			ChatID:    300,
+			Until:     now.Add(-24 * time.Hour),
+			MessageID: first.TelegramMessageID(),
+		})
+		if err != nil {
+			t.Fatalf("DeleteMessages: %v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("deleted = %d, want 1", deleted)
+		}
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 300}), "second")
+	})
+
+	t.Run("Mutations", func(t *testing.T) {
+		s := newStorage(t)
+		ctx := context.Background()
+
+		original := textUpdate(1, 100, 7, "original")
+		saveAt(t, s, 100, "other", time.Now().Add(-time.Minute))
+		if _, err := ApplyUpdate(ctx, s, original); err != nil {
+			t.Fatalf("ApplyUpdate: %v", err)
+		}
+
+		edit := textUpdate(2, 100, 7, "edited")
+		edit.EditedMessage, edit.Message = edit.Message, nil
+		edit.EditedMessage.ID = 1
+		reaction := &models.Update{ID: 3, MessageReaction: &models.MessageReactionUpdated{
+			Chat:      models.Chat{ID: 100},
+			MessageID: 1,
+			User:      &models.User{ID: 8},
+			NewReaction: []models.ReactionType{{
+				Type:              models.ReactionTypeTypeEmoji,
+				ReactionTypeEmoji: &models.ReactionTypeEmoji{Emoji: "👍"},
+			}},
+		}}
+		for _, update := range []*models.Update{edit, reaction} {
+			if _, err := ApplyUpdate(ctx, s, update); err != nil {
+				t.Fatalf("ApplyUpdate: %v", err)
+			}
+		}
+
+		page, err := s.QueryMessages(ctx, MessageQuery{ChatID: 100, MessageID: 1})
+		if err != nil {
+			t.Fatalf("QueryMessages: %v", err)
+		}
+		assertTexts(t, texts(page.Messages), "edited")
+		if got := page.Messages[0].Reactions; fmt.Sprint(got) != "[{8 👍}]" {
+			t.Errorf("Reactions = %v, want [{8 👍}]", got)
+		}
+		if got := page.Messages[0].SenderID(); got != 7 {
+			t.Errorf("SenderID = %d, want 7", got)
+		}
+		assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 100}), "other", "edited")
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		s := newStorage(t)
+		ctx := context.Background()
+		now := time.Now()
+
+		saveAt(t, s, 100, "the deploy failed again", now.Add(-3*time.Hour))
+		saveAt(t, s, 100, "lunch anyone?", now.Add(-2*time.Hour))
+		saveAt(t, s, 100, "deploy is green now", now.Add(-time.Hour))
+		saveAt(t, s, 200, "deploy in another chat", now)
+
+		search := func(query string, opts SearchOptions) []string {
+			t.Helper()
+			results, err := Search(ctx, s, 100, query, opts)
+			if err != nil {
+				t.Fatalf("Search: %v", err)
+			}
+			var out []string
+			for _, r := range results {
+				out = append(out, r.Message.Text())
+			}
+			slices.Sort(out)
+			return out
+		}
+		assertTexts(t, search("deploy", SearchOptions{}), "deploy is green now", "the deploy failed again")
+		assertTexts(t, search("deploy failed", SearchOptions{}), "the deploy failed again")
+		assertTexts(t, search("deploy", SearchOptions{Since: now.Add(-90 * time.Minute)}), "deploy is green now")
+		assertTexts(t, search("deploy", SearchOptions{Limit: 1}), "deploy is green now")
+		assertTexts(t, search("nothing", SearchOptions{}))
+
+		// The index follows saves and deletions
+		saveAt(t, s, 100, "rollback the deploy", now)
+		if _, err := s.DeleteMessages(ctx, MessageQuery{ChatID: 100, Until: now.Add(-150 * time.Minute)}); err != nil {
+			t.Fatalf("DeleteMessages: %v", err)
+		}
+		assertTexts(t, search("deploy", SearchOptions{}), "deploy is green now", "rollback the deploy")
+	})
+
+	t.Run("ListChatIDs", func(t *testing.T) {
+		s := newStorage(t)
+		now := time.Now()
+
+		saveAt(t, s, 100, "a", now)
+		saveAt(t, s, -200, "b", now)
+		saveAt(t, s, 100, "c", now)
+
+		chatIDs, err := s.ListChatIDs(context.Background())
+		if err != nil {
+			t.Fatalf("ListChatIDs: %v", err)
+		}
+		slices.Sort(chatIDs)
+		if fmt.Sprint(chatIDs) != "[-200 100]" {
+			t.Errorf("ListChatIDs = %v, want [-200 100]", chatIDs)
+		}
+	})
+}
+
+func textUpdate(updateID, chatID, senderID int64, text string) *models.Update {
+	return &models.Update{
+		ID: updateID,
+		Message: &models.Message{
+			ID:   int(updateID),
+			Chat: models.Chat{ID: chatID},
+			From: &models.User{ID: senderID, FirstName: "user"},
+			Text: text,
+		},
+	}
+}
+
+func saveAt(t *testing.T, s MessageStorage, chatID int64, text string, at time.Time) *Message {
+	t.Helper()
+	m := &Message{
+		Update:    textUpdate(at.UnixNano(), chatID, 7, text),
+		CreatedAt: at.Unix(),
+	}
+	if err := s.SaveMessage(context.Background(), m); err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	return m
+}
+
+func queryTexts(t *testing.T, s MessageStorage, q MessageQuery) []string {
+	t.Helper()
+	page, err := s.QueryMessages(context.Background(), q)
+	if err != nil {
+		t.Fatalf("QueryMessages: %v", err)
+	}
+	return texts(page.Messages)
+}
+
+func texts(messages []*Message) []string {
+	out := []string{}
+	for _, m := range messages {
+		if m.Latest() != nil {
+			out = append(out, m.Text())
+		}
+	}
+	return out
+}
+
+func assertTexts(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMemoryMessageStorage(t *testing.T) {
+	testMessageStorage(t, func(t *testing.T) MessageStorage {
+		return NewMemoryMessageStorage()
+	})
+}
+
+func TestLocalMessageStorage(t *testing.T) {
+	testMessageStorage(t, func(t *testing.T) MessageStorage {
+		s, err := NewLocalMessageStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestS3MessageStorage(t *testing.T) {
+	testMessageStorage(t, func(t *testing.T) MessageStorage {
+		client, _ := newFakeS3(t)
+		return NewS3MessageStorage(client, "xbot")
+	})
+}
+
+func TestS3MessageStorageEncrypted(t *testing.T) {
+	testMessageStorage(t, func(t *testing.T) MessageStorage {
+		client, _ := newFakeS3(t)
+		s := NewS3MessageStorage(client, "xbot")
+		s.keys = newTestKeyring(t, &s3KeyStore{client: client, bucket: "xbot"}, testMasterKey)
+		return s
+	})
+}
+
+func TestS3QueryLimitOrder(t *testing.T) {
+	client, _ := newFakeS3(t)
+	s := NewS3MessageStorage(client, "xbot")
+	day := time.Now().Add(-time.Hour).Truncate(24 * time.Hour)
+
+	// Messages saved later sort after in the day but were created before
+	saveAt(t, s, 1, "latest", day.Add(12*time.Hour))
+	saveAt(t, s, 1, "first", day.Add(10*time.Hour))
+	saveAt(t, s, 1, "second", day.Add(11*time.Hour))
+
+	assertTexts(t, queryTexts(t, s, MessageQuery{ChatID: 1, Limit: 1}), "latest")
+}
+
+// TestMongoDBStorage runs against a real server when XBOT_TEST_MONGO_URI is set
+func TestMongoDBStorage(t *testing.T) {
+	uri := os.Getenv("XBOT_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("XBOT_TEST_MONGO_URI not set")
+	}
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+
+	testMessageStorage(t, func(t *testing.T) MessageStorage {
+		db := client.Database("xbot_test_" + bson.NewObjectID().Hex())
+		t.Cleanup(func() { db.Drop(context.Background()) })
+		if err := ensureMessageIndexes(context.Background(), db.Collection("messages")); err != nil {
+			t.Fatal(err)
+		}
+		return &MongoDBStorage{messagesColl: db.Collection("messages")}
+	})
+}
+
+// TestMySQLMessageStorage runs against a real server when XBOT_TEST_MYSQL_DSN is set.
+// The tables of the configured database are truncated.
+func TestMySQLMessageStorage(t *testing.T) {
+	dsn := os.Getenv("XBOT_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("XBOT_TEST_MYSQL_DSN not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrateMySQL(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	testMessageStorage(t, func(t *testing.T) MessageStorage {
+		if _, err := db.Exec("TRUNCATE TABLE messages"); err != nil {
+			t.Fatal(err)
+		}
+		return NewMySQLMessageStorage(db)
+	})
+}
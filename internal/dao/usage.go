@@ -0,0 +1,160 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Usage is a request made to a model, recorded for accounting
+type Usage struct {
+	ID     bson.ObjectID `bson:"_id,omitempty"`
+	ChatID int64         `bson:"chat_id"`
+	// UserID is the user the request was made for, 0 for none
+	UserID int64  `bson:"user_id"`
+	Task   string `bson:"task"`
+	// Model is the model as configured, e.g. gemini:gemini-2.5-flash
+	Model            string `bson:"model"`
+	PromptTokens     int    `bson:"prompt_tokens"`
+	CompletionTokens int    `bson:"completion_tokens"`
+	Images           int    `bson:"images"`
+	LatencyMs        int64  `bson:"latency_ms"`
+	// Cost is the estimated cost in dollars
+	Cost float64 `bson:"cost"`
+	// Error is the error of a failed request
+	Error     string `bson:"error,omitempty"`
+	CreatedAt int64  `bson:"created_at"`
+}
+
+// UsageQuery selects the usage to sum up
+type UsageQuery struct {
+	ChatID int64
+	// UserID only sums up the usage of this user when non-zero
+	UserID int64
+	// Since is inclusive, Until exclusive, zero means no bound
+	Since time.Time
+	Until time.Time
+}
+
+// UsageTotal is the usage of a UsageQuery summed up
+type UsageTotal struct {
+	Requests         int     `bson:"requests"`
+	PromptTokens     int     `bson:"prompt_tokens"`
+	CompletionTokens int     `bson:"completion_tokens"`
+	Images           int     `bson:"images"`
+	Cost             float64 `bson:"cost"`
+}
+
+// ensureUsageIndexes creates the indexes of the usage collection
+func ensureUsageIndexes(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+// SaveUsage records a request made to a model
+func SaveUsage(ctx context.Context, usage Usage) error {
+	if usage.ID.IsZero() {
+		usage.ID = bson.NewObjectID()
+	}
+	if usage.CreatedAt == 0 {
+		usage.CreatedAt = time.Now().Unix()
+	}
+	if sqlDB != nil {
+		_, err := sqlDB.ExecContext(ctx,
+			`INSERT INTO llm_usage (id, chat_id, user_id, task, model, prompt_tokens, completion_tokens,
+			images, latency_ms, cost, error, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			usage.ID.Hex(), usage.ChatID, usage.UserID, usage.Task, usage.Model, usage.PromptTokens,
+			usage.CompletionTokens, usage.Images, usage.LatencyMs, usage.Cost,
+			sql.NullString{String: usage.Error, Valid: usage.Error != ""}, usage.CreatedAt)
+		return err
+	}
+	if usageColl == nil {
+		return ErrNoMongo
+	}
+	_, err := usageColl.InsertOne(ctx, usage)
+	return err
+}
+
+// SumUsage sums up the usage matching the query
+func SumUsage(ctx context.Context, query UsageQuery) (*UsageTotal, error) {
+	if sqlDB != nil {
+		return sumUsageSQL(ctx, query)
+	}
+	if usageColl == nil {
+		return nil, ErrNoMongo
+	}
+
+	match := bson.M{"chat_id": query.ChatID}
+	if query.UserID != 0 {
+		match["user_id"] = query.UserID
+	}
+	createdAt := bson.M{}
+	if !query.Since.IsZero() {
+		createdAt["$gte"] = query.Since.Unix()
+	}
+	if !query.Until.IsZero() {
+		createdAt["$lt"] = query.Until.Unix()
+	}
+	if len(createdAt) > 0 {
+		match["created_at"] = createdAt
+	}
+
+	cursor, err := usageColl.Aggregate(ctx, bson.A{
+		bson.M{"$match": match},
+		bson.M{"$group": bson.M{
+			"_id":               nil,
+			"requests":          bson.M{"$sum": 1},
+			"prompt_tokens":     bson.M{"$sum": "$prompt_tokens"},
+			"completion_tokens": bson.M{"$sum": "$completion_tokens"},
+			"images":            bson.M{"$sum": "$images"},
+			"cost":              bson.M{"$sum": "$cost"},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	total := &UsageTotal{}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(total); err != nil {
+			return nil, err
+		}
+	}
+	return total, cursor.Err()
+}
+
+func sumUsageSQL(ctx context.Context, query UsageQuery) (*UsageTotal, error) {
+	conds := []string{"chat_id = ?"}
+	args := []any{query.ChatID}
+	if query.UserID != 0 {
+		conds = append(conds, "user_id = ?")
+		args = append(args, query.UserID)
+	}
+	if !query.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, query.Since.Unix())
+	}
+	if !query.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, query.Until.Unix())
+	}
+
+	total := &UsageTotal{}
+	err := sqlDB.QueryRowContext(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0),
+		COALESCE(SUM(images), 0), COALESCE(SUM(cost), 0) FROM llm_usage WHERE `+
+			strings.Join(conds, " AND "), args...).
+		Scan(&total.Requests, &total.PromptTokens, &total.CompletionTokens, &total.Images, &total.Cost)
+	if err != nil {
+		return nil, err
+	}
+	return total, nil
+}
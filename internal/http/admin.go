@@ -0,0 +1,85 @@
+package http
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"butterfly.orx.me/core/log"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/dao"
+	"go.orx.me/xbot/internal/pkg/llm"
+	"go.orx.me/xbot/internal/transcript"
+)
+
+// adminAuth only lets requests with the admin token through. The endpoints do
+// not exist when no token is configured.
+func adminAuth(c *gin.Context) {
+	token := conf.Conf.Admin.Token
+	if token == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	given, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+	c.Next()
+}
+
+// exportHandler returns the transcript of a chat, like /export.
+// Query parameters: since (2006-01-02 or a period like 7d) and format
+// (json, markdown or html).
+func exportHandler(c *gin.Context) {
+	logger := log.FromContext(c.Request.Context()).With("handler", "exportHandler")
+
+	chatID, err := strconv.ParseInt(c.Param("chat_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid chat id"})
+		return
+	}
+	now := time.Now()
+	var since time.Time
+	if s := c.Query("since"); s != "" {
+		if since, err = transcript.ParseSince(s, now); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	format := transcript.FormatJSON
+	if f := c.Query("format"); f != "" {
+		var ok bool
+		if format, ok = transcript.ParseFormat(f); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, markdown or html"})
+			return
+		}
+	}
+
+	t, err := transcript.Load(c.Request.Context(), dao.GetMessageStorage(), chatID, since)
+	if err != nil {
+		logger.Error("Load transcript error", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read messages"})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := transcript.Render(&buf, format, t); err != nil {
+		logger.Error("Render transcript error", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to render transcript"})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+transcript.FileName(t, format, now)+`"`)
+	c.Data(http.StatusOK, format.ContentType(), buf.Bytes())
+}
+
+// providersHandler checks the health of the model providers and lists their
+// models
+func providersHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"providers": llm.Status(c.Request.Context())})
+}
@@ -16,4 +16,8 @@ func Router(m *gin.Engine) {
 		)
 		bot.GetBot().WebhookHandler().ServeHTTP(c.Writer, c.Request)
 	})
+
+	admin := m.Group("/v1/admin", adminAuth)
+	admin.GET("/chats/:chat_id/export", exportHandler)
+	admin.GET("/providers", providersHandler)
 }
@@ -13,4 +13,84 @@ var (
 		},
 		[]string{"chat_id"},
 	)
+
+	HistoryCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "history_cache_requests_total",
+			Help: "Total number of history queries by cache result (hit, miss or bypass)",
+		},
+		[]string{"result"},
+	)
+
+	HistoryCacheChats = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "history_cache_chats",
+			Help: "Number of chats held in the history cache",
+		},
+	)
+
+	LLMKeyRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "llm_key_requests_total",
+			Help: "Total number of model provider requests per API key by result (ok, unauthorized, rate_limited or error)",
+		},
+		[]string{"provider", "key", "result"},
+	)
+
+	LLMKeyBenched = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "llm_key_benched",
+			Help: "Whether an API key of a model provider is benched after a 401 or 429 response, until its next successful request",
+		},
+		[]string{"provider", "key"},
+	)
+
+	LLMRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "llm_requests_total",
+			Help: "Total number of requests made to models per task and result (ok or error)",
+		},
+		[]string{"task", "model", "result"},
+	)
+
+	LLMRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "llm_request_duration_seconds",
+			Help:    "Duration of the requests made to models",
+			Buckets: []float64{0.5, 1, 2.5, 5, 10, 20, 40, 80, 160},
+		},
+		[]string{"task", "model"},
+	)
+
+	LLMTokens = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "llm_tokens_total",
+			Help: "Total number of tokens used by models per kind (prompt or completion)",
+		},
+		[]string{"model", "kind"},
+	)
+
+	LLMImages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "llm_images_total",
+			Help: "Total number of images generated per model",
+		},
+		[]string{"model"},
+	)
+
+	LLMCost = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "llm_cost_dollars_total",
+			Help: "Estimated cost of the requests made to models per task, from the configured prices. The cost per chat is in the usage records.",
+		},
+		[]string{"task", "model"},
+	)
+
+	RateLimitRefusals = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_refusals_total",
+			Help: "Total number of commands refused per reason (rate_limited or quota_exceeded)",
+		},
+		[]string{"command", "reason"},
+	)
 )
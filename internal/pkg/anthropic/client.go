@@ -0,0 +1,307 @@
+// Package anthropic is the provider of the Anthropic Messages API
+package anthropic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/pkg/llm"
+)
+
+const (
+	defaultEndpoint  = "https://api.anthropic.com"
+	apiVersion       = "2023-06-01"
+	defaultMaxTokens = 4096
+)
+
+func init() {
+	llm.RegisterType("anthropic", New)
+}
+
+// Client is the Anthropic Messages API provider
+type Client struct {
+	endpoint   string
+	maxTokens  int
+	httpClient *http.Client
+}
+
+// New creates the Anthropic Messages API provider
+func New(c conf.ProviderConfig) (llm.Provider, error) {
+	keys := llm.Keys(c)
+	if len(keys) == 0 {
+		return nil, errors.New("an API key is required")
+	}
+	client := &Client{
+		endpoint:   strings.TrimSuffix(c.Endpoint, "/"),
+		maxTokens:  c.MaxTokens,
+		httpClient: llm.NewKeyPool(c.Name, keys, llm.SetHeader("X-Api-Key")).Client(),
+	}
+	if client.endpoint == "" {
+		client.endpoint = defaultEndpoint
+	}
+	if client.maxTokens <= 0 {
+		client.maxTokens = defaultMaxTokens
+	}
+	return client, nil
+}
+
+// Capabilities implements llm.Provider
+func (c *Client) Capabilities() llm.Capability {
+	return llm.CapChat
+}
+
+// GenerateImage implements llm.Provider
+func (c *Client) GenerateImage(ctx context.Context, req *llm.ImageRequest) (*llm.Image, error) {
+	return nil, llm.ErrUnsupported
+}
+
+// Embed implements llm.Provider
+func (c *Client) Embed(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	return nil, llm.ErrUnsupported
+}
+
+// request is the body of POST /v1/messages
+type request struct {
+	Model     string    `json:"model"`
+	MaxTokens int       `json:"max_tokens"`
+	System    string    `json:"system,omitempty"`
+	Messages  []message `json:"messages"`
+	Stream    bool      `json:"stream,omitempty"`
+}
+
+type message struct {
+	Role    string         `json:"role"`
+	Content []contentBlock `json:"content"`
+}
+
+type contentBlock struct {
+	Type   string       `json:"type"`
+	Text   string       `json:"text,omitempty"`
+	Source *imageSource `json:"source,omitempty"`
+}
+
+type imageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// response is a message created by the API
+type response struct {
+	Content    []contentBlock `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      usage          `json:"usage"`
+}
+
+type usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// apiError is the body of error responses and stream events
+type apiError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// newRequest converts a chat request, images go before the text of their
+// message as the API recommends
+func (c *Client) newRequest(req *llm.ChatRequest, stream bool) *request {
+	r := &request{
+		Model:     req.Model,
+		MaxTokens: c.maxTokens,
+		System:    req.System,
+		Messages:  make([]message, 0, len(req.Messages)),
+		Stream:    stream,
+	}
+	for _, m := range req.Messages {
+		var blocks []contentBlock
+		for _, img := range m.Images {
+			blocks = append(blocks, contentBlock{
+				Type: "image",
+				Source: &imageSource{
+					Type:      "base64",
+					MediaType: img.MIMEType,
+					Data:      base64.StdEncoding.EncodeToString(img.Data),
+				},
+			})
+		}
+		if m.Content != "" {
+			blocks = append(blocks, contentBlock{Type: "text", Text: m.Content})
+		}
+		r.Messages = append(r.Messages, message{Role: string(m.Role), Content: blocks})
+	}
+	return r
+}
+
+// post sends a request to an endpoint of the messages API
+func (c *Client) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Anthropic-Version", apiVersion)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// responseError describes a failed request
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var e apiError
+	if err := json.Unmarshal(body, &e); err == nil && e.Error.Message != "" {
+		return fmt.Errorf("anthropic: %s: %s: %s", resp.Status, e.Error.Type, e.Error.Message)
+	}
+	return fmt.Errorf("anthropic: %s: %s", resp.Status, body)
+}
+
+// Chat implements llm.Provider
+func (c *Client) Chat(ctx context.Context, req *llm.ChatRequest) (*llm.ChatResponse, error) {
+	resp, err := c.post(ctx, "/v1/messages", c.newRequest(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	var sb strings.Builder
+	for _, block := range r.Content {
+		if block.Type == "text" {
+			sb.WriteString(block.Text)
+		}
+	}
+	if sb.Len() == 0 {
+		return nil, fmt.Errorf("no text in response, stop reason %s", r.StopReason)
+	}
+	return &llm.ChatResponse{
+		Content: sb.String(),
+		Usage: llm.Usage{
+			PromptTokens:     r.Usage.InputTokens,
+			CompletionTokens: r.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+// streamEvent is the data of a server-sent event of a streamed message
+type streamEvent struct {
+	Type    string    `json:"type"`
+	Message *response `json:"message"`
+	Delta   struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *usage `json:"usage"`
+	apiError
+}
+
+// ChatStream implements llm.Streamer
+func (c *Client) ChatStream(ctx context.Context, req *llm.ChatRequest, delta func(string)) (*llm.ChatResponse, error) {
+	resp, err := c.post(ctx, "/v1/messages", c.newRequest(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var (
+		sb    strings.Builder
+		u     usage
+		ended bool
+	)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		// Only the data lines matter, they repeat the event type
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		var event streamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			return nil, fmt.Errorf("failed to decode event: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				u.InputTokens = event.Message.Usage.InputTokens
+			}
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+				sb.WriteString(event.Delta.Text)
+				delta(event.Delta.Text)
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				u.OutputTokens = event.Usage.OutputTokens
+			}
+		case "message_stop":
+			ended = true
+		case "error":
+			return nil, fmt.Errorf("anthropic: %s: %s", event.Error.Type, event.Error.Message)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !ended {
+		return nil, errors.New("stream ended before the message was complete")
+	}
+	if sb.Len() == 0 {
+		return nil, errors.New("no text in response")
+	}
+	return &llm.ChatResponse{
+		Content: sb.String(),
+		Usage: llm.Usage{
+			PromptTokens:     u.InputTokens,
+			CompletionTokens: u.OutputTokens,
+		},
+	}, nil
+}
+
+// CountTokens implements llm.TokenCounter, counting the text as a message
+func (c *Client) CountTokens(ctx context.Context, model, text string) (int, error) {
+	resp, err := c.post(ctx, "/v1/messages/count_tokens", map[string]any{
+		"model":    model,
+		"messages": []message{{Role: string(llm.RoleUser), Content: []contentBlock{{Type: "text", Text: text}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return r.InputTokens, nil
+}
@@ -0,0 +1,163 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/pkg/llm"
+)
+
+// standIn serves the messages endpoint, answering with the text of the last
+// message reversed, and counts a token per character
+func standIn(t *testing.T, requests *[]request) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/messages") || r.Header.Get("X-Api-Key") != "test-key" || r.Header.Get("Anthropic-Version") != apiVersion {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`))
+			return
+		}
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		*requests = append(*requests, req)
+		if r.URL.Path == "/v1/messages/count_tokens" {
+			fmt.Fprintf(w, `{"input_tokens":%d}`, len([]rune(req.Messages[0].Content[0].Text)))
+			return
+		}
+		if req.Model == "overloaded" {
+			w.WriteHeader(529)
+			w.Write([]byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+			return
+		}
+
+		last := req.Messages[len(req.Messages)-1].Content
+		answer := []rune(last[len(last)-1].Text)
+		for i, j := 0, len(answer)-1; i < j; i, j = i+1, j-1 {
+			answer[i], answer[j] = answer[j], answer[i]
+		}
+		if !req.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"type":"message","role":"assistant","content":[{"type":"text","text":%q}],"stop_reason":"end_turn","usage":{"input_tokens":20,"output_tokens":%d}}`,
+				string(answer), len(answer))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"content\":[],\"usage\":{\"input_tokens\":20,\"output_tokens\":1}}}\n\n")
+		fmt.Fprint(w, "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n")
+		fmt.Fprint(w, "event: ping\ndata: {\"type\":\"ping\"}\n\n")
+		for _, r := range answer {
+			fmt.Fprintf(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":%q}}\n\n", string(r))
+		}
+		fmt.Fprint(w, "event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n")
+		fmt.Fprintf(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":%d}}\n\n", len(answer))
+		fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestClient(t *testing.T, endpoint, key string) *Client {
+	t.Helper()
+	p, err := New(conf.ProviderConfig{Endpoint: endpoint, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*Client)
+}
+
+func testRequest(model string) *llm.ChatRequest {
+	return &llm.ChatRequest{
+		Model:  model,
+		System: "Reverse the text.",
+		Messages: []llm.Message{
+			{Role: llm.RoleUser, Content: "abc"},
+			{Role: llm.RoleAssistant, Content: "cba"},
+			{Role: llm.RoleUser, Content: "hello", Images: []llm.ImageInput{{MIMEType: "image/png", Data: []byte("png")}}},
+		},
+	}
+}
+
+func TestChat(t *testing.T) {
+	var requests []request
+	c := newTestClient(t, standIn(t, &requests).URL, "test-key")
+
+	resp, err := c.Chat(context.Background(), testRequest("claude-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "olleh" || resp.Usage.PromptTokens != 20 || resp.Usage.CompletionTokens != 5 {
+		t.Errorf("response = %+v", resp)
+	}
+
+	req := requests[0]
+	if req.Model != "claude-test" || req.System != "Reverse the text." || req.MaxTokens != defaultMaxTokens || req.Stream {
+		t.Errorf("request = %+v", req)
+	}
+	if len(req.Messages) != 3 || req.Messages[1].Role != "assistant" {
+		t.Fatalf("messages = %+v", req.Messages)
+	}
+	// The image goes before the text
+	blocks := req.Messages[2].Content
+	if len(blocks) != 2 || blocks[0].Type != "image" || blocks[0].Source.MediaType != "image/png" ||
+		blocks[0].Source.Data != "cG5n" || blocks[1].Text != "hello" {
+		t.Errorf("last message = %+v", blocks)
+	}
+}
+
+func TestChatStream(t *testing.T) {
+	var requests []request
+	c := newTestClient(t, standIn(t, &requests).URL, "test-key")
+
+	var deltas []string
+	resp, err := c.ChatStream(context.Background(), testRequest("claude-test"), func(s string) {
+		deltas = append(deltas, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !requests[0].Stream {
+		t.Error("request is not streamed")
+	}
+	if resp.Content != "olleh" || strings.Join(deltas, "|") != "o|l|l|e|h" {
+		t.Errorf("response = %+v, deltas = %v", resp, deltas)
+	}
+	if resp.Usage.PromptTokens != 20 || resp.Usage.CompletionTokens != 5 {
+		t.Errorf("usage = %+v", resp.Usage)
+	}
+}
+
+func TestChatErrors(t *testing.T) {
+	var requests []request
+	srv := standIn(t, &requests)
+
+	_, err := newTestClient(t, srv.URL, "wrong-key").Chat(context.Background(), testRequest("claude-test"))
+	if err == nil || !strings.Contains(err.Error(), "authentication_error") {
+		t.Errorf("error = %v, want an authentication error", err)
+	}
+	_, err = newTestClient(t, srv.URL, "test-key").ChatStream(context.Background(), testRequest("overloaded"), func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "overloaded_error") {
+		t.Errorf("error = %v, want an overloaded error", err)
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	var requests []request
+	c := newTestClient(t, standIn(t, &requests).URL, "test-key")
+
+	n, err := c.CountTokens(context.Background(), "claude-test", "héllo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 || requests[0].Model != "claude-test" {
+		t.Errorf("CountTokens = %d, request = %+v", n, requests[0])
+	}
+}
@@ -0,0 +1,109 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.orx.me/xbot/internal/pkg/llm"
+	"google.golang.org/genai"
+)
+
+// chatContents converts a chat request, the turns of the conversation are
+// sent as user and model contents
+func chatContents(req *llm.ChatRequest) ([]*genai.Content, *genai.GenerateContentConfig) {
+	contents := make([]*genai.Content, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		role := genai.Role(genai.RoleUser)
+		if m.Role == llm.RoleAssistant {
+			role = genai.RoleModel
+		}
+		parts := make([]*genai.Part, 0, len(m.Images)+1)
+		for _, img := range m.Images {
+			parts = append(parts, genai.NewPartFromBytes(img.Data, img.MIMEType))
+		}
+		if m.Content != "" {
+			parts = append(parts, genai.NewPartFromText(m.Content))
+		}
+		contents = append(contents, genai.NewContentFromParts(parts, role))
+	}
+
+	config := &genai.GenerateContentConfig{CandidateCount: 1}
+	if req.System != "" {
+		config.SystemInstruction = genai.NewContentFromText(req.System, genai.RoleUser)
+	}
+	return contents, config
+}
+
+// Chat implements llm.Provider
+func (c *Client) Chat(ctx context.Context, req *llm.ChatRequest) (*llm.ChatResponse, error) {
+	contents, config := chatContents(req)
+	resp, err := c.sdkClient.Models.GenerateContent(ctx, req.Model, contents, config)
+	if err != nil {
+		return nil, err
+	}
+	text := resp.Text()
+	if text == "" {
+		return nil, fmt.Errorf("no text in response: %s", finishReason(resp))
+	}
+	return &llm.ChatResponse{Content: text, Usage: usage(resp)}, nil
+}
+
+// ChatStream implements llm.Streamer
+func (c *Client) ChatStream(ctx context.Context, req *llm.ChatRequest, delta func(string)) (*llm.ChatResponse, error) {
+	contents, config := chatContents(req)
+	var (
+		sb   strings.Builder
+		last *genai.GenerateContentResponse
+	)
+	for resp, err := range c.sdkClient.Models.GenerateContentStream(ctx, req.Model, contents, config) {
+		if err != nil {
+			return nil, err
+		}
+		last = resp
+		if text := resp.Text(); text != "" {
+			sb.WriteString(text)
+			delta(text)
+		}
+	}
+	if last == nil {
+		return nil, errors.New("empty response stream")
+	}
+	if sb.Len() == 0 {
+		return nil, fmt.Errorf("no text in response: %s", finishReason(last))
+	}
+	// Every chunk has the usage so far
+	return &llm.ChatResponse{Content: sb.String(), Usage: usage(last)}, nil
+}
+
+// usage returns the token counts of a response
+func usage(resp *genai.GenerateContentResponse) llm.Usage {
+	if u := resp.UsageMetadata; u != nil {
+		return llm.Usage{
+			PromptTokens:     int(u.PromptTokenCount),
+			CompletionTokens: int(u.CandidatesTokenCount),
+		}
+	}
+	return llm.Usage{}
+}
+
+// finishReason explains why a response has no content
+func finishReason(resp *genai.GenerateContentResponse) string {
+	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		return "prompt blocked, " + string(resp.PromptFeedback.BlockReason)
+	}
+	if len(resp.Candidates) == 0 {
+		return "no candidates"
+	}
+	return "finish reason " + string(resp.Candidates[0].FinishReason)
+}
+
+// CountTokens implements llm.TokenCounter
+func (c *Client) CountTokens(ctx context.Context, model, text string) (int, error) {
+	resp, err := c.sdkClient.Models.CountTokens(ctx, model, genai.Text(text), nil)
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.TotalTokens), nil
+}
@@ -0,0 +1,74 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/pkg/llm"
+)
+
+func TestChat(t *testing.T) {
+	var got struct {
+		Contents []struct {
+			Role  string `json:"role"`
+			Parts []struct {
+				Text string `json:"text"`
+			} `json:"parts"`
+		} `json:"contents"`
+		SystemInstruction struct {
+			Parts []struct {
+				Text string `json:"text"`
+			} `json:"parts"`
+		} `json:"systemInstruction"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/models/gemini-test:generateContent") {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"candidates": [{"content": {"role": "model", "parts": [{"text": "four"}]}, "finishReason": "STOP"}],
+			"usageMetadata": {"promptTokenCount": 12, "candidatesTokenCount": 1}
+		}`))
+	}))
+	defer srv.Close()
+
+	p, err := New(conf.ProviderConfig{Endpoint: srv.URL, Key: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.Chat(context.Background(), &llm.ChatRequest{
+		Model:  "gemini-test",
+		System: "Answer in words.",
+		Messages: []llm.Message{
+			{Role: llm.RoleUser, Content: "1+1?"},
+			{Role: llm.RoleAssistant, Content: "two"},
+			{Role: llm.RoleUser, Content: "2+2?"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "four" || resp.Usage.PromptTokens != 12 || resp.Usage.CompletionTokens != 1 {
+		t.Errorf("response = %+v", resp)
+	}
+
+	var roles []string
+	for _, c := range got.Contents {
+		roles = append(roles, c.Role+":"+c.Parts[0].Text)
+	}
+	if want := "user:1+1? model:two user:2+2?"; strings.Join(roles, " ") != want {
+		t.Errorf("contents = %v, want %s", roles, want)
+	}
+	if len(got.SystemInstruction.Parts) != 1 || got.SystemInstruction.Parts[0].Text != "Answer in words." {
+		t.Errorf("system instruction = %+v", got.SystemInstruction)
+	}
+}
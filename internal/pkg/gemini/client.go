@@ -6,64 +6,55 @@ import (
 
 	"butterfly.orx.me/core/log"
 	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/pkg/llm"
 	"google.golang.org/genai"
 )
 
-var (
-	client *Client
-)
-
-func GetClient() *Client {
-	return client
+func init() {
+	llm.RegisterType("gemini", New)
 }
 
-func Init() error {
-	ctx := context.Background()
+// Client is the Gemini API provider
+type Client struct {
+	sdkClient *genai.Client
+}
 
+// New creates the Gemini API provider
+func New(c conf.ProviderConfig) (llm.Provider, error) {
+	config := &genai.ClientConfig{
+		APIKey:  c.Key,
+		Backend: genai.BackendGeminiAPI,
+	}
+	if keys := llm.Keys(c); len(keys) > 0 {
+		// The SDK needs a key, the pool replaces it in every request
+		config.APIKey = keys[0]
+		config.HTTPClient = llm.NewKeyPool(c.Name, keys, llm.SetHeader("x-goog-api-key")).Client()
+	}
 	// If a custom endpoint is configured, set it
-	if conf.Conf.PictureVendor.Endpoint != "" {
-		genai.SetDefaultBaseURLs(genai.BaseURLParameters{
-			GeminiURL: conf.Conf.PictureVendor.Endpoint,
-			VertexURL: conf.Conf.PictureVendor.Endpoint,
-		})
+	if c.Endpoint != "" {
+		config.HTTPOptions.BaseURL = c.Endpoint
 	}
 
-	sdkClient, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey:  conf.Conf.PictureVendor.Key,
-		Backend: genai.BackendGeminiAPI,
-	})
+	sdkClient, err := genai.NewClient(context.Background(), config)
 	if err != nil {
-		return fmt.Errorf("failed to create Gemini client: %w", err)
-	}
-
-	client = &Client{
-		sdkClient: sdkClient,
+		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
 	}
-	return nil
-}
-
-// Client wraps the Gemini SDK client
-type Client struct {
-	sdkClient *genai.Client
+	return &Client{sdkClient: sdkClient}, nil
 }
 
-// GenerateImageRequest represents parameters for image generation
-type GenerateImageRequest struct {
-	Prompt      string
-	Temperature float64
-	TopK        int
-	TopP        float64
+// Capabilities implements llm.Provider
+func (c *Client) Capabilities() llm.Capability {
+	return llm.CapChat | llm.CapImage
 }
 
-// GenerateImageResponse represents the result of image generation
-type GenerateImageResponse struct {
-	ImageData    string // Base64 encoded image
-	MimeType     string
-	FinishReason string
+// Embed implements llm.Provider
+func (c *Client) Embed(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	return nil, llm.ErrUnsupported
 }
 
-// GenerateImage generates an image using the Gemini image preview model
-func (c *Client) GenerateImage(ctx context.Context, req GenerateImageRequest) (*GenerateImageResponse, error) {
+// GenerateImage implements llm.Provider with an image generating model such
+// as gemini-3-pro-image-preview
+func (c *Client) GenerateImage(ctx context.Context, req *llm.ImageRequest) (*llm.Image, error) {
 	logger := log.FromContext(ctx).With("method", "GenerateImage")
 
 	const maxRetries = 3
@@ -104,7 +95,7 @@ func (c *Client) GenerateImage(ctx context.Context, req GenerateImageRequest) (*
 		// Call the Gemini API
 		resp, err := c.sdkClient.Models.GenerateContent(
 			ctx,
-			"gemini-3-pro-image-preview",
+			req.Model,
 			contents,
 			config,
 		)
@@ -170,9 +161,9 @@ func (c *Client) GenerateImage(ctx context.Context, req GenerateImageRequest) (*
 			"data_length", len(imageData.Data),
 			"attempt", attempt)
 
-		return &GenerateImageResponse{
-			ImageData:    string(imageData.Data),
-			MimeType:     imageData.MIMEType,
+		return &llm.Image{
+			Data:         imageData.Data,
+			MIMEType:     imageData.MIMEType,
 			FinishReason: string(candidate.FinishReason),
 		}, nil
 	}
@@ -0,0 +1,127 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"butterfly.orx.me/core/log"
+)
+
+const (
+	// condensePrompt summarises a chunk of texts in the map and reduce steps
+	condensePrompt = "Summarise the following chat messages or summaries concisely. Keep who said what, the topics, questions, decisions and facts. Write the summary in the language of the messages."
+	// maxCondenseChunks bounds the model calls of the first step, texts
+	// older than what these chunks hold are left out
+	maxCondenseChunks = 16
+	// maxCondenseDepth bounds the reduce steps
+	maxCondenseDepth = 4
+	// condenseConcurrency is the number of chunks summarised at once
+	condenseConcurrency = 4
+)
+
+// Condensed is a history fitted in a budget
+type Condensed struct {
+	// Summary summarises the texts left out of Recent, empty when they all fit
+	Summary string
+	// Recent are the most recent texts, as they are
+	Recent []string
+}
+
+// Condense fits texts, oldest first, in the budget of a request of a task.
+// The most recent texts are kept as they are and, when they do not all fit,
+// the older ones are summarised map-reduce with the models of the task: every
+// chunk of them fitting in the budget is summarised, then the summaries, until
+// a single one is left. The summary requests are made for the ChatID and
+// UserID of req. When summarising fails, the error is returned with the
+// recent texts.
+func Condense(ctx context.Context, task Task, req ChatRequest, counter *Counter, texts []string, budget int) (*Condensed, error) {
+	start := counter.Recent(texts, budget)
+	if start == 0 {
+		return &Condensed{Recent: texts}, nil
+	}
+
+	// A quarter of the budget is left for the summary of the older texts
+	summaryBudget := budget / 4
+	start = counter.Recent(texts, budget-summaryBudget)
+	condensed := &Condensed{Recent: texts[start:]}
+
+	chunkBudget := budget - counter.Count(condensePrompt)
+	older := texts[:start]
+	chunks := counter.Chunk(older, chunkBudget)
+	if len(chunks) > maxCondenseChunks {
+		chunks = chunks[len(chunks)-maxCondenseChunks:]
+	}
+
+	log.FromContext(ctx).Info("Condensing history",
+		"task", task,
+		"recent", len(condensed.Recent),
+		"older", len(older),
+		"chunks", len(chunks))
+
+	summary, err := reduce(ctx, task, req, counter, chunks, chunkBudget, 1)
+	if err != nil {
+		return condensed, err
+	}
+	condensed.Summary = counter.Truncate(summary, summaryBudget)
+	return condensed, nil
+}
+
+// HistoryBudget returns the tokens of history worth reading for a request of a
+// task for a chat: what fits in its context and the older texts Condense can
+// summarise before it
+func HistoryBudget(chatID int64, task Task) int {
+	return ContextBudget(chatID, task) * (maxCondenseChunks + 1)
+}
+
+// reduce summarises the chunks, then their summaries, until one is left
+func reduce(ctx context.Context, task Task, req ChatRequest, counter *Counter, chunks [][]string, budget, depth int) (string, error) {
+	summaries, err := summarizeChunks(ctx, task, req, chunks)
+	if err != nil {
+		return "", err
+	}
+	if len(summaries) == 1 {
+		return summaries[0], nil
+	}
+	if depth >= maxCondenseDepth {
+		return strings.Join(summaries, "\n\n"), nil
+	}
+	return reduce(ctx, task, req, counter, counter.Chunk(summaries, budget), budget, depth+1)
+}
+
+// summarizeChunks summarises each chunk, a few at a time
+func summarizeChunks(ctx context.Context, task Task, req ChatRequest, chunks [][]string) ([]string, error) {
+	var (
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, condenseConcurrency)
+		summaries = make([]string, len(chunks))
+		errs      = make([]error, len(chunks))
+	)
+	for i, chunk := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			resp, err := Chat(ctx, task, ChatRequest{
+				ChatID:   req.ChatID,
+				UserID:   req.UserID,
+				System:   condensePrompt,
+				Messages: []Message{{Role: RoleUser, Content: strings.Join(chunk, "\n")}},
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("chunk %d of %d: %w", i+1, len(chunks), err)
+				return
+			}
+			summaries[i] = resp.Content
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return summaries, nil
+}
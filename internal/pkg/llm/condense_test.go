@@ -0,0 +1,117 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"go.orx.me/xbot/internal/conf"
+)
+
+// summarizer answers with the number of lines it summarised and counts twice
+// as many tokens as estimated
+type summarizer struct {
+	calls atomic.Int32
+}
+
+func (p *summarizer) Capabilities() Capability { return CapChat }
+
+func (p *summarizer) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	p.calls.Add(1)
+	lines := strings.Count(req.Messages[0].Content, "\n") + 1
+	return &ChatResponse{Content: fmt.Sprintf("summary of %d lines", lines)}, nil
+}
+
+func (p *summarizer) GenerateImage(ctx context.Context, req *ImageRequest) (*Image, error) {
+	return nil, ErrUnsupported
+}
+
+func (p *summarizer) Embed(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	return nil, ErrUnsupported
+}
+
+func (p *summarizer) CountTokens(ctx context.Context, model, text string) (int, error) {
+	return 2 * EstimateTokens(text), nil
+}
+
+func setupSummarizer(t *testing.T, window int) *summarizer {
+	t.Helper()
+	p := &summarizer{}
+	RegisterType("summarizer", func(conf.ProviderConfig) (Provider, error) { return p, nil })
+
+	old := *conf.Conf
+	t.Cleanup(func() { *conf.Conf = old })
+	conf.Conf.Providers = []conf.ProviderConfig{{
+		Name:           "s",
+		Type:           "summarizer",
+		ContextWindow:  window,
+		ContextWindows: map[string]int{"big": 100000},
+	}}
+	conf.Conf.Models = conf.ModelsConfig{Summary: []string{"s:small"}, Chat: []string{"s:big"}}
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestContextBudget(t *testing.T) {
+	setupSummarizer(t, 400)
+
+	if got := ContextBudget(0, TaskSummary); got != 300 {
+		t.Errorf("summary budget = %d, want 300", got)
+	}
+	if got := ContextBudget(0, TaskChat); got != 100000-defaultAnswerTokens {
+		t.Errorf("chat budget = %d", got)
+	}
+	if got := HistoryBudget(0, TaskSummary); got != 300*(maxCondenseChunks+1) {
+		t.Errorf("summary history budget = %d", got)
+	}
+
+	c := NewCounter(context.Background(), 0, TaskSummary, "some sample text")
+	if got := c.Count("abcdefgh"); got != 4 {
+		t.Errorf("calibrated Count = %d, want 4", got)
+	}
+}
+
+func TestCondense(t *testing.T) {
+	p := setupSummarizer(t, 400)
+	ctx := context.Background()
+	budget := ContextBudget(0, TaskSummary)
+
+	var texts []string
+	for i := range 100 {
+		texts = append(texts, fmt.Sprintf("user%d: message number %d with a few words", i, i))
+	}
+
+	short, err := Condense(ctx, TaskSummary, ChatRequest{}, nil, texts[:3], budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if short.Summary != "" || len(short.Recent) != 3 || p.calls.Load() != 0 {
+		t.Errorf("texts fitting the budget were condensed: %+v", short)
+	}
+
+	condensed, err := Condense(ctx, TaskSummary, ChatRequest{}, nil, texts, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent := condensed.Recent
+	if len(recent) == 0 || len(recent) >= len(texts) || recent[len(recent)-1] != texts[len(texts)-1] {
+		t.Fatalf("recent = %q", recent)
+	}
+	// The chunks of older texts are summarised, then their summaries
+	if !strings.HasPrefix(condensed.Summary, "summary of ") || p.calls.Load() < 3 {
+		t.Errorf("summary = %q after %d calls", condensed.Summary, p.calls.Load())
+	}
+
+	var c *Counter
+	used := c.Count(condensed.Summary)
+	for _, text := range recent {
+		used += c.Count(text) + 1
+	}
+	if used > budget {
+		t.Errorf("condensed history uses %d tokens of %d", used, budget)
+	}
+}
@@ -0,0 +1,201 @@
+package llm
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/metrics"
+)
+
+const (
+	// benchBase is how long a key is benched after its first 401 or 429,
+	// doubled with every failure in a row up to benchMax
+	benchBase = 10 * time.Second
+	benchMax  = 10 * time.Minute
+)
+
+// Keys returns the API keys of a provider, Key first
+func Keys(c conf.ProviderConfig) []string {
+	var keys []string
+	for _, k := range append([]string{c.Key}, c.Keys...) {
+		if k != "" && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// KeyPool is an http.RoundTripper spreading the requests of a provider over
+// its API keys in turn. A key answered with 401 or 429 is benched for a
+// while and the request is retried with the next key.
+type KeyPool struct {
+	provider string
+	keys     []*poolKey
+	setKey   func(req *http.Request, key string)
+	base     http.RoundTripper
+	now      func() time.Time
+
+	mu   sync.Mutex
+	next int
+}
+
+// poolKey is a key of a pool
+type poolKey struct {
+	key string
+	// label is the position of the key in Keys, keys are never in metrics
+	label        string
+	failures     int
+	benchedUntil time.Time
+}
+
+// NewKeyPool creates the pool of the keys of a provider, setKey puts a key in
+// a request
+func NewKeyPool(provider string, keys []string, setKey func(req *http.Request, key string)) *KeyPool {
+	p := &KeyPool{
+		provider: provider,
+		setKey:   setKey,
+		base:     otelhttp.NewTransport(http.DefaultTransport),
+		now:      time.Now,
+	}
+	for i, k := range keys {
+		p.keys = append(p.keys, &poolKey{key: k, label: strconv.Itoa(i)})
+	}
+	return p
+}
+
+// SetBearer puts a key in the Authorization header
+func SetBearer(req *http.Request, key string) {
+	req.Header.Set("Authorization", "Bearer "+key)
+}
+
+// SetHeader returns a setKey func putting a key in a header
+func SetHeader(name string) func(req *http.Request, key string) {
+	return func(req *http.Request, key string) {
+		req.Header.Set(name, key)
+	}
+}
+
+// Client returns an HTTP client sending its requests through the pool
+func (p *KeyPool) Client() *http.Client {
+	return &http.Client{Transport: p}
+}
+
+// pick returns the next key in turn that is not benched, or the key back the
+// soonest when all are
+func (p *KeyPool) pick() *poolKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	for i := range p.keys {
+		k := p.keys[(p.next+i)%len(p.keys)]
+		if !k.benchedUntil.After(now) {
+			p.next = (p.next + i + 1) % len(p.keys)
+			return k
+		}
+	}
+	soonest := p.keys[0]
+	for _, k := range p.keys[1:] {
+		if k.benchedUntil.Before(soonest.benchedUntil) {
+			soonest = k
+		}
+	}
+	return soonest
+}
+
+// available reports whether a key is not benched
+func (p *KeyPool) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	for _, k := range p.keys {
+		if !k.benchedUntil.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// report records the response status of a request made with a key, zero
+// when the request failed without one
+func (p *KeyPool) report(k *poolKey, status int, retryAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := "error"
+	switch {
+	case status == http.StatusUnauthorized:
+		result = "unauthorized"
+	case status == http.StatusTooManyRequests:
+		result = "rate_limited"
+	case status > 0 && status < 400:
+		result = "ok"
+	}
+	metrics.LLMKeyRequests.WithLabelValues(p.provider, k.label, result).Inc()
+
+	switch result {
+	case "unauthorized", "rate_limited":
+		k.failures++
+		bench := min(benchBase<<min(k.failures-1, 16), benchMax)
+		bench = max(bench, retryAfter)
+		k.benchedUntil = p.now().Add(bench)
+		metrics.LLMKeyBenched.WithLabelValues(p.provider, k.label).Set(1)
+	case "ok":
+		if k.failures > 0 || !k.benchedUntil.IsZero() {
+			k.failures = 0
+			k.benchedUntil = time.Time{}
+			metrics.LLMKeyBenched.WithLabelValues(p.provider, k.label).Set(0)
+		}
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (p *KeyPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		k := p.pick()
+		r := req.Clone(req.Context())
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		p.setKey(r, k.key)
+
+		resp, err := p.base.RoundTrip(r)
+		if err != nil {
+			p.report(k, 0, 0)
+			return nil, err
+		}
+		p.report(k, resp.StatusCode, retryAfter(resp))
+
+		if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		// Retry with another key while one is available
+		if attempt >= len(p.keys) || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		if !p.available() {
+			return resp, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}
+}
+
+// retryAfter returns the delay of the Retry-After header in seconds, zero
+// without one
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyPool(t *testing.T) {
+	var (
+		used    []string
+		limited = map[string]bool{"b": true}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		used = append(used, key)
+		switch {
+		case key == "bad":
+			w.WriteHeader(http.StatusUnauthorized)
+		case limited[key]:
+			limited[key] = false
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	pool := NewKeyPool("test", []string{"a", "b", "c"}, SetBearer)
+	pool.now = func() time.Time { return now }
+	client := pool.Client()
+	post := func() int {
+		t.Helper()
+		resp, err := client.Post(srv.URL, "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for i := 0; i < 4; i++ {
+		if status := post(); status != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, status)
+		}
+	}
+	// b is rate limited, the request is retried with c and b is skipped until
+	// its bench is over
+	if got := strings.Join(used, ","); got != "a,b,c,a,c" {
+		t.Errorf("keys used = %s", got)
+	}
+
+	used = nil
+	now = now.Add(benchBase + time.Second)
+	post()
+	post()
+	if got := strings.Join(used, ","); got != "a,b" {
+		t.Errorf("keys used after the bench = %s", got)
+	}
+}
+
+func TestKeyPoolAllBenched(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	pool := NewKeyPool("test", []string{"bad", "worse"}, SetBearer)
+	resp, err := pool.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want the 401 of the last key", resp.StatusCode)
+	}
+	if pool.available() {
+		t.Error("keys answered with 401 are not benched")
+	}
+}
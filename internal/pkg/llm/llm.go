@@ -0,0 +1,134 @@
+// Package llm hides the language and image model backends behind a Provider
+// interface. Providers are created from the configuration and handlers ask for
+// the models of a task, e.g. the summary or the image model, instead of a
+// concrete client.
+package llm
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnsupported is returned by providers for requests they cannot serve
+var ErrUnsupported = errors.New("not supported by the provider")
+
+// Capability is a kind of request a provider serves
+type Capability uint
+
+const (
+	CapChat Capability = 1 << iota
+	CapImage
+	CapEmbedding
+)
+
+// Has reports whether all of the capabilities c2 are in c
+func (c Capability) Has(c2 Capability) bool {
+	return c&c2 == c2
+}
+
+// Role is the author of a chat message
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+// Message is a turn of a conversation
+type Message struct {
+	Role    Role
+	Content string
+	// Images are shown to the model along with the content
+	Images []ImageInput
+}
+
+// ImageInput is an image in a message
+type ImageInput struct {
+	MIMEType string
+	Data     []byte
+}
+
+// ChatRequest is a chat completion request
+type ChatRequest struct {
+	// ChatID is the chat the request is made for, it selects the chat route
+	ChatID int64
+	// UserID is the user the request is made for, its usage is accounted to
+	// them, 0 for none
+	UserID int64
+	Model  string
+	// System is the system prompt, empty for none
+	System   string
+	Messages []Message
+}
+
+// Usage is the number of tokens a request took
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// ChatResponse is the result of a chat completion
+type ChatResponse struct {
+	Content string
+	// Model is the model that answered, as configured
+	Model string
+	Usage Usage
+}
+
+// ImageRequest is an image generation request
+type ImageRequest struct {
+	// ChatID is the chat the request is made for, it selects the chat route
+	ChatID int64
+	// UserID is the user the request is made for, 0 for none
+	UserID int64
+	Model  string
+	Prompt string
+	// Sampling parameters, zero uses the defaults of the provider
+	Temperature float64
+	TopK        int
+	TopP        float64
+}
+
+// Image is a generated image
+type Image struct {
+	Data     []byte
+	MIMEType string
+	// Model is the model that drew the image, as configured
+	Model        string
+	FinishReason string
+}
+
+// Provider is a model backend
+type Provider interface {
+	// Capabilities returns the kinds of requests the provider serves
+	Capabilities() Capability
+	// Chat completes a conversation
+	Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error)
+	// GenerateImage draws an image from a prompt
+	GenerateImage(ctx context.Context, req *ImageRequest) (*Image, error)
+	// Embed returns the embedding of each input, in order
+	Embed(ctx context.Context, model string, inputs []string) ([][]float32, error)
+}
+
+// Streamer is implemented by providers streaming chat completions
+type Streamer interface {
+	// ChatStream completes a conversation like Chat, calling delta with each
+	// piece of the answer as it is generated
+	ChatStream(ctx context.Context, req *ChatRequest, delta func(string)) (*ChatResponse, error)
+}
+
+// ModelLister is implemented by providers listing the models they serve
+type ModelLister interface {
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// TokenCounter is implemented by providers counting tokens with the tokenizer
+// of a model
+type TokenCounter interface {
+	CountTokens(ctx context.Context, model, text string) (int, error)
+}
+
+// HealthChecker is implemented by providers checking their backend is up
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
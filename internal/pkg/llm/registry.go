@@ -0,0 +1,368 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"butterfly.orx.me/core/log"
+	"go.orx.me/xbot/internal/conf"
+)
+
+// defaultImageModel draws images when no image model is configured
+const defaultImageModel = "gemini:gemini-3-pro-image-preview"
+
+// Factory creates a provider from its configuration
+type Factory func(c conf.ProviderConfig) (Provider, error)
+
+// entry is a created provider
+type entry struct {
+	Provider
+	config conf.ProviderConfig
+}
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{}
+	providers = map[string]*entry{}
+	// defaultProvider serves models without a provider name
+	defaultProvider string
+)
+
+// RegisterType makes a provider implementation available as a type in the
+// configuration
+func RegisterType(typ string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[typ] = factory
+}
+
+// Init creates the configured providers
+func Init() error {
+	created := make(map[string]*entry)
+	configs := providerConfigs()
+	for _, c := range configs {
+		if _, ok := created[c.Name]; ok {
+			return fmt.Errorf("duplicate provider %q", c.Name)
+		}
+		mu.RLock()
+		factory, ok := factories[c.Type]
+		mu.RUnlock()
+		if !ok {
+			return fmt.Errorf("provider %q: unknown type %q", c.Name, c.Type)
+		}
+		p, err := factory(c)
+		if err != nil {
+			return fmt.Errorf("provider %q: %w", c.Name, err)
+		}
+		created[c.Name] = &entry{Provider: p, config: c}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	providers = created
+	defaultProvider = ""
+	if len(configs) > 0 {
+		defaultProvider = configs[0].Name
+	}
+	return nil
+}
+
+// providerConfigs returns the configured providers. Without any, the openAI
+// settings are the "openai" provider and the pictureVendor settings the
+// "gemini" one.
+func providerConfigs() []conf.ProviderConfig {
+	if len(conf.Conf.Providers) > 0 {
+		return conf.Conf.Providers
+	}
+	return []conf.ProviderConfig{
+		{
+			Name:     "openai",
+			Type:     "openai",
+			Endpoint: conf.Conf.OpenAI.Endpoint,
+			Key:      conf.Conf.OpenAI.Key,
+			Keys:     conf.Conf.OpenAI.Keys,
+		},
+		{
+			Name:     "gemini",
+			Type:     "gemini",
+			Endpoint: conf.Conf.PictureVendor.Endpoint,
+			Key:      conf.Conf.PictureVendor.Key,
+			Keys:     conf.Conf.PictureVendor.Keys,
+		},
+	}
+}
+
+// Task is what a model is used for
+type Task string
+
+const (
+	TaskChat      Task = "chat"
+	TaskSummary   Task = "summary"
+	TaskImage     Task = "image"
+	TaskEmbedding Task = "embedding"
+)
+
+// taskModels returns the models of a task listed in the configuration
+func taskModels(models conf.ModelsConfig, task Task) []string {
+	switch task {
+	case TaskChat:
+		return models.Chat
+	case TaskSummary:
+		return models.Summary
+	case TaskImage:
+		return models.Image
+	case TaskEmbedding:
+		if models.Embedding != "" {
+			return []string{models.Embedding}
+		}
+	}
+	return nil
+}
+
+// Models returns the models of a task in the order they are tried
+func Models(task Task) []string {
+	models := taskModels(conf.Conf.Models, task)
+	if len(models) == 0 {
+		switch task {
+		case TaskChat:
+			models = []string{conf.Conf.OpenAI.Model}
+		case TaskSummary:
+			models = conf.Conf.SummaryModels
+			if len(models) == 0 {
+				models = []string{conf.Conf.OpenAI.Model}
+			}
+		case TaskImage:
+			models = []string{defaultImageModel}
+		case TaskEmbedding:
+			models = []string{conf.Conf.Embedding.Model}
+		}
+	}
+	return nonEmpty(models)
+}
+
+// route returns the chat route of a chat, nil when it has none
+func route(chatID int64) *conf.ChatRouteConfig {
+	for i, r := range conf.Conf.ChatRoutes {
+		if slices.Contains(r.ChatIDs, chatID) {
+			return &conf.Conf.ChatRoutes[i]
+		}
+	}
+	return nil
+}
+
+// LocalOnly reports whether the requests made for a chat must stay in our
+// network
+func LocalOnly(chatID int64) bool {
+	r := route(chatID)
+	return r != nil && r.LocalOnly
+}
+
+// ModelsFor returns the models of a task for requests made for a chat
+func ModelsFor(chatID int64, task Task) []string {
+	if r := route(chatID); r != nil {
+		if models := nonEmpty(taskModels(r.Models, task)); len(models) > 0 {
+			return models
+		}
+	}
+	return Models(task)
+}
+
+// nonEmpty drops empty model names
+func nonEmpty(models []string) []string {
+	configured := make([]string, 0, len(models))
+	for _, m := range models {
+		if m != "" {
+			configured = append(configured, m)
+		}
+	}
+	return configured
+}
+
+// Resolve returns the provider of a model and the model name it knows it by.
+// A model is "provider:model", anything else is a model of the first
+// provider, so names like "llama3:8b" still work.
+func Resolve(model string) (Provider, string, error) {
+	e, name, err := lookup(model)
+	if err != nil {
+		return nil, "", err
+	}
+	return e.Provider, name, nil
+}
+
+// lookup is Resolve returning the provider entry
+func lookup(model string) (*entry, string, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if name, rest, ok := strings.Cut(model, ":"); ok {
+		if e, ok := providers[name]; ok {
+			return e, rest, nil
+		}
+	}
+	e, ok := providers[defaultProvider]
+	if !ok {
+		return nil, "", fmt.Errorf("no provider for model %q", model)
+	}
+	return e, model, nil
+}
+
+// resolve is Resolve for a request made for a chat needing the capability,
+// chats routed to local providers only get local ones
+func resolve(chatID int64, model string, capability Capability) (Provider, string, error) {
+	e, name, err := lookup(model)
+	if err != nil {
+		return nil, "", err
+	}
+	if !e.Capabilities().Has(capability) {
+		return nil, "", fmt.Errorf("model %q: %w", model, ErrUnsupported)
+	}
+	if LocalOnly(chatID) && !e.config.Local {
+		return nil, "", fmt.Errorf("model %q is not local, chat %d only uses local providers", model, chatID)
+	}
+	return e.Provider, name, nil
+}
+
+// Chat runs the request on the models of the task for its chat in order
+// until one succeeds. The Model of the request is ignored.
+func Chat(ctx context.Context, task Task, req ChatRequest) (*ChatResponse, error) {
+	return chat(ctx, task, req, nil)
+}
+
+// ChatStream is Chat calling delta with each piece of the answer as it is
+// generated. Providers that do not stream give the answer in one piece. Once
+// a model has given part of an answer, the next models are not tried.
+func ChatStream(ctx context.Context, task Task, req ChatRequest, delta func(string)) (*ChatResponse, error) {
+	return chat(ctx, task, req, delta)
+}
+
+// chat runs Chat, streaming the answer to delta when not nil
+func chat(ctx context.Context, task Task, req ChatRequest, delta func(string)) (*ChatResponse, error) {
+	logger := log.FromContext(ctx).With("method", "Chat", "task", task)
+
+	models := ModelsFor(req.ChatID, task)
+	lastErr := fmt.Errorf("no %s model configured", task)
+	for _, model := range models {
+		p, name, err := resolve(req.ChatID, model, CapChat)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		logger.Info("Attempting to use model", "model", model, "stream", delta != nil)
+		req.Model = name
+		var (
+			resp     *ChatResponse
+			streamed bool
+			start    = time.Now()
+		)
+		if s, ok := p.(Streamer); ok && delta != nil {
+			resp, err = s.ChatStream(ctx, &req, func(text string) {
+				streamed = true
+				delta(text)
+			})
+		} else {
+			resp, err = p.Chat(ctx, &req)
+			if err == nil && delta != nil {
+				delta(resp.Content)
+			}
+		}
+		rec := &Record{ChatID: req.ChatID, UserID: req.UserID, Task: task, Model: model, Latency: time.Since(start), Err: err}
+		if err == nil {
+			rec.Usage = resp.Usage
+		}
+		record(ctx, rec)
+		if err != nil {
+			lastErr = fmt.Errorf("model %q: %w", model, err)
+			logger.Error("Chat failed with model",
+				"model", model,
+				"error", err)
+			if streamed {
+				return nil, lastErr
+			}
+			continue
+		}
+		resp.Model = model
+		logger.Info("Successfully used model",
+			"model", model,
+			"responseLength", len(resp.Content),
+		)
+		return resp, nil
+	}
+
+	logger.Error("All models failed",
+		"attemptedModels", models,
+		"lastError", lastErr)
+	return nil, lastErr
+}
+
+// GenerateImage draws the image with the image models for its chat in order
+// until one succeeds. The Model of the request is ignored.
+func GenerateImage(ctx context.Context, req ImageRequest) (*Image, error) {
+	logger := log.FromContext(ctx).With("method", "GenerateImage")
+
+	lastErr := fmt.Errorf("no %s model configured", TaskImage)
+	for _, model := range ModelsFor(req.ChatID, TaskImage) {
+		p, name, err := resolve(req.ChatID, model, CapImage)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		req.Model = name
+		start := time.Now()
+		img, err := p.GenerateImage(ctx, &req)
+		rec := &Record{ChatID: req.ChatID, UserID: req.UserID, Task: TaskImage, Model: model, Latency: time.Since(start), Err: err}
+		if err == nil {
+			rec.Images = 1
+		}
+		record(ctx, rec)
+		if err != nil {
+			lastErr = fmt.Errorf("model %q: %w", model, err)
+			logger.Error("GenerateImage failed with model",
+				"model", model,
+				"error", err)
+			continue
+		}
+		img.Model = model
+		return img, nil
+	}
+	return nil, lastErr
+}
+
+// EmbeddingModel returns the model computing the embeddings of the messages
+// of a chat, empty when the chat has none. There is no fallback, embeddings of
+// different models cannot be compared.
+func EmbeddingModel(chatID int64) string {
+	models := ModelsFor(chatID, TaskEmbedding)
+	if len(models) == 0 {
+		return ""
+	}
+	if _, _, err := resolve(chatID, models[0], CapEmbedding); err != nil {
+		return ""
+	}
+	return models[0]
+}
+
+// Embed returns the embedding of each input, in order, with the embedding
+// model of a chat
+func Embed(ctx context.Context, chatID int64, model string, inputs []string) ([][]float32, error) {
+	p, name, err := resolve(chatID, model, CapEmbedding)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	embeddings, err := p.Embed(ctx, name, inputs)
+
+	// Embedding APIs do not all report usage, the inputs are estimated
+	rec := &Record{ChatID: chatID, Task: TaskEmbedding, Model: model, Latency: time.Since(start), Err: err}
+	if err == nil {
+		for _, input := range inputs {
+			rec.Usage.PromptTokens += EstimateTokens(input)
+		}
+	}
+	record(ctx, rec)
+	return embeddings, err
+}
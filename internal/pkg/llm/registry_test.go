@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.orx.me/xbot/internal/conf"
+)
+
+// fakeProvider answers chat requests with the model name, failing for the
+// models in fail
+type fakeProvider struct {
+	capabilities Capability
+	fail         map[string]bool
+}
+
+func (p *fakeProvider) Capabilities() Capability { return p.capabilities }
+
+func (p *fakeProvider) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	if p.fail[req.Model] {
+		return nil, errors.New("unavailable")
+	}
+	return &ChatResponse{Content: req.Model}, nil
+}
+
+func (p *fakeProvider) GenerateImage(ctx context.Context, req *ImageRequest) (*Image, error) {
+	return &Image{Data: []byte(req.Model)}, nil
+}
+
+func (p *fakeProvider) Embed(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	return nil, ErrUnsupported
+}
+
+func setupProviders(t *testing.T, configs []conf.ProviderConfig, models conf.ModelsConfig) {
+	t.Helper()
+	fakes := map[string]*fakeProvider{
+		"text":  {capabilities: CapChat, fail: map[string]bool{"down": true}},
+		"image": {capabilities: CapImage},
+	}
+	for typ, p := range fakes {
+		RegisterType(typ, func(conf.ProviderConfig) (Provider, error) { return p, nil })
+	}
+
+	old := *conf.Conf
+	t.Cleanup(func() { *conf.Conf = old })
+	conf.Conf.Providers = configs
+	conf.Conf.Models = models
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChatFallback(t *testing.T) {
+	setupProviders(t, []conf.ProviderConfig{
+		{Name: "local", Type: "text"},
+		{Name: "pictures", Type: "image"},
+	}, conf.ModelsConfig{
+		// The image provider cannot chat and down fails, llama3:8b is a
+		// model of the first provider
+		Summary: []string{"pictures:draw", "local:down", "llama3:8b"},
+		Image:   []string{"local:x", "pictures:draw"},
+	})
+	ctx := context.Background()
+
+	resp, err := Chat(ctx, TaskSummary, ChatRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "llama3:8b" || resp.Model != "llama3:8b" {
+		t.Errorf("response = %+v", resp)
+	}
+
+	img, err := GenerateImage(ctx, ImageRequest{Prompt: "cat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(img.Data) != "draw" || img.Model != "pictures:draw" {
+		t.Errorf("image = %+v", img)
+	}
+
+	if _, err := Embed(ctx, 0, "local:embed", []string{"a"}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Embed error = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestChatAllModelsFail(t *testing.T) {
+	setupProviders(t, []conf.ProviderConfig{{Name: "local", Type: "text"}},
+		conf.ModelsConfig{Chat: []string{"local:down"}})
+
+	if _, err := Chat(context.Background(), TaskChat, ChatRequest{}); err == nil {
+		t.Error("Chat succeeded with every model failing")
+	}
+}
+
+func TestChatRoutes(t *testing.T) {
+	setupProviders(t, []conf.ProviderConfig{
+		{Name: "cloud", Type: "text"},
+		{Name: "home", Type: "text", Local: true},
+	}, conf.ModelsConfig{Summary: []string{"cloud:big"}})
+	conf.Conf.ChatRoutes = []conf.ChatRouteConfig{
+		{ChatIDs: []int64{1}, Models: conf.ModelsConfig{Summary: []string{"home:small"}}},
+		// The global models are not local, requests of chat 2 must fail
+		{ChatIDs: []int64{2}, LocalOnly: true},
+		{ChatIDs: []int64{3}, LocalOnly: true, Models: conf.ModelsConfig{Summary: []string{"cloud:big", "home:small"}}},
+	}
+	ctx := context.Background()
+
+	for chatID, want := range map[int64]string{0: "cloud:big", 1: "home:small", 3: "home:small"} {
+		resp, err := Chat(ctx, TaskSummary, ChatRequest{ChatID: chatID})
+		if err != nil {
+			t.Errorf("chat %d: %v", chatID, err)
+			continue
+		}
+		if resp.Model != want {
+			t.Errorf("chat %d answered by %s, want %s", chatID, resp.Model, want)
+		}
+	}
+	if resp, err := Chat(ctx, TaskSummary, ChatRequest{ChatID: 2}); err == nil {
+		t.Errorf("local only chat answered by %s", resp.Model)
+	}
+}
+
+func TestInitRejectsUnknownType(t *testing.T) {
+	old := *conf.Conf
+	defer func() { *conf.Conf = old }()
+	conf.Conf.Providers = []conf.ProviderConfig{{Name: "x", Type: "nope"}}
+	if err := Init(); err == nil {
+		t.Error("Init succeeded with an unknown provider type")
+	}
+}
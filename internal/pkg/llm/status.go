@@ -0,0 +1,79 @@
+package llm
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// healthTimeout bounds the checks of a provider
+const healthTimeout = 5 * time.Second
+
+// ProviderStatus describes a configured provider
+type ProviderStatus struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Local        bool     `json:"local"`
+	Capabilities []string `json:"capabilities"`
+	// Health is "ok", "down", or "unknown" for providers without a check
+	Health string `json:"health"`
+	Error  string `json:"error,omitempty"`
+	// Models are the models the provider serves, when it lists them
+	Models []string `json:"models,omitempty"`
+}
+
+// Status checks the health of the providers and lists their models
+func Status(ctx context.Context) []ProviderStatus {
+	mu.RLock()
+	entries := make([]*entry, 0, len(providers))
+	for _, e := range providers {
+		entries = append(entries, e)
+	}
+	mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].config.Name < entries[j].config.Name
+	})
+
+	statuses := make([]ProviderStatus, len(entries))
+	for i, e := range entries {
+		statuses[i] = status(ctx, e)
+	}
+	return statuses
+}
+
+// status checks a provider
+func status(ctx context.Context, e *entry) ProviderStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	s := ProviderStatus{
+		Name:   e.config.Name,
+		Type:   e.config.Type,
+		Local:  e.config.Local,
+		Health: "unknown",
+	}
+	for c, name := range map[Capability]string{CapChat: "chat", CapImage: "image", CapEmbedding: "embedding"} {
+		if e.Capabilities().Has(c) {
+			s.Capabilities = append(s.Capabilities, name)
+		}
+	}
+	sort.Strings(s.Capabilities)
+
+	if checker, ok := e.Provider.(HealthChecker); ok {
+		s.Health = "ok"
+		if err := checker.Health(ctx); err != nil {
+			s.Health = "down"
+			s.Error = err.Error()
+			return s
+		}
+	}
+	if lister, ok := e.Provider.(ModelLister); ok {
+		models, err := lister.ListModels(ctx)
+		if err != nil {
+			s.Error = err.Error()
+			return s
+		}
+		s.Models = models
+	}
+	return s
+}
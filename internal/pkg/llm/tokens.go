@@ -0,0 +1,219 @@
+package llm
+
+import (
+	"context"
+	"math"
+	"unicode/utf8"
+
+	"butterfly.orx.me/core/log"
+)
+
+const (
+	// defaultContextWindow is the context size of models without a
+	// configured one, small enough for most local models
+	defaultContextWindow = 16384
+	// defaultAnswerTokens is kept free in the context for the answer of
+	// models of providers without MaxTokens
+	defaultAnswerTokens = 4096
+	// calibrationSample is the number of bytes of a sample counted by the
+	// tokenizer of a model
+	calibrationSample = 32 << 10
+)
+
+// EstimateTokens estimates the number of tokens of a text, about four
+// characters of ASCII text and one of other scripts per token
+func EstimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// Counter counts tokens for the models of a task. It scales the estimate of
+// EstimateTokens by how far off it is for a sample counted with the tokenizer
+// of the model, when its provider is a TokenCounter. A nil Counter estimates.
+type Counter struct {
+	ratio float64
+}
+
+// NewCounter returns the counter of the first model of a task for a chat,
+// calibrated with a sample of the texts it will count
+func NewCounter(ctx context.Context, chatID int64, task Task, sample string) *Counter {
+	logger := log.FromContext(ctx).With("method", "NewCounter", "task", task)
+	c := &Counter{ratio: 1}
+
+	models := ModelsFor(chatID, task)
+	if len(models) == 0 || sample == "" {
+		return c
+	}
+	p, name, err := resolve(chatID, models[0], CapChat)
+	if err != nil {
+		return c
+	}
+	tc, ok := p.(TokenCounter)
+	if !ok {
+		return c
+	}
+
+	if len(sample) > calibrationSample {
+		// Cut at a rune boundary
+		end := calibrationSample
+		for end > 0 && !utf8.RuneStart(sample[end]) {
+			end--
+		}
+		sample = sample[:end]
+	}
+	n, err := tc.CountTokens(ctx, name, sample)
+	if err != nil {
+		logger.Error("Failed to count tokens, estimating them", "model", models[0], "error", err)
+		return c
+	}
+	if estimate := EstimateTokens(sample); estimate > 0 && n > 0 {
+		// A sample of a few words says little, keep the ratio sensible
+		c.ratio = min(max(float64(n)/float64(estimate), 0.25), 4)
+	}
+	logger.Debug("Calibrated token counter", "model", models[0], "ratio", c.ratio)
+	return c
+}
+
+// Count returns the number of tokens of a text
+func (c *Counter) Count(text string) int {
+	n := EstimateTokens(text)
+	if c == nil || c.ratio == 1 {
+		return n
+	}
+	return int(math.Ceil(float64(n) * c.ratio))
+}
+
+// messageTokens counts the tokens of a message, images excluded
+func (c *Counter) messageTokens(m Message) int {
+	// Every message costs a few tokens of its own for its role
+	return c.Count(m.Content) + 4
+}
+
+// Fit returns the most recent messages that fit in the budget. The last
+// message is always kept and the first one returned is a user message, as the
+// APIs expect.
+func (c *Counter) Fit(messages []Message, budget int) []Message {
+	if len(messages) == 0 {
+		return nil
+	}
+	start := len(messages) - 1
+	used := c.messageTokens(messages[start])
+	for start > 0 {
+		used += c.messageTokens(messages[start-1])
+		if used > budget {
+			break
+		}
+		start--
+	}
+	for start < len(messages)-1 && messages[start].Role != RoleUser {
+		start++
+	}
+	return messages[start:]
+}
+
+// FitBudget is Fit with estimated tokens
+func FitBudget(messages []Message, budget int) []Message {
+	return (*Counter)(nil).Fit(messages, budget)
+}
+
+// Recent returns the index of the first of the most recent texts that fit
+// in the budget together, one per line
+func (c *Counter) Recent(texts []string, budget int) int {
+	start := len(texts)
+	used := 0
+	for start > 0 {
+		used += c.Count(texts[start-1]) + 1
+		if used > budget {
+			break
+		}
+		start--
+	}
+	return start
+}
+
+// Chunk splits texts, in order, into chunks fitting in the budget one per
+// line. Texts longer than the budget are truncated.
+func (c *Counter) Chunk(texts []string, budget int) [][]string {
+	var (
+		chunks [][]string
+		chunk  []string
+		used   int
+	)
+	for _, text := range texts {
+		n := c.Count(text) + 1
+		if n > budget {
+			text = c.Truncate(text, budget-1)
+			n = c.Count(text) + 1
+		}
+		if used+n > budget && len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+			chunk, used = nil, 0
+		}
+		chunk = append(chunk, text)
+		used += n
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// Truncate returns the start of a text fitting in the budget
+func (c *Counter) Truncate(text string, budget int) string {
+	runes := []rune(text)
+	for len(runes) > 0 {
+		n := c.Count(string(runes))
+		if n <= budget {
+			break
+		}
+		// Shrink in proportion, by at least a rune
+		keep := len(runes) * max(budget, 0) / n
+		runes = runes[:min(keep, len(runes)-1)]
+	}
+	return string(runes)
+}
+
+// ContextWindow returns the context size of a model in tokens
+func ContextWindow(model string) int {
+	e, name, err := lookup(model)
+	if err != nil {
+		return defaultContextWindow
+	}
+	if n := e.config.ContextWindows[name]; n > 0 {
+		return n
+	}
+	if e.config.ContextWindow > 0 {
+		return e.config.ContextWindow
+	}
+	return defaultContextWindow
+}
+
+// ContextBudget returns the tokens the prompt of a request of a task for a
+// chat can use whichever model runs it: the smallest context window of the
+// models, less room for the answer
+func ContextBudget(chatID int64, task Task) int {
+	budget := 0
+	for _, model := range ModelsFor(chatID, task) {
+		window := ContextWindow(model)
+		answer := defaultAnswerTokens
+		if e, _, err := lookup(model); err == nil && e.config.MaxTokens > 0 {
+			answer = e.config.MaxTokens
+		}
+		// Small windows keep most of their room for the prompt
+		b := window - min(answer, window/4)
+		if budget == 0 || b < budget {
+			budget = b
+		}
+	}
+	if budget == 0 {
+		budget = defaultContextWindow - defaultAnswerTokens
+	}
+	return budget
+}
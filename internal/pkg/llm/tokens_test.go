@@ -0,0 +1,77 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	for text, want := range map[string]int{
+		"":         0,
+		"abcd":     1,
+		"abcde":    2,
+		"你好":       2,
+		"hi 你好 hi": 4,
+	} {
+		if got := EstimateTokens(text); got != want {
+			t.Errorf("EstimateTokens(%q) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+func TestFitBudget(t *testing.T) {
+	long := strings.Repeat("word ", 100)
+	messages := []Message{
+		{Role: RoleUser, Content: long},
+		{Role: RoleAssistant, Content: "first answer"},
+		{Role: RoleUser, Content: "follow-up"},
+		{Role: RoleAssistant, Content: "second answer"},
+		{Role: RoleUser, Content: "question"},
+	}
+
+	contents := func(messages []Message) []string {
+		var c []string
+		for _, m := range messages {
+			c = append(c, m.Content)
+		}
+		return c
+	}
+	for _, tt := range []struct {
+		budget int
+		want   []string
+	}{
+		{1000, contents(messages)},
+		// The long question does not fit and its answer cannot come first
+		{50, []string{"follow-up", "second answer", "question"}},
+		// The last message is kept even when it does not fit
+		{1, []string{"question"}},
+	} {
+		got := contents(FitBudget(messages, tt.budget))
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("FitBudget(%d) = %q, want %q", tt.budget, got, tt.want)
+		}
+	}
+}
+
+func TestCounterChunk(t *testing.T) {
+	var c *Counter
+	texts := []string{"aaaa aaaa", "bbbb", strings.Repeat("c", 40), "dddd"}
+
+	chunks := c.Chunk(texts, 6)
+	var got []string
+	for _, chunk := range chunks {
+		got = append(got, strings.Join(chunk, "+"))
+	}
+	// The long text is truncated to fit a chunk on its own
+	want := []string{"aaaa aaaa+bbbb", strings.Repeat("c", 20), "dddd"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Chunk = %q, want %q", got, want)
+	}
+
+	if start := c.Recent(texts, 6); start != 3 {
+		t.Errorf("Recent = %d, want 3", start)
+	}
+	if got := c.Truncate("你好世界", 2); got != "你好" {
+		t.Errorf("Truncate = %q", got)
+	}
+}
@@ -0,0 +1,83 @@
+package llm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/metrics"
+)
+
+// Record is a request made to a model, for accounting
+type Record struct {
+	ChatID int64
+	UserID int64
+	Task   Task
+	// Model is the model as configured
+	Model string
+	Usage Usage
+	// Images is the number of generated images
+	Images  int
+	Latency time.Duration
+	// Cost is the estimated cost in dollars, zero without a price
+	Cost float64
+	// Err is the error of a failed request
+	Err error
+}
+
+var (
+	recorderMu sync.RWMutex
+	recorder   func(ctx context.Context, r *Record)
+)
+
+// SetRecorder sets the func every request made to a model is given to once
+// done. It is called before the result is returned, so it should not block.
+func SetRecorder(f func(ctx context.Context, r *Record)) {
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+	recorder = f
+}
+
+// Cost returns the estimated cost in dollars of a request to a model, zero
+// when the model has no price
+func Cost(model string, usage Usage, images int) float64 {
+	for _, p := range conf.Conf.Prices {
+		if p.Model == model {
+			return (float64(usage.PromptTokens)*p.Input+float64(usage.CompletionTokens)*p.Output)/1e6 +
+				float64(images)*p.Image
+		}
+	}
+	return 0
+}
+
+// record accounts for a request made to a model
+func record(ctx context.Context, r *Record) {
+	result := "ok"
+	if r.Err != nil {
+		result = "error"
+	}
+	metrics.LLMRequests.WithLabelValues(string(r.Task), r.Model, result).Inc()
+	metrics.LLMRequestDuration.WithLabelValues(string(r.Task), r.Model).Observe(r.Latency.Seconds())
+
+	r.Cost = Cost(r.Model, r.Usage, r.Images)
+	if r.Usage.PromptTokens > 0 {
+		metrics.LLMTokens.WithLabelValues(r.Model, "prompt").Add(float64(r.Usage.PromptTokens))
+	}
+	if r.Usage.CompletionTokens > 0 {
+		metrics.LLMTokens.WithLabelValues(r.Model, "completion").Add(float64(r.Usage.CompletionTokens))
+	}
+	if r.Images > 0 {
+		metrics.LLMImages.WithLabelValues(r.Model).Add(float64(r.Images))
+	}
+	if r.Cost > 0 {
+		metrics.LLMCost.WithLabelValues(string(r.Task), r.Model).Add(r.Cost)
+	}
+
+	recorderMu.RLock()
+	f := recorder
+	recorderMu.RUnlock()
+	if f != nil {
+		f(ctx, r)
+	}
+}
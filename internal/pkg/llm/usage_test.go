@@ -0,0 +1,50 @@
+package llm
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"go.orx.me/xbot/internal/conf"
+)
+
+func TestCost(t *testing.T) {
+	old := conf.Conf.Prices
+	defer func() { conf.Conf.Prices = old }()
+	conf.Conf.Prices = []conf.PriceConfig{
+		{Model: "openai:gpt", Input: 2.5, Output: 10},
+		{Model: "gemini:draw", Image: 0.04},
+	}
+
+	if got := Cost("openai:gpt", Usage{PromptTokens: 1000, CompletionTokens: 500}, 0); math.Abs(got-0.0075) > 1e-12 {
+		t.Errorf("chat cost = %v, want 0.0075", got)
+	}
+	if got := Cost("gemini:draw", Usage{}, 2); got != 0.08 {
+		t.Errorf("image cost = %v, want 0.08", got)
+	}
+	if got := Cost("unpriced", Usage{PromptTokens: 1000}, 1); got != 0 {
+		t.Errorf("unpriced cost = %v", got)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	setupProviders(t, []conf.ProviderConfig{{Name: "local", Type: "text"}},
+		conf.ModelsConfig{Chat: []string{"local:down", "local:up"}})
+	var records []*Record
+	SetRecorder(func(ctx context.Context, r *Record) { records = append(records, r) })
+	defer SetRecorder(nil)
+
+	if _, err := Chat(context.Background(), TaskChat, ChatRequest{ChatID: 1, UserID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// The failed attempt is recorded too
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if r := records[0]; r.Model != "local:down" || r.Err == nil {
+		t.Errorf("first record = %+v", r)
+	}
+	if r := records[1]; r.Model != "local:up" || r.Err != nil || r.ChatID != 1 || r.UserID != 2 || r.Task != TaskChat {
+		t.Errorf("second record = %+v", r)
+	}
+}
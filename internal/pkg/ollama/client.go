@@ -0,0 +1,246 @@
+// Package ollama is the provider of the native API of an Ollama server
+package ollama
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/pkg/llm"
+)
+
+const defaultEndpoint = "http://localhost:11434"
+
+func init() {
+	llm.RegisterType("ollama", New)
+}
+
+// Client is the Ollama provider
+type Client struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+// New creates the provider of an Ollama server
+func New(c conf.ProviderConfig) (llm.Provider, error) {
+	client := &Client{
+		endpoint:   strings.TrimSuffix(c.Endpoint, "/"),
+		httpClient: &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+	}
+	if client.endpoint == "" {
+		client.endpoint = defaultEndpoint
+	}
+	return client, nil
+}
+
+// Capabilities implements llm.Provider
+func (c *Client) Capabilities() llm.Capability {
+	return llm.CapChat | llm.CapEmbedding
+}
+
+// GenerateImage implements llm.Provider
+func (c *Client) GenerateImage(ctx context.Context, req *llm.ImageRequest) (*llm.Image, error) {
+	return nil, llm.ErrUnsupported
+}
+
+type chatRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Images are base64 encoded
+	Images []string `json:"images,omitempty"`
+}
+
+// chatResponse is the response, or a chunk of the streamed response
+type chatResponse struct {
+	Message         chatMessage `json:"message"`
+	Done            bool        `json:"done"`
+	DoneReason      string      `json:"done_reason"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+	EvalCount       int         `json:"eval_count"`
+	Error           string      `json:"error"`
+}
+
+// usage returns the token counts of the final chunk
+func (r *chatResponse) usage() llm.Usage {
+	return llm.Usage{PromptTokens: r.PromptEvalCount, CompletionTokens: r.EvalCount}
+}
+
+func newChatRequest(req *llm.ChatRequest, stream bool) *chatRequest {
+	r := &chatRequest{
+		Model:    req.Model,
+		Messages: make([]chatMessage, 0, len(req.Messages)+1),
+		Stream:   stream,
+	}
+	if req.System != "" {
+		r.Messages = append(r.Messages, chatMessage{Role: "system", Content: req.System})
+	}
+	for _, m := range req.Messages {
+		message := chatMessage{Role: string(m.Role), Content: m.Content}
+		for _, img := range m.Images {
+			message.Images = append(message.Images, base64.StdEncoding.EncodeToString(img.Data))
+		}
+		r.Messages = append(r.Messages, message)
+	}
+	return r
+}
+
+// do sends a request to the API, body is sent as JSON when not nil
+func (c *Client) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("ollama: %s: %s", resp.Status, e.Error)
+		}
+		return nil, fmt.Errorf("ollama: %s: %s", resp.Status, data)
+	}
+	return resp, nil
+}
+
+// Chat implements llm.Provider
+func (c *Client) Chat(ctx context.Context, req *llm.ChatRequest) (*llm.ChatResponse, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/api/chat", newChatRequest(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r chatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if r.Message.Content == "" {
+		return nil, fmt.Errorf("no text in response, done reason %s", r.DoneReason)
+	}
+	return &llm.ChatResponse{Content: r.Message.Content, Usage: r.usage()}, nil
+}
+
+// ChatStream implements llm.Streamer, the response is a JSON object per line
+func (c *Client) ChatStream(ctx context.Context, req *llm.ChatRequest, delta func(string)) (*llm.ChatResponse, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/api/chat", newChatRequest(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var sb strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var chunk chatResponse
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return nil, fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		if chunk.Error != "" {
+			return nil, fmt.Errorf("ollama: %s", chunk.Error)
+		}
+		if chunk.Message.Content != "" {
+			sb.WriteString(chunk.Message.Content)
+			delta(chunk.Message.Content)
+		}
+		if chunk.Done {
+			if sb.Len() == 0 {
+				return nil, fmt.Errorf("no text in response, done reason %s", chunk.DoneReason)
+			}
+			return &llm.ChatResponse{Content: sb.String(), Usage: chunk.usage()}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("stream ended before the response was done")
+}
+
+// Embed implements llm.Provider
+func (c *Client) Embed(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/api/embed", map[string]any{"model": model, "input": inputs})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(r.Embeddings) != len(inputs) {
+		return nil, fmt.Errorf("got %d embeddings for %d inputs", len(r.Embeddings), len(inputs))
+	}
+	return r.Embeddings, nil
+}
+
+// ListModels implements llm.ModelLister with the models pulled on the server
+func (c *Client) ListModels(ctx context.Context) ([]string, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	models := make([]string, 0, len(r.Models))
+	for _, m := range r.Models {
+		models = append(models, m.Name)
+	}
+	return models, nil
+}
+
+// Health implements llm.HealthChecker
+func (c *Client) Health(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/api/version", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,124 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/pkg/llm"
+)
+
+// standIn serves the Ollama API with a single model answering "pong"
+func standIn(t *testing.T, requests *[]chatRequest) *Client {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chat", func(w http.ResponseWriter, r *http.Request) {
+		var req chatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		*requests = append(*requests, req)
+		if req.Model != "llama3:8b" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"error":"model %q not found, try pulling it first"}`, req.Model)
+			return
+		}
+		if !req.Stream {
+			fmt.Fprint(w, `{"message":{"role":"assistant","content":"pong"},"done":true,"done_reason":"stop","prompt_eval_count":9,"eval_count":2}`)
+			return
+		}
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"po"},"done":false}`+"\n")
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"ng"},"done":false}`+"\n")
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":9,"eval_count":2}`+"\n")
+	})
+	mux.HandleFunc("POST /api/embed", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		embeddings := make([][]float32, len(req.Input))
+		for i, s := range req.Input {
+			embeddings[i] = []float32{float32(len(s)), 1}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"embeddings": embeddings})
+	})
+	mux.HandleFunc("GET /api/tags", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"models":[{"name":"llama3:8b","size":4661224676}]}`)
+	})
+	mux.HandleFunc("GET /api/version", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version":"0.5.7"}`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	p, err := New(conf.ProviderConfig{Endpoint: srv.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*Client)
+}
+
+func TestChat(t *testing.T) {
+	var requests []chatRequest
+	c := standIn(t, &requests)
+	ctx := context.Background()
+	req := &llm.ChatRequest{
+		Model:  "llama3:8b",
+		System: "Be brief.",
+		Messages: []llm.Message{
+			{Role: llm.RoleUser, Content: "ping", Images: []llm.ImageInput{{MIMEType: "image/png", Data: []byte("png")}}},
+		},
+	}
+
+	resp, err := c.Chat(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "pong" || resp.Usage.PromptTokens != 9 || resp.Usage.CompletionTokens != 2 {
+		t.Errorf("response = %+v", resp)
+	}
+	sent := requests[0].Messages
+	if len(sent) != 2 || sent[0].Role != "system" || sent[1].Images[0] != "cG5n" {
+		t.Errorf("messages = %+v", sent)
+	}
+
+	var deltas []string
+	resp, err = c.ChatStream(ctx, req, func(s string) { deltas = append(deltas, s) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "pong" || strings.Join(deltas, "|") != "po|ng" || resp.Usage.CompletionTokens != 2 {
+		t.Errorf("streamed response = %+v, deltas = %v", resp, deltas)
+	}
+
+	req.Model = "missing"
+	if _, err := c.Chat(ctx, req); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("error = %v, want model not found", err)
+	}
+}
+
+func TestEmbedListHealth(t *testing.T) {
+	c := standIn(t, new([]chatRequest))
+	ctx := context.Background()
+
+	embeddings, err := c.Embed(ctx, "nomic-embed-text", []string{"a", "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embeddings) != 2 || embeddings[1][0] != 3 {
+		t.Errorf("embeddings = %v", embeddings)
+	}
+
+	models, err := c.ListModels(ctx)
+	if err != nil || len(models) != 1 || models[0] != "llama3:8b" {
+		t.Errorf("ListModels() = %v, %v", models, err)
+	}
+	if err := c.Health(ctx); err != nil {
+		t.Errorf("Health() = %v", err)
+	}
+}
@@ -2,181 +2,227 @@ package openai
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
 
-	"butterfly.orx.me/core/log"
 	openai "github.com/sashabaranov/go-openai"
 	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/pkg/llm"
 )
 
-var (
-	client        *openai.Client
-	pictureClient *openai.Client
-)
+func init() {
+	llm.RegisterType("openai", New)
+}
 
-func Init() error {
-	var err error
-	client, err = newClient()
-	if err != nil {
-		return err
+// Provider is an OpenAI compatible API
+type Provider struct {
+	client *openai.Client
+	// noStreamUsage is set once the API refused stream_options, which
+	// servers older than it and some proxies do
+	noStreamUsage atomic.Bool
+}
+
+// New creates the provider of an OpenAI compatible API
+func New(c conf.ProviderConfig) (llm.Provider, error) {
+	config := openai.DefaultConfig(c.Key)
+	if c.Endpoint != "" {
+		config.BaseURL = c.Endpoint
+	}
+	if keys := llm.Keys(c); len(keys) > 0 {
+		config.HTTPClient = llm.NewKeyPool(c.Name, keys, llm.SetBearer).Client()
 	}
-	pictureClient, err = newPictureClient()
-	return err
+	return &Provider{client: openai.NewClientWithConfig(config)}, nil
 }
 
-func newClient() (*openai.Client, error) {
-	config := openai.DefaultConfig(conf.Conf.OpenAI.Key)
-	config.BaseURL = conf.Conf.OpenAI.Endpoint
-	client := openai.NewClientWithConfig(config)
-	return client, nil
+// Capabilities implements llm.Provider
+func (p *Provider) Capabilities() llm.Capability {
+	return llm.CapChat | llm.CapImage | llm.CapEmbedding
 }
 
-func newPictureClient() (*openai.Client, error) {
-	config := openai.DefaultConfig(conf.Conf.PictureVendor.Key)
-	config.BaseURL = conf.Conf.PictureVendor.Endpoint
-	client := openai.NewClientWithConfig(config)
-	return client, nil
+// chatRequest converts a chat request
+func chatRequest(req *llm.ChatRequest) openai.ChatCompletionRequest {
+	messages := make([]openai.ChatCompletionMessage, 0, len(req.Messages)+1)
+	if req.System != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: req.System,
+		})
+	}
+	for _, m := range req.Messages {
+		messages = append(messages, chatMessage(m))
+	}
+	return openai.ChatCompletionRequest{
+		Model:    req.Model,
+		Messages: messages,
+	}
 }
 
-func ChatCompletionWithModels(ctx context.Context, models []string, promptString, req string) (string, string, error) {
-	logger := log.FromContext(ctx).With("method", "ChatCompletionWithModels")
-	prompt := openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleSystem,
-		Content: promptString,
-	}
-
-	// Try each model in the provided order until one succeeds
-	var lastError error
-	for _, currentModel := range models {
-		logger.Info("Attempting to use model", "model", currentModel)
-
-		// Try to call the API with current model
-		resp, err := client.CreateChatCompletion(
-			ctx, // Use the passed context instead of creating a new one
-			openai.ChatCompletionRequest{
-				Model: currentModel,
-				Messages: []openai.ChatCompletionMessage{
-					prompt,
-					{
-						Role:    openai.ChatMessageRoleUser,
-						Content: req,
-					},
-				},
-			},
-		)
-
-		// If successful, return the result
-		if err == nil {
-			if len(resp.Choices) == 0 {
-				logger.Info("ChatCompletion returned no choices",
-					"model", currentModel)
-				continue
-			}
-			logger.Info("Successfully used model",
-				"model", currentModel,
-				"responseLength", len(resp.Choices[0].Message.Content),
-			)
-			return resp.Choices[0].Message.Content, currentModel, nil
-		}
+// Chat implements llm.Provider
+func (p *Provider) Chat(ctx context.Context, req *llm.ChatRequest) (*llm.ChatResponse, error) {
+	resp, err := p.client.CreateChatCompletion(ctx, chatRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("no choices in response")
+	}
+	return &llm.ChatResponse{
+		Content: resp.Choices[0].Message.Content,
+		Usage: llm.Usage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+		},
+	}, nil
+}
 
-		// Log the error and continue to next model
-		lastError = err
-		logger.Error("ChatCompletion failed with model",
-			"model", currentModel,
-			"error", err)
+// ChatStream implements llm.Streamer
+func (p *Provider) ChatStream(ctx context.Context, req *llm.ChatRequest, delta func(string)) (*llm.ChatResponse, error) {
+	r := chatRequest(req)
+	r.Stream = true
+	if !p.noStreamUsage.Load() {
+		r.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
 	}
+	stream, err := p.client.CreateChatCompletionStream(ctx, r)
+	if r.StreamOptions != nil && refusesStreamOptions(err) {
+		// Without the usage the answer is still streamed
+		p.noStreamUsage.Store(true)
+		r.StreamOptions = nil
+		stream, err = p.client.CreateChatCompletionStream(ctx, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
 
-	// If we've tried all models and all failed, return the last error
-	logger.Error("All models failed in ChatCompletionWithModels",
-		"attemptedModels", models,
-		"lastError", lastError)
+	var (
+		sb    strings.Builder
+		usage llm.Usage
+	)
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The usage comes in a last chunk without choices
+		if chunk.Usage != nil {
+			usage = llm.Usage{
+				PromptTokens:     chunk.Usage.PromptTokens,
+				CompletionTokens: chunk.Usage.CompletionTokens,
+			}
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			sb.WriteString(chunk.Choices[0].Delta.Content)
+			delta(chunk.Choices[0].Delta.Content)
+		}
+	}
+	if sb.Len() == 0 {
+		return nil, errors.New("no text in response")
+	}
+	return &llm.ChatResponse{Content: sb.String(), Usage: usage}, nil
+}
 
-	return "", "", lastError
+// refusesStreamOptions reports whether the API refused a request with a 400
+// naming stream_options, as servers that do not know it do. Other refusals,
+// such as a prompt too long, are left to the caller.
+func refusesStreamOptions(err error) bool {
+	var detail string
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.HTTPStatusCode == http.StatusBadRequest:
+		detail = apiErr.Message
+		if apiErr.Param != nil {
+			detail += " " + *apiErr.Param
+		}
+	case errors.As(err, &reqErr) && reqErr.HTTPStatusCode == http.StatusBadRequest:
+		detail = string(reqErr.Body)
+	default:
+		return false
+	}
+	return strings.Contains(detail, "stream_options") || strings.Contains(detail, "include_usage")
 }
 
-func ChatCompletion(ctx context.Context, model string, promptString, req string) (string, error) {
-	logger := log.FromContext(ctx)
-	prompt := openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleSystem,
-		Content: promptString,
-	}
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: model,
-			Messages: []openai.ChatCompletionMessage{
-				prompt,
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: req,
-				},
+// chatMessage converts a message, images are sent as data URLs
+func chatMessage(m llm.Message) openai.ChatCompletionMessage {
+	if len(m.Images) == 0 {
+		return openai.ChatCompletionMessage{Role: string(m.Role), Content: m.Content}
+	}
+	parts := make([]openai.ChatMessagePart, 0, len(m.Images)+1)
+	for _, img := range m.Images {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{
+				URL: "data:" + img.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(img.Data),
 			},
-		},
-	)
+		})
+	}
+	if m.Content != "" {
+		parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: m.Content})
+	}
+	return openai.ChatCompletionMessage{Role: string(m.Role), MultiContent: parts}
+}
+
+// GenerateImage implements llm.Provider with the images API
+func (p *Provider) GenerateImage(ctx context.Context, req *llm.ImageRequest) (*llm.Image, error) {
+	resp, err := p.client.CreateImage(ctx, openai.ImageRequest{
+		Model:          req.Model,
+		Prompt:         req.Prompt,
+		N:              1,
+		ResponseFormat: openai.CreateImageResponseFormatB64JSON,
+	})
 	if err != nil {
-		logger.Error("ChatCompletion error ",
-			"error", err)
-		return "", err
+		return nil, err
+	}
+	if len(resp.Data) == 0 {
+		return nil, errors.New("no image in response")
 	}
-	return resp.Choices[0].Message.Content, nil
+	data, err := base64.StdEncoding.DecodeString(resp.Data[0].B64JSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return &llm.Image{Data: data, MIMEType: "image/png"}, nil
 }
 
-func GenImage(ctx context.Context, promptString string) (string, error) {
-	logger := log.FromContext(ctx).With("method", "GenImage")
-
-	const maxRetries = 3
-	var lastErr error
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		resp, err := pictureClient.CreateChatCompletion(
-			ctx,
-			openai.ChatCompletionRequest{
-				Model: conf.Conf.PictureVendor.Model,
-				Messages: []openai.ChatCompletionMessage{
-					{
-						Role:    openai.ChatMessageRoleUser,
-						Content: promptString,
-					},
-				},
-			},
-		)
-		if err != nil {
-			lastErr = err
-			logger.Error("CreateChatCompletion error",
-				"error", err,
-				"attempt", attempt,
-				"maxRetries", maxRetries)
-			if attempt < maxRetries {
-				continue
-			}
-			return "", lastErr
-		}
-		if len(resp.Choices) == 0 {
-			logger.Error("CreateChatCompletion returned no choices",
-				"attempt", attempt)
-			lastErr = err
-			if attempt < maxRetries {
-				continue
-			}
-			return "", lastErr
+// Embed implements llm.Provider
+func (p *Provider) Embed(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	resp, err := p.client.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+		Input: inputs,
+		Model: openai.EmbeddingModel(model),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) != len(inputs) {
+		return nil, fmt.Errorf("got %d embeddings for %d inputs", len(resp.Data), len(inputs))
+	}
+
+	embeddings := make([][]float32, len(inputs))
+	for _, data := range resp.Data {
+		if data.Index < 0 || data.Index >= len(inputs) {
+			return nil, fmt.Errorf("embedding index %d out of range", data.Index)
 		}
-		content := resp.Choices[0].Message.Content
-		logger.Info("CreateChatCompletion success",
-			"responseLength", len(content),
-			"attempt", attempt,
-			"contentPrefix", func() string {
-				if len(content) > 200 {
-					return content[:200]
-				}
-				return content
-			}(),
-			"contentSuffix", func() string {
-				if len(content) > 200 {
-					return content[len(content)-200:]
-				}
-				return ""
-			}())
-		return content, nil
-	}
-
-	return "", lastErr
+		embeddings[data.Index] = data.Embedding
+	}
+	return embeddings, nil
+}
+
+// ListModels implements llm.ModelLister
+func (p *Provider) ListModels(ctx context.Context) ([]string, error) {
+	resp, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	models := make([]string, 0, len(resp.Models))
+	for _, m := range resp.Models {
+		models = append(models, m.ID)
+	}
+	return models, nil
 }
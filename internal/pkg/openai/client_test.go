@@ -0,0 +1,89 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/pkg/llm"
+)
+
+func TestChatStreamWithoutStreamOptions(t *testing.T) {
+	var withOptions, without int
+	// An older server refusing stream_options
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if _, ok := req["stream_options"]; ok {
+			withOptions++
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Unrecognized request argument supplied: stream_options","type":"invalid_request_error"}}`))
+			return
+		}
+		without++
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, s := range []string{"he", "llo"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", s)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	p, err := New(conf.ProviderConfig{Name: "old", Key: "test-key", Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamer := p.(*Provider)
+	for range 2 {
+		var deltas string
+		resp, err := streamer.ChatStream(context.Background(), &llm.ChatRequest{Model: "m"}, func(s string) { deltas += s })
+		if err != nil {
+			t.Fatalf("ChatStream: %v", err)
+		}
+		if resp.Content != "hello" || deltas != "hello" {
+			t.Errorf("content = %q, deltas = %q, want hello", resp.Content, deltas)
+		}
+	}
+	// The refusal is remembered
+	if withOptions != 1 || without != 2 {
+		t.Errorf("requests with stream_options = %d, without = %d, want 1 and 2", withOptions, without)
+	}
+}
+
+func TestChatStreamBadRequest(t *testing.T) {
+	var withOptions int
+	// A server refusing the prompt, not stream_options
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if _, ok := req["stream_options"]; ok {
+			withOptions++
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"This model's maximum context length is 8192 tokens","type":"invalid_request_error","param":"messages"}}`))
+	}))
+	defer srv.Close()
+
+	p, err := New(conf.ProviderConfig{Name: "strict", Key: "test-key", Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamer := p.(*Provider)
+	for range 2 {
+		if _, err := streamer.ChatStream(context.Background(), &llm.ChatRequest{Model: "m"}, func(string) {}); err == nil {
+			t.Fatal("ChatStream of a refused prompt succeeded")
+		}
+	}
+	// Usage is still asked for, the request is not sent again without it
+	if withOptions != 2 || streamer.noStreamUsage.Load() {
+		t.Errorf("requests with stream_options = %d, noStreamUsage = %v, want 2 and false", withOptions, streamer.noStreamUsage.Load())
+	}
+}
@@ -0,0 +1,110 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.orx.me/xbot/internal/conf"
+	"go.orx.me/xbot/internal/pkg/llm"
+)
+
+const defaultLlamaCppEndpoint = "http://localhost:8080"
+
+func init() {
+	llm.RegisterType("llamacpp", NewLlamaCpp)
+}
+
+// LlamaCpp is a llama.cpp server, serving the OpenAI API under /v1
+type LlamaCpp struct {
+	*Provider
+	server     string
+	httpClient *http.Client
+}
+
+// NewLlamaCpp creates the provider of a llama.cpp server, Endpoint is the
+// address of the server without /v1
+func NewLlamaCpp(c conf.ProviderConfig) (llm.Provider, error) {
+	server := strings.TrimSuffix(c.Endpoint, "/")
+	if server == "" {
+		server = defaultLlamaCppEndpoint
+	}
+	// The key is only checked when the server runs with --api-key
+	config := openai.DefaultConfig(c.Key)
+	config.BaseURL = server + "/v1"
+	if keys := llm.Keys(c); len(keys) > 0 {
+		config.HTTPClient = llm.NewKeyPool(c.Name, keys, llm.SetBearer).Client()
+	}
+	return &LlamaCpp{
+		Provider:   &Provider{client: openai.NewClientWithConfig(config)},
+		server:     server,
+		httpClient: &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+	}, nil
+}
+
+// Capabilities implements llm.Provider, embeddings need a server started
+// with --embeddings
+func (p *LlamaCpp) Capabilities() llm.Capability {
+	return llm.CapChat | llm.CapEmbedding
+}
+
+// GenerateImage implements llm.Provider
+func (p *LlamaCpp) GenerateImage(ctx context.Context, req *llm.ImageRequest) (*llm.Image, error) {
+	return nil, llm.ErrUnsupported
+}
+
+// Health implements llm.HealthChecker, the server is down while it loads the
+// model
+func (p *LlamaCpp) Health(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.server+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("llama.cpp: %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// CountTokens implements llm.TokenCounter with the tokenizer of the loaded
+// model, model is ignored
+func (p *LlamaCpp) CountTokens(ctx context.Context, model, text string) (int, error) {
+	body, err := json.Marshal(map[string]string{"content": text})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.server+"/tokenize", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return 0, fmt.Errorf("llama.cpp: %s: %s", resp.Status, body)
+	}
+
+	var r struct {
+		Tokens []json.RawMessage `json:"tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return len(r.Tokens), nil
+}
@@ -0,0 +1,133 @@
+// Package ratelimit limits how often commands are used, with a token bucket
+// per user and a daily quota per chat for each command
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"go.orx.me/xbot/internal/conf"
+)
+
+// pruneSize is the number of buckets above which full buckets are dropped
+const pruneSize = 10000
+
+// Reason is why a use is refused
+type Reason string
+
+const (
+	// RateLimited means the user used the command too often
+	RateLimited Reason = "rate_limited"
+	// QuotaExceeded means the chat used up the command for the day
+	QuotaExceeded Reason = "quota_exceeded"
+)
+
+// Decision is the answer of Allow
+type Decision struct {
+	Allowed bool
+	Reason  Reason
+	// RetryAfter is how long until the use would be allowed
+	RetryAfter time.Duration
+}
+
+type userKey struct {
+	command string
+	userID  int64
+}
+
+type chatKey struct {
+	command string
+	chatID  int64
+}
+
+// bucket holds the uses left to a user, refilled over time
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter counts the uses of the commands in memory, they start over when
+// the bot restarts
+type Limiter struct {
+	limits map[string]conf.CommandLimitConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[userKey]*bucket
+	// daily are the uses of each chat on day
+	daily map[chatKey]int
+	day   time.Time
+}
+
+// New creates a limiter of the commands
+func New(limits map[string]conf.CommandLimitConfig) *Limiter {
+	return &Limiter{
+		limits:  limits,
+		now:     time.Now,
+		buckets: make(map[userKey]*bucket),
+		daily:   make(map[chatKey]int),
+	}
+}
+
+// burst returns the size of the bucket of a limit
+func burst(limit conf.CommandLimitConfig) float64 {
+	return float64(max(limit.Burst, 1))
+}
+
+// Allow reports whether a user may use a command in a chat now and records
+// the use when so. Commands without a limit are always allowed.
+func (l *Limiter) Allow(command string, chatID, userID int64) Decision {
+	limit, ok := l.limits[command]
+	if !ok {
+		return Decision{Allowed: true}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	// The quotas start over at midnight
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if !today.Equal(l.day) {
+		l.day = today
+		clear(l.daily)
+	}
+	ck := chatKey{command, chatID}
+	if limit.Daily > 0 && l.daily[ck] >= limit.Daily {
+		return Decision{Reason: QuotaExceeded, RetryAfter: today.AddDate(0, 0, 1).Sub(now)}
+	}
+
+	if limit.PerMinute > 0 {
+		uk := userKey{command, userID}
+		b := l.buckets[uk]
+		if b == nil {
+			if len(l.buckets) >= pruneSize {
+				l.prune(now)
+			}
+			b = &bucket{tokens: burst(limit), updated: now}
+			l.buckets[uk] = b
+		}
+		perSecond := limit.PerMinute / 60
+		b.tokens = min(b.tokens+now.Sub(b.updated).Seconds()*perSecond, burst(limit))
+		b.updated = now
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+			return Decision{Reason: RateLimited, RetryAfter: wait}
+		}
+		b.tokens--
+	}
+
+	l.daily[ck]++
+	return Decision{Allowed: true}
+}
+
+// prune drops the buckets that are full again, users without one get a full
+// bucket anyway
+func (l *Limiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		limit := l.limits[k.command]
+		if b.tokens+now.Sub(b.updated).Seconds()*limit.PerMinute/60 >= burst(limit) {
+			delete(l.buckets, k)
+		}
+	}
+}
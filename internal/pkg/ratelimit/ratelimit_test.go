@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"go.orx.me/xbot/internal/conf"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(map[string]conf.CommandLimitConfig{
+		"huahua": {PerMinute: 2, Burst: 2, Daily: 5},
+	})
+	now := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	allow := func(command string, chatID, userID int64) Decision {
+		t.Helper()
+		return l.Allow(command, chatID, userID)
+	}
+
+	// The burst is used up, then a use comes back every 30 seconds
+	for i := range 2 {
+		if d := allow("huahua", 1, 10); !d.Allowed {
+			t.Fatalf("use %d refused: %+v", i+1, d)
+		}
+	}
+	d := allow("huahua", 1, 10)
+	if d.Allowed || d.Reason != RateLimited || d.RetryAfter != 30*time.Second {
+		t.Errorf("third use = %+v, want rate limited for 30s", d)
+	}
+	now = now.Add(30 * time.Second)
+	if d := allow("huahua", 1, 10); !d.Allowed {
+		t.Errorf("use after 30s refused: %+v", d)
+	}
+
+	// Other users have their own bucket, but share the quota of the chat
+	if d := allow("huahua", 1, 11); !d.Allowed {
+		t.Errorf("other user refused: %+v", d)
+	}
+	if d := allow("huahua", 1, 12); !d.Allowed {
+		t.Errorf("other user refused: %+v", d)
+	}
+	d = allow("huahua", 1, 13)
+	if d.Allowed || d.Reason != QuotaExceeded || d.RetryAfter != time.Hour-30*time.Second {
+		t.Errorf("sixth use = %+v, want quota exceeded until midnight", d)
+	}
+	if d := allow("huahua", 2, 13); !d.Allowed {
+		t.Errorf("use in another chat refused: %+v", d)
+	}
+	if d := allow("gpt", 1, 13); !d.Allowed {
+		t.Errorf("command without limit refused: %+v", d)
+	}
+
+	// The quota starts over the next day
+	now = now.Add(time.Hour)
+	if d := allow("huahua", 1, 13); !d.Allowed {
+		t.Errorf("use on the next day refused: %+v", d)
+	}
+}
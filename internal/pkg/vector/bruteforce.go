@@ -0,0 +1,103 @@
+package vector
+
+import (
+	"context"
+	"math"
+	"sync"
+)
+
+// BruteForce is an in-memory index comparing the query with every item of
+// the chat. It is exact and fast enough for the history of a chat.
+type BruteForce struct {
+	mu    sync.RWMutex
+	chats map[int64]map[string]Item
+}
+
+// NewBruteForce creates an empty brute-force index
+func NewBruteForce() *BruteForce {
+	return &BruteForce{chats: make(map[int64]map[string]Item)}
+}
+
+// Upsert adds items to the index of a chat. Vectors are stored normalized so
+// the cosine similarity is a dot product.
+func (x *BruteForce) Upsert(ctx context.Context, chatID int64, items ...Item) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	chat := x.chats[chatID]
+	if chat == nil {
+		chat = make(map[string]Item)
+		x.chats[chatID] = chat
+	}
+	for _, item := range items {
+		item.Vector = normalize(item.Vector)
+		chat[item.ID] = item
+	}
+	return nil
+}
+
+// Search returns the K items of a chat with the highest cosine similarity
+func (x *BruteForce) Search(ctx context.Context, chatID int64, query []float32, opts SearchOptions) ([]Match, error) {
+	query = normalize(query)
+	since := opts.Since.Unix()
+
+	x.mu.RLock()
+	matches := make([]Match, 0, len(x.chats[chatID]))
+	for _, item := range x.chats[chatID] {
+		if !opts.Since.IsZero() && item.CreatedAt < since || len(item.Vector) != len(query) {
+			continue
+		}
+		matches = append(matches, Match{ID: item.ID, CreatedAt: item.CreatedAt, Score: dot(query, item.Vector)})
+	}
+	x.mu.RUnlock()
+
+	sortMatches(matches)
+	if opts.K > 0 && len(matches) > opts.K {
+		matches = matches[:opts.K]
+	}
+	return matches, nil
+}
+
+// Remove drops items from the index of a chat
+func (x *BruteForce) Remove(ctx context.Context, chatID int64, ids ...string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, id := range ids {
+		delete(x.chats[chatID], id)
+	}
+	return nil
+}
+
+// Drop drops the whole index of a chat
+func (x *BruteForce) Drop(ctx context.Context, chatID int64) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.chats, chatID)
+	return nil
+}
+
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, f := range v {
+		sum += float64(f) * float64(f)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	out := make([]float32, len(v))
+	for i, f := range v {
+		out[i] = f / norm
+	}
+	return out
+}
+
+func dot(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
@@ -0,0 +1,63 @@
+package vector
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBruteForce(t *testing.T) {
+	ctx := context.Background()
+	x, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	err = x.Upsert(ctx, 1,
+		Item{ID: "east", CreatedAt: now - 100, Vector: []float32{1, 0}},
+		Item{ID: "north", CreatedAt: now - 50, Vector: []float32{0, 2}},
+		Item{ID: "northeast", CreatedAt: now, Vector: []float32{3, 3}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.Upsert(ctx, 2, Item{ID: "other", CreatedAt: now, Vector: []float32{1, 0}})
+
+	ids := func(opts SearchOptions) string {
+		t.Helper()
+		matches, err := x.Search(ctx, 1, []float32{10, 1}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, m := range matches {
+			out = append(out, m.ID)
+		}
+		return fmt.Sprint(out)
+	}
+
+	if got := ids(SearchOptions{K: 2}); got != "[east northeast]" {
+		t.Errorf("Search = %s, want [east northeast]", got)
+	}
+	if got := ids(SearchOptions{Since: time.Unix(now-60, 0)}); got != "[northeast north]" {
+		t.Errorf("Search since = %s, want [northeast north]", got)
+	}
+
+	// Upserting the same ID replaces the item
+	x.Upsert(ctx, 1, Item{ID: "east", CreatedAt: now - 100, Vector: []float32{0, 1}})
+	x.Remove(ctx, 1, "northeast")
+	if got := ids(SearchOptions{}); got != "[north east]" {
+		t.Errorf("Search after upsert = %s, want [north east]", got)
+	}
+
+	x.Drop(ctx, 1)
+	if got := ids(SearchOptions{}); got != "[]" {
+		t.Errorf("Search after drop = %s, want []", got)
+	}
+
+	if _, err := New("missing"); err == nil {
+		t.Error("New with an unknown index succeeded")
+	}
+}
@@ -0,0 +1,83 @@
+// Package vector stores message embeddings per chat and finds the ones
+// nearest to a query embedding
+package vector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Item is the embedding of a message
+type Item struct {
+	// ID identifies the message, e.g. the hex of its storage ID
+	ID string
+	// CreatedAt is the unix time the message was created
+	CreatedAt int64
+	Vector    []float32
+}
+
+// Match is an item found by a search, higher scores are more similar
+type Match struct {
+	ID        string
+	CreatedAt int64
+	Score     float32
+}
+
+// SearchOptions narrows a search
+type SearchOptions struct {
+	// K is the number of matches to return
+	K int
+	// Since only returns items created at or after it when non-zero
+	Since time.Time
+}
+
+// Index holds the embeddings of every chat
+type Index interface {
+	// Upsert adds items to the index of a chat, replacing items with the same ID
+	Upsert(ctx context.Context, chatID int64, items ...Item) error
+	// Search returns the K items of a chat most similar to the query, best first
+	Search(ctx context.Context, chatID int64, query []float32, opts SearchOptions) ([]Match, error)
+	// Remove drops items from the index of a chat
+	Remove(ctx context.Context, chatID int64, ids ...string) error
+	// Drop drops the whole index of a chat
+	Drop(ctx context.Context, chatID int64) error
+}
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]func() (Index, error){
+		"":           func() (Index, error) { return NewBruteForce(), nil },
+		"bruteforce": func() (Index, error) { return NewBruteForce(), nil },
+	}
+)
+
+// Register makes an index implementation available under a name
+func Register(name string, factory func() (Index, error)) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[name] = factory
+}
+
+// New creates the index registered under name, "" is the brute-force index
+func New(name string) (Index, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown vector index %q", name)
+	}
+	return factory()
+}
+
+// sortMatches orders matches by score, newest first on ties
+func sortMatches(matches []Match) {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].CreatedAt > matches[j].CreatedAt
+	})
+}
@@ -0,0 +1,137 @@
+package transcript
+
+import (
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"go.orx.me/xbot/internal/dao"
+)
+
+// htmlPage is a standalone page, the styles are inlined so the file can be
+// opened without anything else
+var htmlPage = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"entity": htmlEntity,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Roboto, sans-serif; max-width: 760px; margin: 0 auto; padding: 16px; color: #222; background: #f5f5f5; }
+h1 { font-size: 1.4em; margin-bottom: 4px; }
+.summary { color: #777; margin-top: 0; }
+.day { text-align: center; color: #777; margin: 24px 0 8px; font-size: .9em; }
+.message { background: #fff; border-radius: 8px; padding: 8px 12px; margin: 6px 0; }
+.from { font-weight: 600; color: #2a6fb0; }
+.time { color: #999; font-size: .85em; margin-left: 6px; }
+.reply { border-left: 3px solid #2a6fb0; padding-left: 8px; color: #666; font-size: .9em; margin: 4px 0; }
+.text { white-space: pre-wrap; word-wrap: break-word; margin-top: 4px; }
+.file, .reactions { color: #555; font-size: .9em; margin-top: 4px; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="summary">{{.Summary}}</p>
+{{range .Messages}}{{if .Day}}<div class="day">{{.Day}}</div>
+{{end}}<div class="message" id="message{{.ID}}">
+<div><span class="from">{{.From}}</span><span class="time">{{.Time}}{{if .Edited}} (edited){{end}}</span></div>
+{{if .Reply}}<div class="reply">{{.Reply}}</div>
+{{end}}{{if .Text}}<div class="text">{{range .Text}}{{entity .}}{{end}}</div>
+{{end}}{{range .Files}}<div class="file">📎 {{.}}</div>
+{{end}}{{if .Reactions}}<div class="reactions">{{.Reactions}}</div>
+{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+type htmlTranscript struct {
+	Title    string
+	Summary  string
+	Messages []htmlMessage
+}
+
+type htmlMessage struct {
+	ID int
+	// Day is set on the first message of each day
+	Day       string
+	From      string
+	Time      string
+	Edited    bool
+	Reply     string
+	Text      []TextEntity
+	Files     []string
+	Reactions string
+}
+
+// htmlEntity renders a formatted part of a text, the text is escaped
+func htmlEntity(e TextEntity) template.HTML {
+	text := template.HTMLEscapeString(e.Text)
+	switch e.Type {
+	case "bold":
+		return template.HTML("<b>" + text + "</b>")
+	case "italic":
+		return template.HTML("<i>" + text + "</i>")
+	case "underline":
+		return template.HTML("<u>" + text + "</u>")
+	case "strikethrough":
+		return template.HTML("<s>" + text + "</s>")
+	case "code", "pre":
+		return template.HTML("<code>" + text + "</code>")
+	case "text_link":
+		return template.HTML(`<a href="` + template.HTMLEscapeString(safeURL(e.Href)) + `">` + text + "</a>")
+	case "link":
+		return template.HTML(`<a href="` + template.HTMLEscapeString(safeURL(e.Text)) + `">` + text + "</a>")
+	}
+	return template.HTML(text)
+}
+
+// safeURL only keeps web links, so a transcript cannot run scripts
+func safeURL(u string) string {
+	for _, scheme := range []string{"https://", "http://", "tg://"} {
+		if strings.HasPrefix(u, scheme) {
+			return u
+		}
+	}
+	if u != "" && !strings.Contains(u, ":") {
+		// Links without scheme such as example.com/path
+		return "https://" + u
+	}
+	return "#"
+}
+
+func renderHTML(w io.Writer, t *Transcript) error {
+	page := htmlTranscript{Title: title(t.Chat), Summary: summary(t)}
+	day := ""
+	for _, m := range t.Messages {
+		hm := newHTMLMessage(m)
+		if d := time.Unix(m.CreatedAt, 0).Format(time.DateOnly); d != day {
+			day = d
+			hm.Day = d
+		}
+		page.Messages = append(page.Messages, hm)
+	}
+	return htmlPage.Execute(w, page)
+}
+
+func newHTMLMessage(m *dao.Message) htmlMessage {
+	message := m.Latest()
+	hm := htmlMessage{
+		ID:     message.ID,
+		From:   senderName(message),
+		Time:   time.Unix(m.CreatedAt, 0).Format("15:04"),
+		Edited: message.EditDate != 0,
+		Text:   splitEntities(text(message)),
+	}
+	if reply := message.ReplyToMessage; reply != nil {
+		replyText, _ := text(reply)
+		hm.Reply = senderName(reply) + ": " + snippet(replyText)
+	}
+	for _, f := range files(m, message) {
+		hm.Files = append(hm.Files, fileLabel(f))
+	}
+	hm.Reactions = formatReactions(m)
+	return hm
+}
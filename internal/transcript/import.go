@@ -0,0 +1,280 @@
+package transcript
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.orx.me/xbot/internal/dao"
+)
+
+// ImportOptions controls Import
+type ImportOptions struct {
+	// ChatID is the chat the messages are imported into, 0 derives it from
+	// the ID and type of the export
+	ChatID int64
+	// DryRun parses and checks the export without writing messages
+	DryRun bool
+}
+
+// ImportResult reports what Import did
+type ImportResult struct {
+	ChatID   int64
+	Imported int
+	// Existing are messages already stored, by the bot or a previous import
+	Existing int
+	// Expired are messages older than the retention of the chat
+	Expired int
+	// Skipped are service messages and messages without text or media
+	Skipped int
+}
+
+// ParseResult reads a Telegram Desktop result.json export of a single chat
+func ParseResult(r io.Reader) (*Result, error) {
+	var result Result
+	if err := json.NewDecoder(r).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse export: %w", err)
+	}
+	if result.ID == 0 && len(result.Messages) == 0 {
+		// Exports of a whole account nest the chats, see "chats" > "list"
+		return nil, errors.New("not a chat export, export a single chat as JSON in Telegram Desktop")
+	}
+	return &result, nil
+}
+
+// ChatID returns the Bot API ID of the exported chat
+func (r *Result) ChatID() int64 {
+	switch r.Type {
+	case "private_group":
+		return -r.ID
+	case "private_supergroup", "public_supergroup", "private_channel", "public_channel":
+		return channelID(r.ID)
+	}
+	return r.ID
+}
+
+// channelID returns the Bot API ID of a supergroup or channel, its ID
+// prefixed with -100
+func channelID(id int64) int64 {
+	n, _ := strconv.ParseInt("-100"+strconv.FormatInt(id, 10), 10, 64)
+	return n
+}
+
+// chat returns the exported chat as the Bot API describes it
+func (r *Result) chat(chatID int64) models.Chat {
+	chat := models.Chat{ID: chatID, Title: r.Name}
+	switch r.Type {
+	case "private_group":
+		chat.Type = models.ChatTypeGroup
+	case "private_supergroup", "public_supergroup":
+		chat.Type = models.ChatTypeSupergroup
+	case "private_channel", "public_channel":
+		chat.Type = models.ChatTypeChannel
+	default:
+		chat.Type = models.ChatTypePrivate
+		chat.Title = ""
+		chat.FirstName = r.Name
+	}
+	return chat
+}
+
+// Import writes the messages of an export into the storage as synthetic
+// updates. Messages keep their Telegram ID, messages already stored with the
+// same ID are left alone so importing the same export twice is harmless.
+func Import(ctx context.Context, storage dao.MessageStorage, result *Result, opts ImportOptions) (*ImportResult, error) {
+	chatID := opts.ChatID
+	if chatID == 0 {
+		chatID = result.ChatID()
+	}
+	if !dao.ShouldStoreMessages(chatID) {
+		return nil, fmt.Errorf("messages of chat %d are not stored", chatID)
+	}
+	chat := result.chat(chatID)
+	report := &ImportResult{ChatID: chatID}
+
+	var messages []*dao.Message
+	for _, rm := range result.Messages {
+		m, ok := toMessage(chat, rm)
+		if !ok {
+			report.Skipped++
+			continue
+		}
+		messages = append(messages, m)
+	}
+	if len(messages) == 0 {
+		return report, nil
+	}
+
+	existing, err := storedMessageIDs(ctx, storage, chatID, messages)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := dao.RetentionCutoff(chatID, time.Now()).Unix()
+	for _, m := range messages {
+		switch {
+		case existing[m.MessageID]:
+			report.Existing++
+		case m.CreatedAt < cutoff:
+			report.Expired++
+		default:
+			if !opts.DryRun {
+				if err := storage.SaveMessage(ctx, m); err != nil {
+					return report, fmt.Errorf("failed to save message %d: %w", m.MessageID, err)
+				}
+			}
+			report.Imported++
+		}
+	}
+	return report, nil
+}
+
+// storedMessageIDs returns the Telegram IDs of the messages of the chat
+// stored in the time range of the imported messages
+func storedMessageIDs(ctx context.Context, storage dao.MessageStorage, chatID int64, messages []*dao.Message) (map[int]bool, error) {
+	first, last := messages[0].CreatedAt, messages[0].CreatedAt
+	for _, m := range messages {
+		first = min(first, m.CreatedAt)
+		last = max(last, m.CreatedAt)
+	}
+	page, err := storage.QueryMessages(ctx, dao.MessageQuery{
+		ChatID: chatID,
+		Since:  time.Unix(first, 0),
+		Until:  time.Unix(last+1, 0),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stored messages: %w", err)
+	}
+	ids := make(map[int]bool, len(page.Messages))
+	for _, m := range page.Messages {
+		ids[m.TelegramMessageID()] = true
+	}
+	return ids, nil
+}
+
+// toMessage converts an exported message, ok is false for service messages
+// and messages without anything to keep
+func toMessage(chat models.Chat, rm ResultMessage) (*dao.Message, bool) {
+	if rm.Type != "message" || rm.ID == 0 {
+		return nil, false
+	}
+	date, err := strconv.ParseInt(rm.DateUnix, 10, 64)
+	if err != nil {
+		// Older exports only have the local time
+		t, err := time.ParseInLocation("2006-01-02T15:04:05", rm.Date, time.Local)
+		if err != nil {
+			return nil, false
+		}
+		date = t.Unix()
+	}
+
+	message := &models.Message{
+		ID:   rm.ID,
+		Chat: chat,
+		Date: int(date),
+	}
+	message.Text, message.Entities = joinEntities(rm.TextEntities)
+	if message.Text == "" {
+		message.Text, message.Entities = joinEntities(rm.Text)
+	}
+	if message.Text == "" && rm.Photo == "" && rm.File == "" {
+		return nil, false
+	}
+	if edited, err := strconv.Atoi(rm.EditedUnix); err == nil {
+		message.EditDate = edited
+	}
+	if rm.ReplyToMessageID != 0 {
+		message.ReplyToMessage = &models.Message{ID: rm.ReplyToMessageID, Chat: chat}
+	}
+
+	if kind, id, ok := cutPeerID(rm.FromID); ok {
+		switch kind {
+		case "user":
+			message.From = &models.User{ID: id, FirstName: rm.From}
+		case "channel":
+			message.SenderChat = &models.Chat{ID: channelID(id), Type: models.ChatTypeChannel, Title: rm.From}
+		}
+	}
+
+	m := &dao.Message{
+		ID:        importedID(chat.ID, rm.ID, date),
+		Update:    &models.Update{Message: message},
+		ChatID:    chat.ID,
+		MessageID: rm.ID,
+		CreatedAt: date,
+	}
+	for _, r := range rm.Reactions {
+		emoji := r.Emoji
+		if emoji == "" {
+			emoji = r.Type
+		}
+		m.ReactionCounts = append(m.ReactionCounts, dao.ReactionCount{Emoji: emoji, Count: r.Count})
+	}
+	return m, true
+}
+
+// cutPeerID splits a Telegram Desktop peer ID such as "user123"
+func cutPeerID(s string) (string, int64, bool) {
+	for _, kind := range []string{"user", "channel", "chat"} {
+		if rest, ok := strings.CutPrefix(s, kind); ok {
+			id, err := strconv.ParseInt(rest, 10, 64)
+			return kind, id, err == nil
+		}
+	}
+	return "", 0, false
+}
+
+// importedID derives the storage ID of an imported message from the chat and
+// message IDs, so every import of the message gets the same one. Like any
+// ObjectID it starts with the creation time.
+func importedID(chatID int64, messageID int, date int64) bson.ObjectID {
+	var id bson.ObjectID
+	binary.BigEndian.PutUint32(id[:4], uint32(date))
+	sum := sha256.Sum256([]byte(fmt.Sprintf("import/%d/%d", chatID, messageID)))
+	copy(id[4:], sum[:])
+	return id
+}
+
+// botEntityTypes maps Telegram Desktop entity types back to the Bot API
+var botEntityTypes = map[string]models.MessageEntityType{
+	"link":         models.MessageEntityTypeURL,
+	"phone":        models.MessageEntityTypePhoneNumber,
+	"mention_name": models.MessageEntityTypeTextMention,
+}
+
+// joinEntities rebuilds a text and its Bot API entities from its parts
+func joinEntities(parts []TextEntity) (string, []models.MessageEntity) {
+	var (
+		sb       strings.Builder
+		entities []models.MessageEntity
+		offset   int
+	)
+	for _, part := range parts {
+		length := len(utf16.Encode([]rune(part.Text)))
+		if part.Type != "plain" && length > 0 {
+			entity := models.MessageEntity{Type: models.MessageEntityType(part.Type), Offset: offset, Length: length}
+			if t, ok := botEntityTypes[part.Type]; ok {
+				entity.Type = t
+			}
+			switch entity.Type {
+			case models.MessageEntityTypeTextLink:
+				entity.URL = part.Href
+			case models.MessageEntityTypeTextMention:
+				entity.User = &models.User{ID: part.UserID}
+			}
+			entities = append(entities, entity)
+		}
+		sb.WriteString(part.Text)
+		offset += length
+	}
+	return sb.String(), entities
+}
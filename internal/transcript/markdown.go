@@ -0,0 +1,98 @@
+package transcript
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.orx.me/xbot/internal/dao"
+)
+
+// markdownEscaper escapes the characters Markdown would interpret in names
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "#", `\#`, "<", "&lt;",
+)
+
+func renderMarkdown(w io.Writer, t *Transcript) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %s\n\n", markdownEscaper.Replace(title(t.Chat)))
+	fmt.Fprintf(bw, "%s\n", summary(t))
+
+	day := ""
+	for _, m := range t.Messages {
+		created := time.Unix(m.CreatedAt, 0)
+		if d := created.Format(time.DateOnly); d != day {
+			day = d
+			fmt.Fprintf(bw, "\n## %s\n", day)
+		}
+		writeMarkdownMessage(bw, m, created)
+	}
+	return bw.Flush()
+}
+
+func writeMarkdownMessage(w io.Writer, m *dao.Message, created time.Time) {
+	message := m.Latest()
+	fmt.Fprintf(w, "\n**%s** · %s", markdownEscaper.Replace(senderName(message)), created.Format("15:04"))
+	if message.EditDate != 0 {
+		fmt.Fprint(w, " _(edited)_")
+	}
+	fmt.Fprintln(w)
+
+	if message.ReplyToMessage != nil {
+		reply := message.ReplyToMessage
+		replyText, _ := text(reply)
+		fmt.Fprintf(w, "> %s: %s\n", markdownEscaper.Replace(senderName(reply)), snippet(replyText))
+	}
+	if body, _ := text(message); body != "" {
+		// Two trailing spaces keep the line breaks of the message
+		fmt.Fprintf(w, "\n%s\n", strings.ReplaceAll(body, "\n", "  \n"))
+	}
+	for _, f := range files(m, message) {
+		fmt.Fprintf(w, "\n📎 %s\n", fileLabel(f))
+	}
+	if r := formatReactions(m); r != "" {
+		fmt.Fprintf(w, "\n%s\n", r)
+	}
+}
+
+// summary describes what the transcript covers
+func summary(t *Transcript) string {
+	s := fmt.Sprintf("%d messages", len(t.Messages))
+	if !t.Since.IsZero() {
+		s += " since " + t.Since.Format("2006-01-02 15:04")
+	}
+	return s + ", exported " + time.Now().Format("2006-01-02 15:04") + "."
+}
+
+// fileLabel describes a file and where its archived copy is
+func fileLabel(f file) string {
+	label := f.Kind
+	if f.FileName != "" {
+		label += " " + f.FileName
+	}
+	if f.archived != nil {
+		return label + " (" + f.archived.Key + ")"
+	}
+	return label + " (not archived)"
+}
+
+// formatReactions lists the reactions to a message, e.g. "👍 2 · 🔥 1"
+func formatReactions(m *dao.Message) string {
+	emojis, counts := reactions(m)
+	parts := make([]string, len(emojis))
+	for i, emoji := range emojis {
+		parts[i] = fmt.Sprintf("%s %d", emoji, counts[emoji])
+	}
+	return strings.Join(parts, " · ")
+}
+
+// snippet shortens a quoted text to a single line
+func snippet(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > 80 {
+		return string(r[:80]) + "…"
+	}
+	return text
+}
@@ -0,0 +1,301 @@
+package transcript
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/dao"
+)
+
+// fileNotIncluded is what Telegram Desktop writes for files it did not export
+const fileNotIncluded = "(File not included. Change data exporting settings to download.)"
+
+// Result is a chat export in the result.json format of Telegram Desktop
+type Result struct {
+	Name string `json:"name"`
+	// Type is e.g. "personal_chat", "private_group" or "public_supergroup"
+	Type string `json:"type"`
+	// ID is the chat ID without the -100 prefix of supergroups and channels
+	ID       int64           `json:"id"`
+	Messages []ResultMessage `json:"messages"`
+}
+
+// ResultMessage is a message of a Result
+type ResultMessage struct {
+	ID   int    `json:"id"`
+	Type string `json:"type"`
+	// Date is the local time without zone, DateUnix the same as unix time
+	Date       string `json:"date"`
+	DateUnix   string `json:"date_unixtime"`
+	Edited     string `json:"edited,omitempty"`
+	EditedUnix string `json:"edited_unixtime,omitempty"`
+	From       string `json:"from,omitempty"`
+	// FromID is "user<id>" or "channel<id>"
+	FromID           string `json:"from_id,omitempty"`
+	ReplyToMessageID int    `json:"reply_to_message_id,omitempty"`
+
+	Photo     string `json:"photo,omitempty"`
+	File      string `json:"file,omitempty"`
+	FileName  string `json:"file_name,omitempty"`
+	MimeType  string `json:"mime_type,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
+
+	Text         Text             `json:"text"`
+	TextEntities []TextEntity     `json:"text_entities"`
+	Reactions    []ResultReaction `json:"reactions,omitempty"`
+}
+
+// ResultReaction is the number of reactions with an emoji
+type ResultReaction struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+	Emoji string `json:"emoji,omitempty"`
+}
+
+// TextEntity is a formatted part of a text, the whole text is the
+// concatenation of its entities
+type TextEntity struct {
+	// Type is "plain" for unformatted text, otherwise e.g. "bold" or "link"
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Href   string `json:"href,omitempty"`
+	UserID int64  `json:"user_id,omitempty"`
+}
+
+// Text is the text of a result message. It is a plain string without
+// formatting, otherwise a list of strings and formatted entities.
+type Text []TextEntity
+
+// String returns the unformatted text
+func (t Text) String() string {
+	var sb strings.Builder
+	for _, e := range t {
+		sb.WriteString(e.Text)
+	}
+	return sb.String()
+}
+
+func (t Text) MarshalJSON() ([]byte, error) {
+	formatted := false
+	for _, e := range t {
+		formatted = formatted || e.Type != "plain"
+	}
+	if !formatted {
+		return json.Marshal(t.String())
+	}
+
+	parts := make([]any, len(t))
+	for i, e := range t {
+		if e.Type == "plain" {
+			parts[i] = e.Text
+		} else {
+			parts[i] = e
+		}
+	}
+	return json.Marshal(parts)
+}
+
+func (t *Text) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = nil
+		if s != "" {
+			*t = Text{{Type: "plain", Text: s}}
+		}
+		return nil
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	*t = make(Text, 0, len(parts))
+	for _, part := range parts {
+		var e TextEntity
+		if err := json.Unmarshal(part, &e.Text); err == nil {
+			e.Type = "plain"
+		} else if err := json.Unmarshal(part, &e); err != nil {
+			return err
+		}
+		*t = append(*t, e)
+	}
+	return nil
+}
+
+// entityTypes maps Bot API entity types to the names of Telegram Desktop
+var entityTypes = map[models.MessageEntityType]string{
+	models.MessageEntityTypeURL:         "link",
+	models.MessageEntityTypePhoneNumber: "phone",
+	models.MessageEntityTypeTextMention: "mention_name",
+	"expandable_blockquote":             "blockquote",
+}
+
+// splitEntities splits a text into plain and formatted parts. Offsets of Bot
+// API entities are in UTF-16 code units. Nested entities are not supported
+// by the format, the outer one is kept.
+func splitEntities(text string, entities []models.MessageEntity) []TextEntity {
+	units := utf16.Encode([]rune(text))
+	var parts []TextEntity
+	plain := func(from, to int) {
+		if from < to {
+			parts = append(parts, TextEntity{Type: "plain", Text: string(utf16.Decode(units[from:to]))})
+		}
+	}
+
+	pos := 0
+	for _, e := range entities {
+		end := e.Offset + e.Length
+		if e.Offset < pos || end > len(units) || e.Length <= 0 {
+			continue
+		}
+		plain(pos, e.Offset)
+
+		part := TextEntity{Type: string(e.Type), Text: string(utf16.Decode(units[e.Offset:end]))}
+		if name, ok := entityTypes[e.Type]; ok {
+			part.Type = name
+		}
+		switch e.Type {
+		case models.MessageEntityTypeTextLink:
+			part.Href = e.URL
+		case models.MessageEntityTypeTextMention:
+			if e.User != nil {
+				part.UserID = e.User.ID
+			}
+		}
+		parts = append(parts, part)
+		pos = end
+	}
+	plain(pos, len(units))
+	return parts
+}
+
+// resultChatType returns the Telegram Desktop type of a chat
+func resultChatType(chat models.Chat) string {
+	switch chat.Type {
+	case models.ChatTypePrivate:
+		return "personal_chat"
+	case models.ChatTypeGroup:
+		return "private_group"
+	case models.ChatTypeSupergroup:
+		if chat.Username != "" {
+			return "public_supergroup"
+		}
+		return "private_supergroup"
+	case models.ChatTypeChannel:
+		if chat.Username != "" {
+			return "public_channel"
+		}
+		return "private_channel"
+	}
+	return "personal_chat"
+}
+
+// peerID returns a chat ID without the -100 prefix or minus sign used by the
+// Bot API, as Telegram Desktop writes it
+func peerID(id int64) int64 {
+	s := strconv.FormatInt(id, 10)
+	if bare, ok := strings.CutPrefix(s, "-100"); ok {
+		n, _ := strconv.ParseInt(bare, 10, 64)
+		return n
+	}
+	if id < 0 {
+		return -id
+	}
+	return id
+}
+
+// fromID returns the Telegram Desktop ID of the sender of a message
+func fromID(message *models.Message) string {
+	switch {
+	case message.From != nil:
+		return "user" + strconv.FormatInt(message.From.ID, 10)
+	case message.SenderChat != nil:
+		return "channel" + strconv.FormatInt(peerID(message.SenderChat.ID), 10)
+	}
+	return ""
+}
+
+// mediaTypes maps the kinds of files to the media types of Telegram Desktop
+var mediaTypes = map[string]string{
+	"voice":      "voice_message",
+	"audio":      "audio_file",
+	"video":      "video_file",
+	"video_note": "video_message",
+	"animation":  "animation",
+}
+
+// ToResult converts a transcript to the result.json format
+func ToResult(t *Transcript) *Result {
+	result := &Result{
+		Name:     title(t.Chat),
+		Type:     resultChatType(t.Chat),
+		ID:       peerID(t.Chat.ID),
+		Messages: make([]ResultMessage, 0, len(t.Messages)),
+	}
+	for _, m := range t.Messages {
+		result.Messages = append(result.Messages, toResultMessage(m))
+	}
+	return result
+}
+
+func toResultMessage(m *dao.Message) ResultMessage {
+	message := m.Latest()
+	created := time.Unix(m.CreatedAt, 0)
+	rm := ResultMessage{
+		ID:       message.ID,
+		Type:     "message",
+		Date:     created.Format("2006-01-02T15:04:05"),
+		DateUnix: strconv.FormatInt(m.CreatedAt, 10),
+		From:     senderName(message),
+		FromID:   fromID(message),
+	}
+	if message.EditDate != 0 {
+		edited := time.Unix(int64(message.EditDate), 0)
+		rm.Edited = edited.Format("2006-01-02T15:04:05")
+		rm.EditedUnix = strconv.Itoa(message.EditDate)
+	}
+	if message.ReplyToMessage != nil {
+		rm.ReplyToMessageID = message.ReplyToMessage.ID
+	}
+
+	// A message has at most one file, the largest photo size
+	if fs := files(m, message); len(fs) > 0 {
+		f := fs[0]
+		path := fileNotIncluded
+		if f.archived != nil {
+			path = f.archived.Key
+		}
+		if f.Kind == "photo" {
+			rm.Photo = path
+		} else {
+			rm.File = path
+			rm.FileName = f.FileName
+			rm.MimeType = f.MIMEType
+			rm.MediaType = mediaTypes[f.Kind]
+		}
+	}
+
+	rm.TextEntities = splitEntities(text(message))
+	rm.Text = Text(rm.TextEntities)
+	if rm.TextEntities == nil {
+		rm.TextEntities = []TextEntity{}
+	}
+
+	emojis, counts := reactions(m)
+	for _, emoji := range emojis {
+		rm.Reactions = append(rm.Reactions, ResultReaction{Type: "emoji", Count: counts[emoji], Emoji: emoji})
+	}
+	return rm
+}
+
+func renderJSON(w io.Writer, t *Transcript) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(ToResult(t))
+}
@@ -0,0 +1,197 @@
+// Package transcript renders stored chat history for people outside Telegram
+package transcript
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/dao"
+)
+
+// Format is the file format of a transcript
+type Format string
+
+const (
+	// FormatJSON is compatible with the result.json of Telegram Desktop
+	FormatJSON     Format = "json"
+	FormatMarkdown Format = "markdown"
+	FormatHTML     Format = "html"
+)
+
+// ParseFormat returns the format with the given name or file extension
+func ParseFormat(name string) (Format, bool) {
+	switch strings.ToLower(name) {
+	case "json":
+		return FormatJSON, true
+	case "markdown", "md":
+		return FormatMarkdown, true
+	case "html", "htm":
+		return FormatHTML, true
+	}
+	return "", false
+}
+
+// Extension returns the file extension of the format, with the dot
+func (f Format) Extension() string {
+	switch f {
+	case FormatMarkdown:
+		return ".md"
+	case FormatHTML:
+		return ".html"
+	}
+	return ".json"
+}
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatHTML:
+		return "text/html; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// Transcript is the history of a chat to render
+type Transcript struct {
+	Chat models.Chat
+	// Since is the start of the transcript, zero when it holds every message
+	Since time.Time
+	// Messages are the messages of the chat, oldest first
+	Messages []*dao.Message
+}
+
+// Load reads the messages of a chat created since the given time, zero reads
+// every stored message. Messages deleted in Telegram are left out. The chat
+// is taken from the newest message.
+func Load(ctx context.Context, storage dao.MessageStorage, chatID int64, since time.Time) (*Transcript, error) {
+	page, err := storage.QueryMessages(ctx, dao.MessageQuery{ChatID: chatID, Since: since})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+
+	t := &Transcript{Chat: models.Chat{ID: chatID}, Since: since}
+	for _, m := range page.Messages {
+		latest := m.Latest()
+		if latest == nil || m.DeletedAt != 0 {
+			continue
+		}
+		t.Chat = latest.Chat
+		t.Messages = append(t.Messages, m)
+	}
+	return t, nil
+}
+
+// Render writes the transcript in the given format
+func Render(w io.Writer, format Format, t *Transcript) error {
+	switch format {
+	case FormatJSON:
+		return renderJSON(w, t)
+	case FormatMarkdown:
+		return renderMarkdown(w, t)
+	case FormatHTML:
+		return renderHTML(w, t)
+	}
+	return fmt.Errorf("unknown transcript format %q", format)
+}
+
+// FileName returns the name of the transcript file,
+// e.g. "chat-100-20250102.html"
+func FileName(t *Transcript, format Format, now time.Time) string {
+	return fmt.Sprintf("chat-%d-%s%s", t.Chat.ID, now.Format("20060102"), format.Extension())
+}
+
+// ParseSince parses the start of a transcript, either a date (2006-01-02) or
+// a period before now such as "7d" or "12h"
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid start %q, use a date like 2006-01-02 or a period like 7d", s)
+}
+
+// title returns the name of the chat
+func title(chat models.Chat) string {
+	switch {
+	case chat.Title != "":
+		return chat.Title
+	case chat.FirstName != "":
+		return strings.TrimSpace(chat.FirstName + " " + chat.LastName)
+	case chat.Username != "":
+		return "@" + chat.Username
+	}
+	return fmt.Sprintf("Chat %d", chat.ID)
+}
+
+// senderName returns the display name of the sender of a message
+func senderName(message *models.Message) string {
+	switch {
+	case message.From != nil:
+		name := strings.TrimSpace(message.From.FirstName + " " + message.From.LastName)
+		if name == "" && message.From.Username != "" {
+			name = "@" + message.From.Username
+		}
+		if name != "" {
+			return name
+		}
+	case message.SenderChat != nil:
+		return title(*message.SenderChat)
+	}
+	return "Deleted Account"
+}
+
+// text returns the text of a message, the caption for media
+func text(message *models.Message) (string, []models.MessageEntity) {
+	if message.Text != "" {
+		return message.Text, message.Entities
+	}
+	return message.Caption, message.CaptionEntities
+}
+
+// file is a file of a message with its archived copy, if any
+type file struct {
+	dao.MessageFile
+	archived *dao.Attachment
+}
+
+// files returns the files of a message
+func files(m *dao.Message, message *models.Message) []file {
+	var out []file
+	for _, f := range dao.MessageFiles(message) {
+		out = append(out, file{MessageFile: f, archived: m.Attachment(f.FileUniqueID)})
+	}
+	return out
+}
+
+// reactions returns the number of reactions per emoji, in order of appearance
+func reactions(m *dao.Message) ([]string, map[string]int) {
+	var emojis []string
+	counts := make(map[string]int)
+	add := func(emoji string, n int) {
+		if _, ok := counts[emoji]; !ok {
+			emojis = append(emojis, emoji)
+		}
+		counts[emoji] += n
+	}
+	for _, r := range m.Reactions {
+		add(r.Emoji, 1)
+	}
+	for _, r := range m.ReactionCounts {
+		add(r.Emoji, r.Count)
+	}
+	return emojis, counts
+}
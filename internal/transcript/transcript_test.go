@@ -0,0 +1,229 @@
+package transcript
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"go.orx.me/xbot/internal/dao"
+)
+
+func testTranscript() *Transcript {
+	chat := models.Chat{ID: -1001234, Type: models.ChatTypeSupergroup, Title: "Ops <team>"}
+	at := time.Date(2025, 1, 2, 15, 4, 0, 0, time.Local)
+	first := &models.Message{
+		ID:   10,
+		Chat: chat,
+		From: &models.User{ID: 7, FirstName: "Ann"},
+		// The emoji is two UTF-16 code units, entity offsets count them
+		Text:     "🚀 deploy <now> at example.com",
+		Entities: []models.MessageEntity{{Type: "bold", Offset: 3, Length: 6}, {Type: "url", Offset: 19, Length: 11}},
+	}
+	second := &models.Message{
+		ID:             11,
+		Chat:           chat,
+		From:           &models.User{ID: 8, FirstName: "Bob"},
+		Caption:        "logs",
+		Document:       &models.Document{FileID: "f", FileUniqueID: "u", FileName: "app.log", MimeType: "text/plain"},
+		ReplyToMessage: first,
+	}
+	return &Transcript{
+		Chat: chat,
+		Messages: []*dao.Message{
+			{Update: &models.Update{Message: first}, CreatedAt: at.Unix(), Reactions: []dao.Reaction{{UserID: 8, Emoji: "👍"}}},
+			{
+				Update:      &models.Update{Message: second},
+				CreatedAt:   at.Add(time.Minute).Unix(),
+				Attachments: []dao.Attachment{{Kind: "document", FileUniqueID: "u", Key: "media/-1001234/app.log"}},
+			},
+		},
+	}
+}
+
+func TestResultJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Render(&buf, FormatJSON, testTranscript()); err != nil {
+		t.Fatal(err)
+	}
+
+	var result Result
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("Unmarshal: %v\n%s", err, buf.String())
+	}
+	if result.ID != 1234 || result.Type != "private_supergroup" || len(result.Messages) != 2 {
+		t.Fatalf("result = %+v", result)
+	}
+
+	first := result.Messages[0]
+	want := Text{
+		{Type: "plain", Text: "🚀 "},
+		{Type: "bold", Text: "deploy"},
+		{Type: "plain", Text: " <now> at "},
+		{Type: "link", Text: "example.com"},
+	}
+	if got, _ := json.Marshal(first.Text); string(got) != mustMarshal(t, want) {
+		t.Errorf("text = %s, want %s", got, mustMarshal(t, want))
+	}
+	if first.FromID != "user7" || first.From != "Ann" || len(first.Reactions) != 1 || first.Reactions[0].Count != 1 {
+		t.Errorf("first message = %+v", first)
+	}
+
+	second := result.Messages[1]
+	if second.Text.String() != "logs" || second.File != "media/-1001234/app.log" || second.ReplyToMessageID != 10 {
+		t.Errorf("second message = %+v", second)
+	}
+	// Unformatted text is a plain string
+	if !strings.Contains(buf.String(), `"text": "logs"`) {
+		t.Errorf("plain text not written as a string:\n%s", buf.String())
+	}
+}
+
+func TestRenderHTMLEscapes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Render(&buf, FormatHTML, testTranscript()); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	for _, want := range []string{
+		"<title>Ops &lt;team&gt;</title>",
+		"<b>deploy</b> &lt;now&gt; at ",
+		`<a href="https://example.com">example.com</a>`,
+		"document app.log (media/-1001234/app.log)",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %q:\n%s", want, page)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2025, 1, 10, 12, 0, 0, 0, time.Local)
+	for in, want := range map[string]time.Time{
+		"2025-01-02": time.Date(2025, 1, 2, 0, 0, 0, 0, time.Local),
+		"7d":         now.AddDate(0, 0, -7),
+		"12h":        now.Add(-12 * time.Hour),
+	} {
+		got, err := ParseSince(in, now)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("ParseSince(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseSince("yesterday", now); err == nil {
+		t.Error("ParseSince(yesterday) succeeded")
+	}
+}
+
+func mustMarshal(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestImport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Render(&buf, FormatJSON, testTranscript()); err != nil {
+		t.Fatal(err)
+	}
+	// A service message, which is not imported
+	export := strings.Replace(buf.String(), `"messages": [`,
+		`"messages": [{"id": 9, "type": "service", "date": "2025-01-02T15:00:00", "date_unixtime": "1735830000", "action": "pin_message", "text": ""},`, 1)
+	result, err := ParseResult(strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ChatID() != -1001234 {
+		t.Fatalf("ChatID() = %d", result.ChatID())
+	}
+
+	ctx := context.Background()
+	storage := dao.NewMemoryMessageStorage()
+	report, err := Import(ctx, storage, result, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 || report.Skipped != 1 || report.Existing != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	imported, err := Load(ctx, storage, -1001234, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Messages) != 2 {
+		t.Fatalf("loaded %d messages", len(imported.Messages))
+	}
+	// The text and its entities survive the round trip
+	want := testTranscript().Messages[0].Update.Message
+	first := imported.Messages[0].Update.Message
+	if first.Text != want.Text || mustMarshal(t, first.Entities) != mustMarshal(t, want.Entities) {
+		t.Errorf("first message = %q %+v, want %q %+v", first.Text, first.Entities, want.Text, want.Entities)
+	}
+	if first.From == nil || first.From.ID != 7 || first.Chat.Type != models.ChatTypeSupergroup {
+		t.Errorf("first message = %+v", first)
+	}
+	if second := imported.Messages[1].Update.Message; second.ReplyToMessage == nil || second.ReplyToMessage.ID != 10 {
+		t.Errorf("second message = %+v", second)
+	}
+
+	// Importing again leaves the stored messages alone
+	report, err = Import(ctx, storage, result, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 0 || report.Existing != 2 {
+		t.Errorf("second import = %+v", report)
+	}
+}
+
+// legacyStorage returns messages as stored before MessageID was recorded
+type legacyStorage struct {
+	dao.MessageStorage
+}
+
+func (s legacyStorage) QueryMessages(ctx context.Context, query dao.MessageQuery) (*dao.MessagePage, error) {
+	page, err := s.MessageStorage.QueryMessages(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range page.Messages {
+		legacy := *m
+		legacy.MessageID = 0
+		page.Messages[i] = &legacy
+	}
+	return page, nil
+}
+
+func TestImportOverLegacyMessages(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Render(&buf, FormatJSON, testTranscript()); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ParseResult(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	storage := legacyStorage{dao.NewMemoryMessageStorage()}
+	for _, m := range testTranscript().Messages {
+		if err := storage.SaveMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The stored messages are found by the ID in their update
+	report, err := Import(ctx, storage, result, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 0 || report.Existing != 2 {
+		t.Errorf("report = %+v", report)
+	}
+}